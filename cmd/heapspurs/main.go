@@ -5,7 +5,6 @@ import (
 	"fmt"
 	"log"
 	"os"
-	"os/exec"
 	"runtime"
 	"runtime/debug"
 	"strconv"
@@ -13,6 +12,7 @@ import (
 
 	"github.com/adamroach/heapspurs/internal/pkg/config"
 	"github.com/adamroach/heapspurs/pkg/heapdump"
+	"github.com/adamroach/heapspurs/pkg/program"
 	"github.com/adamroach/heapspurs/pkg/trace"
 	"github.com/adamroach/heapspurs/pkg/treeclimber"
 )
@@ -23,6 +23,8 @@ func main() {
 		panic(fmt.Sprintf("Config: %v\n", err))
 	}
 
+	dump := heapdump.NewDump()
+
 	hasMallocMeta := len(conf.MallocMeta) > 0
 	hasTrace := len(conf.Trace) > 0
 
@@ -41,8 +43,8 @@ func main() {
 		}
 
 		for _, m := range mappings {
-			heapdump.AddName(m.Ptr, m.TypeName)
-			heapdump.AddNameWithSize(m.Ptr, m.Size, m.TypeName)
+			dump.AddName(m.Ptr, m.TypeName)
+			dump.AddNameWithSize(m.Ptr, m.Size, m.TypeName)
 		}
 
 		file.Close()
@@ -71,8 +73,8 @@ func main() {
 			if err != nil {
 				panic(fmt.Sprintf("Error parsing size '%s': %v\n", parts[2], err))
 			}
-			heapdump.AddName(ptr, name)
-			heapdump.AddNameWithSize(ptr, int(size), name)
+			dump.AddName(ptr, name)
+			dump.AddNameWithSize(ptr, int(size), name)
 		}
 		file.Close()
 	}
@@ -82,7 +84,7 @@ func main() {
 		if err != nil {
 			panic(fmt.Sprintf("Open OID file '%s': %v\n", conf.Oid, err))
 		}
-		err = heapdump.ReadOids(file)
+		err = dump.ReadOids(file)
 		if err != nil {
 			panic(fmt.Sprintf("Reading OID file '%s': %v\n", conf.Oid, err))
 		}
@@ -90,23 +92,60 @@ func main() {
 	}
 
 	if len(conf.Program) > 0 {
-		cmd := exec.Command("go", "tool", "nm", conf.Program)
-		stdout, err := cmd.StdoutPipe()
+		prog, err := program.Open(conf.Program)
 		if err != nil {
 			panic(fmt.Sprintf("Open program file '%s': %v\n", conf.Program, err))
 		}
-		err = cmd.Start()
+		err = dump.ReadSymbols(prog)
 		if err != nil {
-			panic(fmt.Sprintf("Running [go tool nm] on '%s': %v\n", conf.Program, err))
+			fmt.Fprintf(os.Stderr, "Warning: reading symbols from program file '%s': %v\n", conf.Program, err)
 		}
+		lines, err := prog.LineTable()
 		if err != nil {
-			panic(fmt.Sprintf("Open program file '%s': %v\n", conf.Program, err))
+			fmt.Fprintf(os.Stderr, "Warning: no line table in program file '%s': %v\n", conf.Program, err)
+		} else {
+			dump.ReadLineTable(lines)
+		}
+		// Stripped binaries have no DWARF, but still carry the
+		// runtime's own type descriptors.
+		runtimeTypes, runtimeErr := prog.RuntimeTypes()
+		if runtimeErr == nil {
+			dump.ReadTypeDescriptors(runtimeTypes)
 		}
-		err = heapdump.ReadSymbols(stdout)
+		types, err := prog.Types()
 		if err != nil {
-			panic(fmt.Sprintf("Reading program file '%s': %v\n", conf.Program, err))
+			types, err = runtimeTypes, runtimeErr
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: no type information in program file '%s': %v\n", conf.Program, err)
+		} else {
+			dump.ReadTypes(types)
 		}
-		cmd.Wait()
+		prog.Close()
+	}
+
+	if len(conf.TypeFile) > 0 {
+		file, err := os.Open(conf.TypeFile)
+		if err != nil {
+			panic(fmt.Sprintf("Open type file '%s': %v\n", conf.TypeFile, err))
+		}
+		if strings.HasSuffix(conf.TypeFile, ".go") {
+			err = dump.ReadTypeSource(conf.TypeFile, file)
+		} else {
+			err = dump.ReadTypeFile(file)
+		}
+		if err != nil {
+			panic(fmt.Sprintf("Reading type file '%s': %v\n", conf.TypeFile, err))
+		}
+		file.Close()
+	}
+
+	if conf.Types {
+		err = dump.PrintTypes()
+		if err != nil {
+			panic(err)
+		}
+		return
 	}
 
 	file, err := os.Open(conf.Dumpfile)
@@ -116,7 +155,7 @@ func main() {
 	reader := bufio.NewReader(file)
 
 	if conf.Print {
-		err = heapdump.PrintRecords(reader, "")
+		err = dump.PrintRecords(reader)
 		if err != nil {
 			panic(err)
 		}
@@ -124,14 +163,14 @@ func main() {
 	}
 
 	if len(conf.Find) > 0 {
-		err = heapdump.PrintRecords(reader, conf.Find)
+		err = dump.FindRecords(reader, conf.Find)
 		if err != nil {
 			panic(err)
 		}
 		return
 	}
 
-	climber, err := treeclimber.NewTreeClimber(reader)
+	climber, err := treeclimber.NewTreeClimber(dump, reader)
 
 	if len(conf.MakeDump) > 0 {
 		f, err := os.Create(conf.MakeDump)
@@ -166,6 +205,111 @@ func main() {
 		return
 	}
 
+	if conf.Globals {
+		err := climber.PrintGlobals()
+		if err != nil {
+			panic(err)
+		}
+		return
+	}
+
+	if conf.Decode {
+		decoded, err := climber.Decode(conf.Address)
+		if err != nil {
+			panic(err)
+		}
+		fmt.Print(decoded)
+		return
+	}
+
+	if conf.Histogram {
+		err := climber.PrintHistogram()
+		if err != nil {
+			panic(err)
+		}
+		return
+	}
+
+	if conf.Strings {
+		err := climber.PrintStrings()
+		if err != nil {
+			panic(err)
+		}
+		return
+	}
+
+	if conf.Pinned {
+		err := climber.PrintPinned()
+		if err != nil {
+			panic(err)
+		}
+		return
+	}
+
+	if conf.Channels {
+		err := climber.PrintChannels()
+		if err != nil {
+			panic(err)
+		}
+		return
+	}
+
+	if conf.Goroutines {
+		err := climber.PrintGoroutines()
+		if err != nil {
+			panic(err)
+		}
+		return
+	}
+
+	if conf.GoroutineMem {
+		err := climber.PrintGoroutineMemory()
+		if err != nil {
+			panic(err)
+		}
+		return
+	}
+
+	if conf.Creators {
+		err := climber.PrintGoroutineCreators()
+		if err != nil {
+			panic(err)
+		}
+		return
+	}
+
+	if conf.BlockedFor > 0 {
+		err := climber.PrintBlockedGoroutines(conf.BlockedFor)
+		if err != nil {
+			panic(err)
+		}
+		return
+	}
+
+	if conf.Threads {
+		err := climber.PrintThreads()
+		if err != nil {
+			panic(err)
+		}
+		return
+	}
+
+	if conf.Stats {
+		err := climber.PrintStats()
+		if err != nil {
+			panic(err)
+		}
+		return
+	}
+
+	if conf.Roots {
+		err := climber.PrintRoots()
+		if err != nil {
+			panic(err)
+		}
+		return
+	}
+
 	if conf.Hexdump {
 		hexdump, err := climber.Hexdump(conf.Address)
 		if err != nil {
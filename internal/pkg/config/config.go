@@ -4,26 +4,42 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 )
 
 type Config struct {
-	Dumpfile   string
-	Output     string
-	Oid        string
-	MallocMeta string
-	Trace      string
-	Program    string
-	Address    uint64
-	Children   bool
-	Print      bool
-	Find       string
-	Hexdump    bool
-	Anchors    bool
-	Owners     int
-	MakeDump   string
+	Dumpfile     string
+	Output       string
+	Oid          string
+	MallocMeta   string
+	Trace        string
+	Program      string
+	TypeFile     string
+	Address      uint64
+	Children     bool
+	Print        bool
+	Find         string
+	Hexdump      bool
+	Decode       bool
+	Anchors      bool
+	Owners       int
+	Globals      bool
+	Histogram    bool
+	Strings      bool
+	Pinned       bool
+	Channels     bool
+	Goroutines   bool
+	GoroutineMem bool
+	Creators     bool
+	BlockedFor   time.Duration `mapstructure:"blocked-longer-than"`
+	Threads      bool
+	Stats        bool
+	Roots        bool
+	Types        bool
+	MakeDump     string
 }
 
 func Initialize() (*Config, error) {
@@ -34,13 +50,28 @@ func Initialize() (*Config, error) {
 	flag.String("mallocmeta", "", "File that maps from ptrs to object names. Line format: $$$ 0x14000100180 os.file")
 	flag.String("trace", "", "trace output when process ran with GODEBUG=traceallocfree=1")
 	flag.String("program", "", "File to read symbol information from")
+	flag.String("typefile", "", "File of type layouts (size, pointer offsets, and name), or Go source file of type declarations, to recognize objects by")
 	flag.Int("address", 0, "Address of object to analyze")
 	// flag.Bool("children", false, "If set, will show children rather than parents")
 	flag.Bool("print", false, "If set, will list all dumpfile records and exit")
 	flag.String("find", "", "Finds an object whose name matches the specified regular expression")
 	flag.Bool("hexdump", false, "If set, will print a hexdump of the specified object and exit")
+	flag.Bool("decode", false, "If set, will print the fields of the specified object, decoded according to its type, and exit")
 	flag.Bool("anchors", false, "If set, will print a list of the anchors keeping the indicated object alive")
 	flag.Int("owners", 0, "If positive, will print the owners of the specified object to the depth indicated, and exit; if negative, will print owners to their full depth")
+	flag.Bool("globals", false, "If set, will print the global variables that retain the most memory and exit")
+	flag.Bool("histogram", false, "If set, will print the number of objects and bytes of each type and exit")
+	flag.Bool("strings", false, "If set, will print every string in the heap, along with what holds it, and exit")
+	flag.Bool("pinned", false, "If set, will print objects that are kept alive only by pointers to a small part of them, and exit")
+	flag.Bool("channels", false, "If set, will print every channel, along with its buffer and the goroutines blocked on it, and exit")
+	flag.Bool("goroutines", false, "If set, will print every goroutine, grouped by identical stacks, and exit")
+	flag.Bool("goroutinemem", false, "If set, will print the goroutines (and groups of goroutines with identical stacks) that retain the most memory and exit")
+	flag.Bool("creators", false, "If set, will print goroutines grouped by the go statement that created them, what they're waiting for, and where, and exit")
+	flag.Duration("blocked-longer-than", 0, "If set, will print the goroutines that have been blocked for at least this long (e.g. 10m), with their stacks and the objects they keep alive, and exit")
+	flag.Bool("threads", false, "If set, will print every OS thread, with its runtime.m and the goroutine running on it, followed by the goroutines in system calls, and exit")
+	flag.Bool("stats", false, "If set, will print the runtime's memory statistics and GC pauses, compare them with the contents of the dump, and exit")
+	flag.Bool("roots", false, "If set, will print how much of the heap is reachable from goroutine stacks, globals, finalizers and other roots, and from which of them, and exit")
+	flag.Bool("types", false, "If set, will print the types read from the program file and exit")
 	flag.String("makedump", "", "For debugging and examples: dump heapspurs' heap")
 
 	v := viper.New()
@@ -63,7 +94,7 @@ func Initialize() (*Config, error) {
 	args := pflag.Args()
 	if len(args) > 0 {
 		conf.Dumpfile = args[0]
-	} else if len(conf.Dumpfile) == 0 {
+	} else if len(conf.Dumpfile) == 0 && !conf.Types {
 		pflag.Usage()
 		os.Exit(-1)
 	}
@@ -0,0 +1,319 @@
+package gotype
+
+// Describes the memory layout of Go types, independent of where the
+// description came from (DWARF, runtime type descriptors, and so on).
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+type Kind int
+
+const (
+	Invalid Kind = iota
+	Bool
+	Int
+	Uint
+	Uintptr
+	Float
+	Complex
+	String
+	Pointer
+	UnsafePointer
+	Slice
+	Array
+	Struct
+	Interface
+	Map
+	Chan
+	Func
+)
+
+var kindNames = []string{
+	"invalid", "bool", "int", "uint", "uintptr", "float", "complex",
+	"string", "pointer", "unsafe.Pointer", "slice", "array", "struct",
+	"interface", "map", "chan", "func",
+}
+
+func (k Kind) String() string {
+	if int(k) < len(kindNames) {
+		return kindNames[k]
+	}
+	return fmt.Sprintf("Kind(%d)", int(k))
+}
+
+type Type struct {
+	Name   string
+	Kind   Kind
+	Size   uint64
+	Elem   *Type   // Pointer, Slice, Array: element type; Map, Chan: runtime header
+	Len    uint64  // Array only
+	Fields []Field // Struct; Interface, if the words are named
+	Bitmap []byte  // GC pointer bitmap, one bit per word; nil if unknown
+}
+
+type Field struct {
+	Name   string
+	Offset uint64
+	Type   *Type
+}
+
+func (t *Type) String() string {
+	return fmt.Sprintf("%s (%s, %d bytes)", t.Name, t.Kind, t.Size)
+}
+
+// Returns the name of the type without its package path, so that
+// "runtime.m" becomes "m" and "*main.Session" becomes "*Session".
+func (t *Type) ShortName() string {
+	prefix := len(t.Name) - len(strings.TrimLeft(t.Name, "*[]0123456789"))
+	name := t.Name[prefix:]
+	if strings.ContainsAny(name, "[(< ") {
+		return t.Name
+	}
+	if i := strings.LastIndex(name, "."); i >= 0 {
+		name = name[i+1:]
+	}
+	return t.Name[:prefix] + name
+}
+
+// A word-sized (or larger) leaf of a type: the innermost value that
+// isn't a struct or an array.
+type Slot struct {
+	Offset uint64 // offset of the leaf from the start of the outer type
+	Path   string // e.g. "freelink" or "peers[2].name"
+	Type   *Type
+}
+
+// Returns the leaf that contains the indicated offset.
+func (t *Type) SlotAt(offset uint64) (Slot, bool) {
+	slot := Slot{Type: t}
+	for {
+		if offset >= slot.Type.Size {
+			return slot, false
+		}
+		switch slot.Type.Kind {
+		case Interface:
+			if len(slot.Type.Fields) == 0 {
+				return slot, true
+			}
+			fallthrough
+		case Struct:
+			i := sort.Search(len(slot.Type.Fields), func(i int) bool {
+				return slot.Type.Fields[i].Offset > offset
+			}) - 1
+			if i < 0 {
+				return slot, false
+			}
+			f := slot.Type.Fields[i]
+			if offset-f.Offset >= f.Type.Size {
+				return slot, false
+			}
+			if len(slot.Path) > 0 {
+				slot.Path += "."
+			}
+			slot.Path += f.Name
+			slot.Offset += f.Offset
+			offset -= f.Offset
+			slot.Type = f.Type
+		case Array:
+			if slot.Type.Elem.Size == 0 {
+				return slot, false
+			}
+			index := offset / slot.Type.Elem.Size
+			slot.Path += fmt.Sprintf("[%d]", index)
+			slot.Offset += index * slot.Type.Elem.Size
+			offset -= index * slot.Type.Elem.Size
+			slot.Type = slot.Type.Elem
+		default:
+			return slot, true
+		}
+	}
+}
+
+// Reports whether a pointer can live at the indicated offset into a
+// leaf of this type.
+func (t *Type) HoldsPointerAt(offset uint64, ptrSize uint64) bool {
+	switch t.Kind {
+	case Pointer, UnsafePointer, Map, Chan, Func, String, Slice:
+		return offset == 0
+	case Interface:
+		return offset == 0 || offset == ptrSize
+	}
+	return false
+}
+
+// Returns the offsets of every word in the type that can hold a pointer.
+// When we have the runtime's GC bitmap for the type, that's the final
+// word on the matter; otherwise, we work it out from the type's layout.
+func (t *Type) PointerOffsets(ptrSize uint64) []uint64 {
+	offsets := make([]uint64, 0)
+	if t.Bitmap != nil {
+		for i := 0; i < 8*len(t.Bitmap); i++ {
+			if t.Bitmap[i/8]&(1<<(i%8)) != 0 {
+				offsets = append(offsets, uint64(i)*ptrSize)
+			}
+		}
+		return offsets
+	}
+	t.walkPointers(0, ptrSize, func(offset uint64, typeWord bool) {
+		offsets = append(offsets, offset)
+	})
+	return offsets
+}
+
+// Returns the offsets of the first word of each interface in the type.
+// These point to type descriptors or itabs, which aren't in the heap,
+// so newer runtimes don't tell the garbage collector about them. They
+// are never included in GC bitmaps.
+func (t *Type) TypeWordOffsets(ptrSize uint64) []uint64 {
+	offsets := make([]uint64, 0)
+	if t.Bitmap != nil {
+		return offsets
+	}
+	t.walkPointers(0, ptrSize, func(offset uint64, typeWord bool) {
+		if typeWord {
+			offsets = append(offsets, offset)
+		}
+	})
+	return offsets
+}
+
+func (t *Type) hasPointers(ptrSize uint64) bool {
+	switch t.Kind {
+	case Struct:
+		for _, field := range t.Fields {
+			if field.Type.hasPointers(ptrSize) {
+				return true
+			}
+		}
+		return false
+	case Array:
+		return t.Len > 0 && t.Elem.hasPointers(ptrSize)
+	case Interface:
+		return true
+	}
+	return t.HoldsPointerAt(0, ptrSize)
+}
+
+func (t *Type) walkPointers(base uint64, ptrSize uint64, f func(offset uint64, typeWord bool)) {
+	switch t.Kind {
+	case Struct:
+		for _, field := range t.Fields {
+			field.Type.walkPointers(base+field.Offset, ptrSize, f)
+		}
+	case Array:
+		if !t.Elem.hasPointers(ptrSize) {
+			return
+		}
+		for i := uint64(0); i < t.Len; i++ {
+			t.Elem.walkPointers(base+i*t.Elem.Size, ptrSize, f)
+		}
+	case Interface:
+		f(base, true)
+		f(base+ptrSize, false)
+	default:
+		if t.HoldsPointerAt(0, ptrSize) {
+			f(base, false)
+		}
+	}
+}
+
+///////////////////////////////////////////////////////////////////////////
+
+// A global variable, as described by the program's debug information.
+type Variable struct {
+	Name    string
+	Address uint64 // link-time address
+	Type    *Type
+}
+
+// A function's parameters and local variables, as described by the
+// program's debug information.
+type Function struct {
+	Name  string
+	Entry uint64 // link-time address
+	Vars  []LocalVariable
+}
+
+type LocalVariable struct {
+	Name      string
+	Param     bool
+	Type      *Type // nil if unknown
+	Locations []Location
+}
+
+// Where a variable (or a piece of one) lives on the stack while the
+// function is at a given range of PCs. Offsets are from the canonical
+// frame address: the caller's stack pointer just before the call.
+type Location struct {
+	Low, High uint64 // link-time PCs; both zero if it's always there
+	Offset    int64  // from the CFA
+	Piece     uint64 // offset of this piece into the variable
+	Size      uint64 // size of this piece; zero for the whole variable
+}
+
+// The set of types known for a program.
+type Table struct {
+	types       map[string]*Type
+	functions   map[string]*Function
+	Globals     []Variable       // Sorted by address
+	Descriptors map[uint64]*Type // The runtime's type descriptors, by link-time address, if read from them
+	PtrSize     uint64
+}
+
+func NewTable() *Table {
+	return &Table{types: make(map[string]*Type), functions: make(map[string]*Function)}
+}
+
+func (t *Table) Add(typ *Type) {
+	if len(typ.Name) > 0 {
+		if _, found := t.types[typ.Name]; !found {
+			t.types[typ.Name] = typ
+		}
+	}
+}
+
+func (t *Table) Lookup(name string) *Type {
+	return t.types[name]
+}
+
+func (t *Table) AddGlobal(v Variable) {
+	t.Globals = append(t.Globals, v)
+}
+
+func (t *Table) AddFunction(f *Function) {
+	if _, found := t.functions[f.Name]; !found {
+		t.functions[f.Name] = f
+	}
+}
+
+// Returns the function with the indicated name, if the program
+// describes its variables.
+func (t *Table) Function(name string) *Function {
+	return t.functions[name]
+}
+
+func (t *Table) Len() int {
+	return len(t.types)
+}
+
+// Calls f for every known type, in name order.
+func (t *Table) Each(f func(*Type)) {
+	names := make([]string, 0, len(t.types))
+	for name := range t.types {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		f(t.types[name])
+	}
+}
+
+// Must be called once all globals have been added.
+func (t *Table) Sort() {
+	sort.SliceStable(t.Globals, func(i, j int) bool {
+		return t.Globals[i].Address < t.Globals[j].Address
+	})
+}
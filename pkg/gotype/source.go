@@ -0,0 +1,136 @@
+package gotype
+
+// Reads type layouts from Go source code, so that users can describe
+// types that the program file doesn't (or when they don't have the
+// program file at all).
+
+import (
+	"fmt"
+	"go/ast"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"io"
+)
+
+// Parses a Go source file and returns the layout of every type it
+// declares, along with the types those refer to. Layouts are computed
+// for the gc compiler, with the indicated pointer size.
+func ParseSource(filename string, src io.Reader, ptrSize uint64) (*Table, error) {
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, filename, src, 0)
+	if err != nil {
+		return nil, err
+	}
+	arch := "amd64"
+	if ptrSize == 4 {
+		arch = "386"
+	}
+	conf := types.Config{
+		Importer: importer.ForCompiler(fset, "source", nil),
+		Sizes:    types.SizesFor("gc", arch),
+	}
+	pkg, err := conf.Check(file.Name.Name, fset, []*ast.File{file}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &sourceConverter{
+		sizes:   conf.Sizes,
+		ptrSize: ptrSize,
+		types:   make(map[types.Type]*Type),
+		table:   NewTable(),
+	}
+	c.table.PtrSize = ptrSize
+	scope := pkg.Scope()
+	for _, name := range scope.Names() {
+		if tn, isType := scope.Lookup(name).(*types.TypeName); isType {
+			c.convert(tn.Type())
+		}
+	}
+	if c.table.Len() == 0 {
+		return nil, fmt.Errorf("No types declared in '%s'", filename)
+	}
+	return c.table, nil
+}
+
+type sourceConverter struct {
+	sizes   types.Sizes
+	ptrSize uint64
+	types   map[types.Type]*Type
+	table   *Table
+}
+
+// Names types the way the compiler does, with full package paths.
+func qualifier(p *types.Package) string {
+	return p.Path()
+}
+
+func (c *sourceConverter) convert(t types.Type) *Type {
+	if r, found := c.types[t]; found {
+		return r
+	}
+	r := &Type{Name: types.TypeString(t, qualifier), Size: uint64(c.sizes.Sizeof(t))}
+	c.types[t] = r
+
+	switch u := t.Underlying().(type) {
+	case *types.Basic:
+		info := u.Info()
+		switch {
+		case u.Kind() == types.UnsafePointer:
+			r.Kind = UnsafePointer
+		case u.Kind() == types.Uintptr:
+			r.Kind = Uintptr
+		case info&types.IsBoolean != 0:
+			r.Kind = Bool
+		case info&types.IsUnsigned != 0:
+			r.Kind = Uint
+		case info&types.IsInteger != 0:
+			r.Kind = Int
+		case info&types.IsFloat != 0:
+			r.Kind = Float
+		case info&types.IsComplex != 0:
+			r.Kind = Complex
+		case info&types.IsString != 0:
+			r.Kind = String
+		}
+	case *types.Pointer:
+		r.Kind = Pointer
+		r.Elem = c.convert(u.Elem())
+	case *types.Slice:
+		r.Kind = Slice
+		r.Elem = c.convert(u.Elem())
+	case *types.Array:
+		r.Kind = Array
+		r.Elem = c.convert(u.Elem())
+		r.Len = uint64(u.Len())
+	case *types.Struct:
+		r.Kind = Struct
+		vars := make([]*types.Var, u.NumFields())
+		for i := range vars {
+			vars[i] = u.Field(i)
+		}
+		offsets := c.sizes.Offsetsof(vars)
+		for i, v := range vars {
+			r.Fields = append(r.Fields, Field{Name: v.Name(), Offset: uint64(offsets[i]), Type: c.convert(v.Type())})
+		}
+	case *types.Interface:
+		r.Kind = Interface
+		first := "tab"
+		if u.Empty() {
+			first = "_type"
+		}
+		word := &Type{Name: "unsafe.Pointer", Kind: UnsafePointer, Size: c.ptrSize}
+		r.Fields = []Field{{Name: first, Type: word}, {Name: "data", Offset: c.ptrSize, Type: word}}
+	case *types.Map:
+		r.Kind = Map
+	case *types.Chan:
+		r.Kind = Chan
+	case *types.Signature:
+		r.Kind = Func
+	}
+
+	c.table.Add(r)
+	return r
+}
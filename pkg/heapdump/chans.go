@@ -0,0 +1,255 @@
+package heapdump
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/adamroach/heapspurs/pkg/gotype"
+)
+
+// A Go channel: the runtime.hchan header, its buffer (which is part of
+// the header if the elements have no pointers), and the goroutines that
+// are blocked sending to it or receiving from it.
+type ChanInfo struct {
+	Header   *Object
+	Name     string // e.g. "chan *main.Job", or just "chan" if we don't know the type
+	Capacity uint64 // elements
+	Count    uint64 // elements currently in the buffer
+	ElemSize uint64
+	Closed   bool
+	Timer    bool    // it belongs to a time.Timer or time.Ticker, so the runtime will send to it
+	Buffer   *Object // the buffer, if it's separate from the header
+	Bytes    uint64  // size of the buffer, in bytes
+	Waiters  []ChanWaiter
+}
+
+// A goroutine that's blocked on a channel.
+type ChanWaiter struct {
+	Goroutine *Goroutine
+	Direction string  // "send", "receive", or "select" if we can't tell
+	Sudog     *Object // the runtime.sudog that queues it on the channel; nil if found by its WaitReason
+}
+
+func (c *ChanInfo) String() string {
+	s := fmt.Sprintf("cap %d, %d buffered, %d bytes, %d waiting", c.Capacity, c.Count, c.Bytes, len(c.Waiters))
+	if c.Closed {
+		s += ", closed"
+	}
+	if c.Timer {
+		s += ", timer"
+	}
+	return s
+}
+
+// Where the interesting parts of runtime.hchan are.
+type chanLayout struct {
+	qcount, dataqsiz, buf, elemsize, closed, timer, elemtype, sendx, recvx, recvq, sendq uint64
+}
+
+const noField = ^uint64(0)
+
+// Reads the layout from the runtime's own description of hchan, if we
+// have one; otherwise, assumes the layout used since Go 1.23.
+func hchanLayout(t *gotype.Type, ptrSize uint64) chanLayout {
+	ps := ptrSize
+	l := chanLayout{
+		qcount: 0, dataqsiz: ps, buf: 2 * ps, elemsize: 3 * ps, closed: 3*ps + 4, timer: 3*ps + 8,
+		elemtype: 4*ps + 8, sendx: 5*ps + 8, recvx: 6*ps + 8, recvq: 7*ps + 8, sendq: 9*ps + 8,
+	}
+	if t == nil {
+		return l
+	}
+	l.timer = noField // Before Go 1.23
+	for _, f := range t.Fields {
+		switch f.Name {
+		case "qcount":
+			l.qcount = f.Offset
+		case "dataqsiz":
+			l.dataqsiz = f.Offset
+		case "buf":
+			l.buf = f.Offset
+		case "elemsize":
+			l.elemsize = f.Offset
+		case "closed":
+			l.closed = f.Offset
+		case "timer":
+			l.timer = f.Offset
+		case "elemtype":
+			l.elemtype = f.Offset
+		case "sendx":
+			l.sendx = f.Offset
+		case "recvx":
+			l.recvx = f.Offset
+		case "recvq":
+			l.recvq = f.Offset
+		case "sendq":
+			l.sendq = f.Offset
+		}
+	}
+	return l
+}
+
+func isChanHeader(t *gotype.Type) bool {
+	return t.Name == "runtime.hchan" || strings.HasPrefix(t.Name, "hchan<")
+}
+
+// Finds channel headers, and the goroutines that are blocked on them.
+// As with maps, headers with a known type are taken at their word, and
+// anything else has to look like a consistent hchan before we believe
+// it: unbuffered channels point to themselves, buffers have to fit,
+// and anything in the wait queues has to lead back to a goroutine.
+func (d *Dump) findChans(goroutines map[uint64]*Goroutine, p *DumpParams) []*ChanInfo {
+	chans := make([]*ChanInfo, 0)
+	layout := hchanLayout(d.types.Lookup("runtime.hchan"), p.PointerSize)
+	for _, o := range d.heapObjects {
+		if o.Chan != nil || o.Map != nil {
+			continue
+		}
+		typed := o.Type != nil && isChanHeader(o.Type)
+		l := layout
+		if typed {
+			l = hchanLayout(o.Type, p.PointerSize)
+		} else if len(o.Name) > 0 && !strings.HasPrefix(o.Name, "chan ") {
+			continue
+		}
+		c := d.readChan(o, l, typed, goroutines, p)
+		if c == nil {
+			continue
+		}
+
+		c.Name = "chan"
+		if strings.HasPrefix(o.Name, "chan ") {
+			c.Name = o.Name
+		} else if len(o.Name) == 0 {
+			o.Name = c.Name
+			d.AddName(o.Address, c.Name)
+		}
+		o.Chan = c
+		if c.Buffer != nil {
+			c.Buffer.Chan = c
+			if len(c.Buffer.Name) == 0 {
+				c.Buffer.Name = c.Name + " (buffer)"
+				d.AddName(c.Buffer.Address, c.Buffer.Name)
+			}
+		}
+		for _, w := range c.Waiters {
+			w.Goroutine.Chans = append(w.Goroutine.Chans, c)
+		}
+		chans = append(chans, c)
+	}
+	d.findChanWaiters(chans, goroutines, p)
+	return chans
+}
+
+func (d *Dump) readChan(o *Object, l chanLayout, typed bool, goroutines map[uint64]*Goroutine, p *DumpParams) *ChanInfo {
+	ps := p.PointerSize
+	end := o.Address + uint64(len(o.Contents))
+	if uint64(len(o.Contents)) < l.sendq+2*ps {
+		return nil
+	}
+	c := &ChanInfo{
+		Header:   o,
+		Count:    ReadWord(o.Contents, l.qcount, p),
+		Capacity: ReadWord(o.Contents, l.dataqsiz, p),
+		ElemSize: readUint(o, l.elemsize, 2, p),
+		Closed:   readUint(o, l.closed, 4, p) != 0,
+	}
+	c.Bytes = c.Capacity * c.ElemSize
+	if l.timer != noField {
+		c.Timer = ReadWord(o.Contents, l.timer, p) != 0
+	}
+	buf := ReadWord(o.Contents, l.buf, p)
+
+	if !typed {
+		elemtype := ReadWord(o.Contents, l.elemtype, p)
+		sendx, recvx := ReadWord(o.Contents, l.sendx, p), ReadWord(o.Contents, l.recvx, p)
+		if c.Count > c.Capacity || readUint(o, l.closed, 4, p) > 1 || elemtype == 0 || d.FindObject(elemtype) != nil ||
+			sendx > c.Capacity || recvx > c.Capacity {
+			return nil
+		}
+		switch {
+		case c.Bytes == 0:
+			// There's nothing to buffer, so buf points at itself.
+			if buf != o.Address+l.buf {
+				return nil
+			}
+		case buf > o.Address && buf < end:
+			if buf < o.Address+l.sendq+2*ps || buf+c.Bytes > end {
+				return nil
+			}
+		default:
+			b, found := d.objectAt(buf, p)
+			if !found || buf+c.Bytes > b.Address+uint64(len(b.Contents)) {
+				return nil
+			}
+		}
+	}
+	if c.Bytes > 0 && (buf < o.Address || buf >= end) {
+		c.Buffer, _ = d.objectAt(buf, p)
+	}
+
+	for _, q := range []struct {
+		offset    uint64
+		direction string
+	}{{l.recvq, "receive"}, {l.sendq, "send"}} {
+		first, last := ReadWord(o.Contents, q.offset, p), ReadWord(o.Contents, q.offset+ps, p)
+		if (first == 0) != (last == 0) {
+			return nil
+		}
+		seen := make(map[uint64]bool)
+		for sg := first; sg != 0 && !seen[sg]; {
+			seen[sg] = true
+			sudog, found := d.objectAt(sg, p)
+			if !found || uint64(len(sudog.Contents)) < 2*ps {
+				return nil
+			}
+			g, found := goroutines[ReadWord(sudog.Contents, 0, p)]
+			if !found {
+				return nil
+			}
+			c.Waiters = append(c.Waiters, ChanWaiter{Goroutine: g, Direction: q.direction, Sudog: sudog})
+			sg = ReadWord(sudog.Contents, ps, p)
+		}
+	}
+	return c
+}
+
+// Goroutines that are waiting on a channel but aren't in any wait
+// queue that we could follow are matched up by their WaitReason with
+// the channel that their stack points to, if there's only one.
+func (d *Dump) findChanWaiters(chans []*ChanInfo, goroutines map[uint64]*Goroutine, p *DumpParams) {
+	if len(chans) == 0 {
+		return
+	}
+	for _, g := range goroutines {
+		direction := ""
+		switch {
+		case g.Status != Waiting || len(g.Chans) > 0 || strings.Contains(g.WaitReason, "nil chan"):
+		case strings.HasPrefix(g.WaitReason, "chan send"):
+			direction = "send"
+		case strings.HasPrefix(g.WaitReason, "chan receive"):
+			direction = "receive"
+		case g.WaitReason == "select":
+			direction = "select"
+		}
+		if len(direction) == 0 {
+			continue
+		}
+		referenced := make(map[*ChanInfo]bool)
+		for _, frame := range g.Frames {
+			for _, ptr := range GetPointers(frame, p) {
+				if o, found := d.objectAt(ptr, p); found && o.Chan != nil && o.Chan.Header == o {
+					referenced[o.Chan] = true
+				}
+			}
+		}
+		if len(referenced) != 1 {
+			// If there's more than one, we can't tell which.
+			continue
+		}
+		for c := range referenced {
+			c.Waiters = append(c.Waiters, ChanWaiter{Goroutine: g, Direction: direction})
+			g.Chans = append(g.Chans, c)
+		}
+	}
+}
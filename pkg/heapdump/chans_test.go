@@ -0,0 +1,175 @@
+package heapdump
+
+import (
+	"testing"
+
+	"github.com/adamroach/heapspurs/pkg/gotype"
+)
+
+func TestHchanLayout(t *testing.T) {
+	if l := hchanLayout(nil, 8); l.buf != 16 || l.elemsize != 24 || l.closed != 28 || l.timer != 32 || l.recvq != 64 || l.sendq != 80 {
+		t.Errorf("hchanLayout(nil) = %+v; want the Go 1.23 layout", l)
+	}
+	// Before Go 1.23, there was no timer field.
+	old := &gotype.Type{Name: "runtime.hchan", Fields: []gotype.Field{
+		{Name: "qcount", Offset: 0}, {Name: "dataqsiz", Offset: 8}, {Name: "buf", Offset: 16},
+		{Name: "elemsize", Offset: 24}, {Name: "closed", Offset: 28}, {Name: "elemtype", Offset: 32},
+		{Name: "sendx", Offset: 40}, {Name: "recvx", Offset: 48}, {Name: "recvq", Offset: 56}, {Name: "sendq", Offset: 72},
+	}}
+	if l := hchanLayout(old, 8); l.timer != noField || l.elemtype != 32 || l.recvq != 56 || l.sendq != 72 {
+		t.Errorf("hchanLayout(go1.22) = %+v", l)
+	}
+}
+
+func TestReadChan(t *testing.T) {
+	const header, buffer, sudog1, sudog2, g1, g2, elemtype = 0x1000, 0x2000, 0x3000, 0x3100, 0x4000, 0x4100, 0x900000
+	type hchan struct {
+		qcount, dataqsiz, buf, elemsize, closed, timer, elemtype uint64
+		recvq, sendq                                             [2]uint64
+	}
+	tests := []struct {
+		name     string
+		c        hchan
+		found    bool
+		buffered bool
+		waiters  []string
+	}{
+		{
+			name:  "unbuffered",
+			c:     hchan{buf: header + 16, elemsize: 8, elemtype: elemtype},
+			found: true,
+		},
+		{
+			name:     "buffered",
+			c:        hchan{qcount: 2, dataqsiz: 4, buf: buffer, elemsize: 8, elemtype: elemtype},
+			found:    true,
+			buffered: true,
+		},
+		{
+			// Elements without pointers are stored right after the
+			// header.
+			name:  "inline buffer",
+			c:     hchan{qcount: 1, dataqsiz: 2, buf: header + 96, elemsize: 8, elemtype: elemtype},
+			found: true,
+		},
+		{
+			name:    "closed, with waiters",
+			c:       hchan{buf: header + 16, elemtype: elemtype, closed: 1, recvq: [2]uint64{sudog1, sudog2}},
+			found:   true,
+			waiters: []string{"receive", "receive"},
+		},
+		{
+			name:    "sender",
+			c:       hchan{buf: header + 16, elemtype: elemtype, sendq: [2]uint64{sudog2, sudog2}},
+			found:   true,
+			waiters: []string{"send"},
+		},
+		{name: "overfull", c: hchan{qcount: 5, dataqsiz: 4, buf: buffer, elemsize: 8, elemtype: elemtype}},
+		{name: "buffer too small", c: hchan{dataqsiz: 8, buf: buffer, elemsize: 8, elemtype: elemtype}},
+		{name: "unbuffered pointing elsewhere", c: hchan{buf: buffer, elemtype: elemtype}},
+		{name: "bad closed flag", c: hchan{buf: header + 16, elemtype: elemtype, closed: 2}},
+		{name: "no element type", c: hchan{buf: header + 16}},
+		{name: "element type in the heap", c: hchan{buf: header + 16, elemtype: buffer}},
+		{name: "half a queue", c: hchan{buf: header + 16, elemtype: elemtype, recvq: [2]uint64{sudog1, 0}}},
+		{name: "queue of strangers", c: hchan{buf: header + 16, elemtype: elemtype, recvq: [2]uint64{buffer, buffer}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := test.c
+			contents := words(c.qcount, c.dataqsiz, c.buf, c.elemsize|c.closed<<32, c.timer, c.elemtype, 0, 0,
+				c.recvq[0], c.recvq[1], c.sendq[0], c.sendq[1], 0, 0)
+			h := &Object{Address: header, Contents: contents, Fields: []uint64{16, 64, 72, 80, 88}}
+			goroutines := map[uint64]*Goroutine{g1: {Address: g1}, g2: {Address: g2}}
+			d := newTestDump(h,
+				&Object{Address: buffer, Contents: make([]byte, 32)},
+				// Each sudog's goroutine, then the next sudog.
+				&Object{Address: sudog1, Contents: words(g1, sudog2)},
+				&Object{Address: sudog2, Contents: words(g2, 0)},
+			)
+
+			info := d.readChan(h, hchanLayout(nil, 8), false, goroutines, testParams)
+			if (info != nil) != test.found {
+				t.Fatalf("readChan() = %v; want found %v", info, test.found)
+			}
+			if info == nil {
+				return
+			}
+			if info.Count != c.qcount || info.Capacity != c.dataqsiz || info.Bytes != c.dataqsiz*c.elemsize || info.Closed != (c.closed != 0) {
+				t.Errorf("readChan() = %v", info)
+			}
+			if (info.Buffer != nil) != test.buffered {
+				t.Errorf("Buffer = %v; want buffered %v", info.Buffer, test.buffered)
+			}
+			directions := make([]string, 0)
+			for _, w := range info.Waiters {
+				directions = append(directions, w.Direction)
+			}
+			if len(directions) != len(test.waiters) {
+				t.Fatalf("Waiters = %v; want %v", directions, test.waiters)
+			}
+			for i := range directions {
+				if directions[i] != test.waiters[i] {
+					t.Errorf("Waiters = %v; want %v", directions, test.waiters)
+				}
+			}
+		})
+	}
+}
+
+// Goroutines that no wait queue leads to are matched with the channel
+// that their stack points to, but only if there's just the one.
+func TestFindChanWaiters(t *testing.T) {
+	const header1, header2 = 0x1000, 0x2000
+	hchan := func(addr uint64) *Object {
+		return &Object{Address: addr, Contents: words(0, 0, addr+16, 0, 0, 0x900000, 0, 0, 0, 0, 0, 0), Fields: []uint64{16}}
+	}
+	frame := func(pointers ...uint64) []*StackFrame {
+		fields := make([]uint64, len(pointers))
+		for i := range pointers {
+			fields[i] = uint64(8 * i)
+		}
+		return []*StackFrame{{Contents: words(pointers...), Fields: fields}}
+	}
+	receiver := &Goroutine{Address: 0x5000, Status: Waiting, WaitReason: "chan receive", Frames: frame(header1)}
+	sender := &Goroutine{Address: 0x5100, Status: Waiting, WaitReason: "chan send", Frames: frame(header1)}
+	selecting := &Goroutine{Address: 0x5200, Status: Waiting, WaitReason: "select", Frames: frame(header2)}
+	ambiguous := &Goroutine{Address: 0x5300, Status: Waiting, WaitReason: "chan receive", Frames: frame(header1, header2)}
+	nilChan := &Goroutine{Address: 0x5400, Status: Waiting, WaitReason: "chan receive (nil chan)", Frames: frame(header1)}
+	sleeping := &Goroutine{Address: 0x5500, Status: Waiting, WaitReason: "sleep", Frames: frame(header1)}
+	goroutines := make(map[uint64]*Goroutine)
+	for _, g := range []*Goroutine{receiver, sender, selecting, ambiguous, nilChan, sleeping} {
+		goroutines[g.Address] = g
+	}
+
+	d := newTestDump(hchan(header1), hchan(header2))
+	chans := d.findChans(goroutines, testParams)
+	if len(chans) != 2 {
+		t.Fatalf("findChans() found %d channels; want 2", len(chans))
+	}
+	want := map[*Goroutine]string{receiver: "receive", sender: "send", selecting: "select"}
+	for _, g := range goroutines {
+		direction, waiting := want[g]
+		if !waiting {
+			if len(g.Chans) != 0 {
+				t.Errorf("Goroutine %x (%s) is waiting on %d channels; want none", g.Address, g.WaitReason, len(g.Chans))
+			}
+			continue
+		}
+		if len(g.Chans) != 1 {
+			t.Errorf("Goroutine %x (%s) is waiting on %d channels; want 1", g.Address, g.WaitReason, len(g.Chans))
+			continue
+		}
+		found := false
+		for _, w := range g.Chans[0].Waiters {
+			found = found || (w.Goroutine == g && w.Direction == direction)
+		}
+		if !found {
+			t.Errorf("Goroutine %x isn't listed as a %s waiter", g.Address, direction)
+		}
+	}
+	for _, c := range chans {
+		if c.Name != "chan" || c.Header.Name != "chan" {
+			t.Errorf("Channel named %q, header %q; want \"chan\"", c.Name, c.Header.Name)
+		}
+	}
+}
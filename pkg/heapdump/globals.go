@@ -0,0 +1,136 @@
+package heapdump
+
+import (
+	"bufio"
+	"fmt"
+	"sort"
+
+	"github.com/adamroach/heapspurs/pkg/gotype"
+)
+
+// A global variable, carved out of a DataSegment or BssSegment using
+// the program's symbol table. These don't appear in the dump itself.
+type Global struct {
+	Address  uint64       // address of the variable
+	Name     string       // symbol name
+	Contents []byte       // contents of the variable
+	Fields   []uint64     // offsets of pointer-containing fields in the variable
+	Segment  Owner        // segment that contains the variable
+	Type     *gotype.Type // from the program's debug information, if available
+}
+
+func (r *Global) GetAddress() uint64 {
+	return r.Address
+}
+
+func (r *Global) GetContents() []byte {
+	return r.Contents
+}
+
+func (r *Global) GetFields() []uint64 {
+	return r.Fields
+}
+
+// Returns the name of the field at the indicated offset, such as
+// "main.config.handlers", or an empty string if the type isn't known.
+func (r *Global) FieldName(offset uint64) string {
+	if r.Type == nil {
+		return ""
+	}
+	return fieldPath(r.Name, r.Type, offset)
+}
+
+func (r *Global) String() string {
+	return fmt.Sprintf("%s variable %s @ 0x%x with %d pointers in %d bytes",
+		SegmentName(r.Segment), r.Name, r.Address, len(r.Fields), len(r.Contents))
+}
+
+func (r *Global) Read(reader *bufio.Reader) error {
+	return fmt.Errorf("Globals are derived from segments, and cannot be read from a dump")
+}
+
+func SegmentName(r Addressable) string {
+	switch r.(type) {
+	case *DataSegment:
+		return "DataSegment"
+	case *BssSegment:
+		return "BssSegment"
+	}
+	return fmt.Sprintf("%T", r)
+}
+
+// Splits a DataSegment or BssSegment into the global variables that
+// hold its pointers. Pointers that don't fall inside of any symbol are
+// attributed to an anonymous global that covers the gap between the
+// surrounding symbols. Returns nil if no symbols have been loaded.
+func (d *Dump) SplitSegment(seg Owner) []*Global {
+	if len(d.symbols) == 0 {
+		return nil
+	}
+	globals := make([]*Global, 0)
+	var current *Global
+	for _, offset := range seg.GetFields() {
+		addr := seg.GetAddress() + offset
+		if current == nil || addr >= current.Address+uint64(len(current.Contents)) {
+			current = d.newGlobal(seg, addr)
+			globals = append(globals, current)
+		}
+		current.Fields = append(current.Fields, addr-current.Address)
+	}
+	return globals
+}
+
+func (d *Dump) newGlobal(seg Owner, addr uint64) *Global {
+	segStart := seg.GetAddress()
+	segEnd := segStart + uint64(len(seg.GetContents()))
+
+	g := &Global{Segment: seg}
+	var start, end uint64
+	sym, _ := d.GetSymbol(addr)
+	if sym != nil && sym.Size > 0 {
+		start, end = sym.Address, sym.Address+sym.Size
+		g.Name = sym.Name
+		g.Type = d.globalTypeMap[sym.Name]
+	} else {
+		start, end = d.symbolGap(addr)
+	}
+
+	start = max(start, segStart)
+	end = min(end, segEnd)
+	if len(g.Name) == 0 {
+		g.Name = fmt.Sprintf("%s+0x%x", SegmentName(seg), start-segStart)
+	}
+	g.Address = start
+	g.Contents = seg.GetContents()[start-segStart : end-segStart]
+	return g
+}
+
+// Returns the range between the symbols on either side of an address
+// that isn't part of any symbol.
+func (d *Dump) symbolGap(addr uint64) (start, end uint64) {
+	i := sort.Search(len(d.symbols), func(i int) bool {
+		return d.symbols[i].Address > addr
+	})
+	start, end = 0, ^uint64(0)
+	if i > 0 {
+		start = min(d.symbols[i-1].Address+d.symbols[i-1].Size, addr)
+	}
+	if i < len(d.symbols) {
+		end = d.symbols[i].Address
+	}
+	return
+}
+
+// Returns the global variable that contains the indicated address in a
+// segment (or, if no symbol does, the gap between symbols), along with
+// the offsets of its pointers.
+func (d *Dump) GlobalAt(seg Owner, addr uint64) *Global {
+	g := d.newGlobal(seg, addr)
+	for _, offset := range seg.GetFields() {
+		a := seg.GetAddress() + offset
+		if a >= g.Address && a < g.Address+uint64(len(g.Contents)) {
+			g.Fields = append(g.Fields, a-g.Address)
+		}
+	}
+	return g
+}
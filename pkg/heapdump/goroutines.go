@@ -0,0 +1,272 @@
+package heapdump
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/adamroach/heapspurs/pkg/gotype"
+)
+
+// The runtime writes each goroutine's stack frames right after the
+// goroutine itself, so we can hand each goroutine its frames by
+// walking the records in order. Returns the goroutines by address.
+func linkGoroutines(records []Record) map[uint64]*Goroutine {
+	goroutines := make(map[uint64]*Goroutine)
+	var current *Goroutine
+	for _, record := range records {
+		switch r := record.(type) {
+		case *Goroutine:
+			r.Frames = r.Frames[:0]
+			r.Chans = r.Chans[:0]
+			goroutines[r.Address] = r
+			current = r
+		case *StackFrame:
+			if current != nil {
+				current.Frames = append(current.Frames, r)
+			}
+		case *DeferRecord, *PanicRecord:
+			// These come after the frames, but still belong to the
+			// goroutine.
+		default:
+			current = nil
+		}
+	}
+	return goroutines
+}
+
+// Hands each goroutine its chains of defer and panic records, starting
+// from its TopDefer and TopPanic. Also gives each record the pointer
+// that keeps its deferred closure, or its panic argument, alive: at the
+// same offset as in the runtime's own record, if we know it.
+func (d *Dump) linkDefers(records []Record, goroutines map[uint64]*Goroutine, p *DumpParams) {
+	ps := p.PointerSize
+	fnOffset, argOffset := 3*ps, ps // Since Go 1.22
+	if offset, found := d.fieldOffset("runtime._defer", "fn"); found {
+		fnOffset = offset
+	}
+	if offset, found := d.fieldOffset("runtime._panic", "arg"); found {
+		argOffset = offset + ps // the data word
+	}
+
+	defers := make(map[uint64]*DeferRecord)
+	panics := make(map[uint64]*PanicRecord)
+	for _, record := range records {
+		switch r := record.(type) {
+		case *DeferRecord:
+			defers[r.Address] = r
+			r.Contents, r.Fields = pointerAt(fnOffset, r.FuncVal, p)
+		case *PanicRecord:
+			panics[r.Address] = r
+			r.Contents, r.Fields = pointerAt(argOffset, r.PanicArgData, p)
+			r.Arg = d.panicArg(r, p)
+		}
+	}
+	for _, g := range goroutines {
+		g.Defers = g.Defers[:0]
+		for addr := g.TopDefer; addr != 0 && len(g.Defers) < len(defers); {
+			r, found := defers[addr]
+			if !found {
+				break
+			}
+			g.Defers = append(g.Defers, r)
+			addr = r.Next
+		}
+		g.Panics = g.Panics[:0]
+		for addr := g.TopPanic; addr != 0 && len(g.Panics) < len(panics); {
+			r, found := panics[addr]
+			if !found {
+				break
+			}
+			g.Panics = append(g.Panics, r)
+			addr = r.Next
+		}
+	}
+}
+
+func (d *Dump) fieldOffset(typeName string, field string) (uint64, bool) {
+	if t := d.types.Lookup(typeName); t != nil {
+		for _, f := range t.Fields {
+			if f.Name == field {
+				return f.Offset, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// Makes the contents of a record that holds a single pointer.
+func pointerAt(offset uint64, ptr uint64, p *DumpParams) ([]byte, []uint64) {
+	if ptr == 0 {
+		return nil, nil
+	}
+	contents := make([]byte, offset+p.PointerSize)
+	var order binary.ByteOrder = binary.LittleEndian
+	if p.BigEndian {
+		order = binary.BigEndian
+	}
+	switch p.PointerSize {
+	case 4:
+		order.PutUint32(contents[offset:], uint32(ptr))
+	default:
+		order.PutUint64(contents[offset:], ptr)
+	}
+	return contents, []uint64{offset}
+}
+
+// Describes the value that was passed to panic: its type, and whatever
+// we can make out of its value. Strings, and errors whose message is a
+// string field (as with errors.New), are shown as text.
+func (d *Dump) panicArg(r *PanicRecord, p *DumpParams) string {
+	if r.PanicArgType == 0 {
+		return "nil"
+	}
+	name := d.typeName(r.PanicArgType)
+	value := d.Addr(r.PanicArgData)
+	o := d.FindObject(r.PanicArgData)
+	if o == nil {
+		return fmt.Sprintf("%s %s", name, value)
+	}
+	t := d.types.Lookup(name)
+	if t == nil {
+		t = d.GetDescriptorType(r.PanicArgType)
+	}
+	switch {
+	case strings.HasPrefix(name, "*") || (t != nil && t.Kind == gotype.Pointer):
+		// Pointers (such as most errors) are stored in the interface
+		// itself, so the data word is the value.
+		if r.PanicArgData != o.Address {
+			break
+		}
+		if t != nil && t.Elem != nil {
+			for _, f := range t.Elem.Fields {
+				if f.Type.Kind != gotype.String || f.Offset+2*p.PointerSize > uint64(len(o.Contents)) {
+					continue
+				}
+				// The text is often a literal, which isn't in the dump.
+				h := DataHeader{Kind: StringHeader, Data: ReadWord(o.Contents, f.Offset, p), Len: ReadWord(o.Contents, f.Offset+p.PointerSize, p)}
+				h.Text, _ = d.readString(h.Data, h.Len)
+				value = fmt.Sprintf("0x%x -> %s", r.PanicArgData, headerText(h))
+				break
+			}
+		} else if h, isHeader := d.FindHeader(o, 0, p); isHeader && h.Kind == StringHeader {
+			value = fmt.Sprintf("0x%x -> %s", r.PanicArgData, headerText(h))
+		}
+	case name == "string" || (t != nil && t.Kind == gotype.String):
+		// Anything else is stored elsewhere, and the data word points
+		// to it.
+		if h, isHeader := d.FindHeader(o, r.PanicArgData-o.Address, p); isHeader && h.Kind == StringHeader {
+			value = headerText(h)
+		}
+	case t != nil && (t.Kind == gotype.Int || t.Kind == gotype.Uint) && t.Size <= 8:
+		value = fmt.Sprintf("%d", readUint(o, r.PanicArgData-o.Address, t.Size, p))
+	}
+	return fmt.Sprintf("%s %s", name, value)
+}
+
+// Names the type descriptor at the indicated address. The program's
+// own descriptors are better at this than the dump, which only names
+// the types of things it has come across, and sometimes leaves part of
+// the name out.
+func (d *Dump) typeName(addr uint64) string {
+	if t := d.GetDescriptorType(addr); t != nil && len(t.Name) > 0 && t.Name != "?" {
+		return t.Name
+	}
+	if t := d.GetType(addr); t != nil && len(t.Name) > 0 && !strings.HasSuffix(t.Name, ".") {
+		return t.Name
+	}
+	return d.TypeAddr(addr)
+}
+
+func headerText(h DataHeader) string {
+	if len(h.Text) == 0 {
+		return fmt.Sprintf("(string len %d)", h.Len)
+	}
+	s := strconv.Quote(h.Text)
+	if h.Len > uint64(len(h.Text)) {
+		s += "..."
+	}
+	return s
+}
+
+// Reads the bounds of each goroutine's stack from its runtime.g, to
+// find out how much memory the runtime set aside for it. That's usually
+// far more than its frames use.
+func (d *Dump) findStackSizes(goroutines map[uint64]*Goroutine, p *DumpParams) {
+	offset, found := d.fieldOffset("runtime.g", "stack")
+	for _, g := range goroutines {
+		g.StackSize = 0
+		if !found {
+			continue
+		}
+		// A runtime.stack is its lowest and highest address.
+		if data := d.readMemory(g.Address+offset, 2*p.PointerSize); data != nil {
+			lo, hi := ReadWord(data, 0, p), ReadWord(data, p.PointerSize, p)
+			if hi > lo {
+				g.StackSize = hi - lo
+			}
+		}
+	}
+}
+
+// Works out when the last garbage collection finished, on the same
+// clock as Goroutine.WaitStart. That's the runtime's monotonic clock,
+// which MemStats.LastGC isn't on. The runtime keeps its own copy in
+// runtime.memstats, but that's in .noptrbss, which the dump leaves out;
+// runtime.work, which notes when each phase of the last collection
+// started, is in .bss, so we read that if we know its layout.
+// Otherwise, the most recent WaitStart will have to do, and we report
+// that it's an estimate.
+func (d *Dump) findLastGC(goroutines map[uint64]*Goroutine, p *DumpParams) (lastGC uint64, estimated bool) {
+	if addr, found := d.globalFieldAddress("runtime.work", "tEnd"); found {
+		if data := d.readMemory(addr, 8); data != nil {
+			if v := readUint(&Object{Contents: data}, 0, 8, p); v != 0 {
+				return v, false
+			}
+		}
+	}
+	for _, g := range goroutines {
+		lastGC = max(lastGC, g.WaitStart)
+	}
+	return lastGC, true
+}
+
+// Reports whether goroutines' wait times are measured up to the most
+// recent WaitStart, because we couldn't tell when the last garbage
+// collection finished. They may then be too short, or even zero.
+func (d *Dump) LastGCEstimated() bool {
+	return d != nil && d.lastGCEstimated
+}
+
+// Returns the address of a field of a struct-typed global variable.
+func (d *Dump) globalFieldAddress(name string, field string) (uint64, bool) {
+	t := d.globalTypeMap[name]
+	if t == nil {
+		return 0, false
+	}
+	for _, f := range t.Fields {
+		if f.Name != field {
+			continue
+		}
+		for i := range d.symbols {
+			if d.symbols[i].Name == name {
+				return d.symbols[i].Address + f.Offset, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// Returns roughly how long a goroutine has been blocked, as of the last
+// garbage collection. The runtime only notes when a goroutine started
+// waiting when a collection comes across it, so this is only accurate
+// to within a GC cycle; goroutines that no collection has seen waiting
+// yet report false.
+func (r *Goroutine) WaitTime() (time.Duration, bool) {
+	if (r.Status != Waiting && r.Status != Syscall) || r.WaitStart == 0 || r.WaitStart > r.LastGC {
+		return 0, false
+	}
+	return time.Duration(r.LastGC - r.WaitStart), true
+}
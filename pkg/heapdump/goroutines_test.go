@@ -0,0 +1,123 @@
+package heapdump
+
+import (
+	"bufio"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/adamroach/heapspurs/pkg/program"
+)
+
+// Builds and runs the program in testdata/blocked, which writes a heap
+// dump, and returns the paths of the executable and of the dump. Skips
+// the test if there's no toolchain to build it with.
+func runBlockedFixture(t *testing.T) (string, string) {
+	t.Helper()
+	if testing.Short() {
+		t.Skip("Skipping fixture build in short mode")
+	}
+	goTool, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("No Go toolchain to build the fixture with")
+	}
+	dir := t.TempDir()
+	exe := filepath.Join(dir, "blocked")
+	cmd := exec.Command(goTool, "build", "-trimpath", "-o", exe, ".")
+	cmd.Dir = filepath.Join("testdata", "blocked")
+	cmd.Env = append(os.Environ(), "CGO_ENABLED=0", "GOFLAGS=")
+	if output, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("Building the fixture: %v\n%s", err, output)
+	}
+	dumpFile := filepath.Join(dir, "dump.bin")
+	if output, err := exec.Command(exe, dumpFile).CombinedOutput(); err != nil {
+		t.Fatalf("Running the fixture: %v\n%s", err, output)
+	}
+	return exe, dumpFile
+}
+
+// Reads a heap dump and infers what it can, with the indicated program
+// file, if any.
+func readFixtureDump(t *testing.T, exe string, dumpFile string) (*Dump, []Record) {
+	t.Helper()
+	d := NewDump()
+	if len(exe) > 0 {
+		p, err := program.Open(exe)
+		if err != nil {
+			t.Fatalf("Open %s: %v", exe, err)
+		}
+		defer p.Close()
+		if err := d.ReadSymbols(p); err != nil {
+			t.Fatalf("ReadSymbols: %v", err)
+		}
+		types, err := p.Types()
+		if err != nil {
+			t.Fatalf("Types: %v", err)
+		}
+		d.ReadTypes(types)
+	}
+	f, err := os.Open(dumpFile)
+	if err != nil {
+		t.Fatalf("Open %s: %v", dumpFile, err)
+	}
+	defer f.Close()
+	records, params, err := d.ReadRecords(bufio.NewReader(f))
+	if err != nil {
+		t.Fatalf("ReadRecords: %v", err)
+	}
+	d.InferTypes(records, params)
+	return d, records
+}
+
+// Finds the goroutine with the indicated function on its stack.
+func goroutineIn(records []Record, function string) *Goroutine {
+	for _, record := range records {
+		g, isGoroutine := record.(*Goroutine)
+		if !isGoroutine {
+			continue
+		}
+		for _, frame := range g.Frames {
+			if frame.Name == function {
+				return g
+			}
+		}
+	}
+	return nil
+}
+
+func TestWaitTime(t *testing.T) {
+	exe, dumpFile := runBlockedFixture(t)
+
+	t.Run("with program", func(t *testing.T) {
+		d, records := readFixtureDump(t, exe, dumpFile)
+		if d.LastGCEstimated() {
+			t.Errorf("LastGCEstimated() = true; want the end of the last GC from runtime.work")
+		}
+		g := goroutineIn(records, "main.blocked")
+		if g == nil {
+			t.Fatalf("No goroutine in main.blocked")
+		}
+		// It's been waiting since before the sleep between the two
+		// collections.
+		wait, known := g.WaitTime()
+		if !known || wait < 10*time.Millisecond {
+			t.Errorf("WaitTime() = %v, %v; want at least 10ms (WaitStart %d, LastGC %d)", wait, known, g.WaitStart, g.LastGC)
+		}
+	})
+
+	t.Run("without program", func(t *testing.T) {
+		d, records := readFixtureDump(t, "", dumpFile)
+		if !d.LastGCEstimated() {
+			t.Errorf("LastGCEstimated() = false; want true without runtime.work's layout")
+		}
+		g := goroutineIn(records, "main.blocked")
+		if g == nil {
+			t.Fatalf("No goroutine in main.blocked")
+		}
+		if g.LastGC < g.WaitStart {
+			t.Errorf("LastGC = %d; want at least WaitStart %d", g.LastGC, g.WaitStart)
+		}
+	})
+}
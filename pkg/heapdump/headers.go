@@ -0,0 +1,164 @@
+package heapdump
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"unicode/utf8"
+
+	"github.com/adamroach/heapspurs/pkg/gotype"
+)
+
+type HeaderKind int
+
+const (
+	StringHeader HeaderKind = iota + 1 // ptr, len
+	SliceHeader                        // ptr, len, cap
+)
+
+// The most bytes of a string that we keep for display.
+const maxStringPreview = 64
+
+// A string or slice header, found at a pointer slot.
+type DataHeader struct {
+	Kind HeaderKind
+	Data uint64 // data pointer
+	Len  uint64
+	Cap  uint64 // slices only
+	Elem uint64 // slices only; the size of an element, if the type is known
+	Text string // strings only; the first maxStringPreview bytes, if we can read them
+}
+
+func (h DataHeader) String() string {
+	if h.Kind == SliceHeader {
+		return fmt.Sprintf("slice len %d cap %d", h.Len, h.Cap)
+	}
+	if len(h.Text) == 0 {
+		return fmt.Sprintf("string len %d", h.Len)
+	}
+	s := strconv.Quote(h.Text)
+	if h.Len > uint64(len(h.Text)) {
+		s += "..."
+	}
+	return fmt.Sprintf("string %s (len %d)", s, h.Len)
+}
+
+// Returns the object that contains the indicated address, if any.
+func (d *Dump) FindObject(addr uint64) *Object {
+	i := sort.Search(len(d.heapObjects), func(i int) bool {
+		return d.heapObjects[i].Address > addr
+	}) - 1
+	if i < 0 || addr >= d.heapObjects[i].Address+uint64(len(d.heapObjects[i].Contents)) {
+		return nil
+	}
+	return d.heapObjects[i]
+}
+
+// Works out whether the pointer at the indicated offset is the data
+// pointer of a string or slice header. If the owner's type is known,
+// we go by that; otherwise, we look for a pointer followed by plausible
+// length (and capacity) words that fit inside the object it points
+// into. Strings must also be printable, and point into an object
+// without pointers.
+func (d *Dump) FindHeader(o Owner, offset uint64, p *DumpParams) (DataHeader, bool) {
+	contents := o.GetContents()
+	ptrSize := p.PointerSize
+	if offset+2*ptrSize > uint64(len(contents)) {
+		return DataHeader{}, false
+	}
+	h := DataHeader{Data: ReadWord(contents, offset, p), Len: ReadWord(contents, offset+ptrSize, p)}
+	if h.Data == 0 {
+		return DataHeader{}, false
+	}
+
+	if t := ownerType(o); t != nil && t.Size > 0 {
+		base := offset - offset%t.Size
+		slot, ok := t.SlotAt(offset - base)
+		if !ok || slot.Offset != offset-base {
+			return DataHeader{}, false
+		}
+		switch slot.Type.Kind {
+		case gotype.String:
+			h.Kind = StringHeader
+			h.Text, _ = d.readString(h.Data, h.Len)
+			return h, true
+		case gotype.Slice:
+			if offset+3*ptrSize > uint64(len(contents)) {
+				return DataHeader{}, false
+			}
+			h.Kind = SliceHeader
+			h.Cap = ReadWord(contents, offset+2*ptrSize, p)
+			if slot.Type.Elem != nil {
+				h.Elem = slot.Type.Elem.Size
+			}
+			return h, true
+		}
+		return DataHeader{}, false
+	}
+
+	target := d.FindObject(h.Data)
+	if target == nil || isPointerField(o, offset+ptrSize) {
+		return DataHeader{}, false
+	}
+	room := target.Address + uint64(len(target.Contents)) - h.Data
+	if h.Len > 0 && h.Len <= room && len(target.Fields) == 0 {
+		if text, ok := d.readString(h.Data, h.Len); ok && printable(text) {
+			h.Kind = StringHeader
+			h.Text = text
+			return h, true
+		}
+	}
+	if offset+3*ptrSize > uint64(len(contents)) || isPointerField(o, offset+2*ptrSize) {
+		return DataHeader{}, false
+	}
+	h.Cap = ReadWord(contents, offset+2*ptrSize, p)
+	if len(target.Fields) > 0 {
+		// Anything that holds pointers is at least a word long.
+		room /= ptrSize
+	}
+	if h.Cap == 0 || h.Len > h.Cap || h.Cap > room {
+		return DataHeader{}, false
+	}
+	h.Kind = SliceHeader
+	return h, true
+}
+
+func ownerType(o Owner) *gotype.Type {
+	switch r := o.(type) {
+	case *Object:
+		return r.Type
+	case *Global:
+		return r.Type
+	}
+	return nil
+}
+
+func isPointerField(o Owner, offset uint64) bool {
+	fields := o.GetFields()
+	i := sort.Search(len(fields), func(i int) bool {
+		return fields[i] >= offset
+	})
+	return i < len(fields) && fields[i] == offset
+}
+
+// Reads up to maxStringPreview bytes of a string from the heap.
+func (d *Dump) readString(addr uint64, length uint64) (string, bool) {
+	o := d.FindObject(addr)
+	if o == nil {
+		return "", false
+	}
+	n := min(length, maxStringPreview, o.Address+uint64(len(o.Contents))-addr)
+	return string(o.Contents[addr-o.Address : addr-o.Address+n]), true
+}
+
+func printable(s string) bool {
+	if !utf8.ValidString(s) {
+		return false
+	}
+	for _, r := range s {
+		if r < 0x20 && r != '\t' && r != '\n' && r != '\r' || r == 0x7f {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,139 @@
+package heapdump
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFindHeader(t *testing.T) {
+	const owner, text, array, pointers = 0x1000, 0x2000, 0x3000, 0x4000
+	long := strings.Repeat("x", 100)
+	targets := []*Object{
+		{Address: text, Contents: []byte("hello\x00\x01\x02")},
+		{Address: array, Contents: make([]byte, 32)},
+		{Address: pointers, Contents: make([]byte, 32), Fields: []uint64{0, 8}},
+		{Address: 0x5000, Contents: []byte(long)},
+	}
+	tests := []struct {
+		name     string
+		contents []byte
+		fields   []uint64
+		want     DataHeader
+		found    bool
+	}{
+		{
+			name:     "string",
+			contents: words(text, 5),
+			fields:   []uint64{0},
+			want:     DataHeader{Kind: StringHeader, Data: text, Len: 5, Text: "hello"},
+			found:    true,
+		},
+		{
+			name:     "slice of bytes",
+			contents: words(array, 2, 32),
+			fields:   []uint64{0},
+			want:     DataHeader{Kind: SliceHeader, Data: array, Len: 2, Cap: 32},
+			found:    true,
+		},
+		{
+			// Unprintable bytes aren't a string, but could be a slice.
+			name:     "unprintable",
+			contents: words(text, 8, 8),
+			fields:   []uint64{0},
+			want:     DataHeader{Kind: SliceHeader, Data: text, Len: 8, Cap: 8},
+			found:    true,
+		},
+		{
+			name:     "slice of pointers",
+			contents: words(pointers, 1, 4),
+			fields:   []uint64{0},
+			want:     DataHeader{Kind: SliceHeader, Data: pointers, Len: 1, Cap: 4},
+			found:    true,
+		},
+		{
+			// Capacity is counted in words when the array holds pointers.
+			name:     "slice of pointers too big",
+			contents: words(pointers, 1, 32),
+			fields:   []uint64{0},
+		},
+		{
+			name:     "long string",
+			contents: words(0x5000, 100),
+			fields:   []uint64{0},
+			want:     DataHeader{Kind: StringHeader, Data: 0x5000, Len: 100, Text: long[:maxStringPreview]},
+			found:    true,
+		},
+		{name: "nil", contents: words(0, 0, 0), fields: []uint64{0}},
+		{name: "len over cap", contents: words(array, 4, 2), fields: []uint64{0}},
+		{name: "past the end", contents: words(array, 2, 33), fields: []uint64{0}},
+		{name: "pointer length", contents: words(array, array, 4), fields: []uint64{0, 8}},
+		{name: "pointer capacity", contents: words(array, 2, array), fields: []uint64{0, 16}},
+		{name: "outside the heap", contents: words(0x900000, 2, 4), fields: []uint64{0}},
+		{name: "too short", contents: words(array), fields: []uint64{0}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			o := &Object{Address: owner, Contents: test.contents, Fields: test.fields}
+			d := newTestDump(append([]*Object{o}, targets...)...)
+			h, found := d.FindHeader(o, 0, testParams)
+			if found != test.found || h != test.want {
+				t.Errorf("FindHeader() = %+v, %v; want %+v, %v", h, found, test.want, test.found)
+			}
+		})
+	}
+}
+
+// With a type, we trust it over the contents.
+func TestFindTypedHeader(t *testing.T) {
+	const owner, array = 0x1000, 0x3000
+	d := newTestDump()
+	if err := d.ReadTypeSource("headers.go", strings.NewReader(`package main
+
+type Record struct {
+	name  string
+	data  []uint32
+	count int
+}
+`)); err != nil {
+		t.Fatalf("ReadTypeSource: %v", err)
+	}
+	o := &Object{
+		Address:  owner,
+		Type:     d.LookupType("main.Record"),
+		Contents: words(array, 3, array, 2, 4, 7),
+		Fields:   []uint64{0, 16},
+	}
+	d = newTestDump(o, &Object{Address: array, Contents: []byte("abc\x00\x00\x00\x00\x00")})
+	tests := []struct {
+		offset uint64
+		want   DataHeader
+		found  bool
+	}{
+		{0, DataHeader{Kind: StringHeader, Data: array, Len: 3, Text: "abc"}, true},
+		{16, DataHeader{Kind: SliceHeader, Data: array, Len: 2, Cap: 4, Elem: 4}, true},
+		{8, DataHeader{}, false},
+		{24, DataHeader{}, false},
+	}
+	for _, test := range tests {
+		if h, found := d.FindHeader(o, test.offset, testParams); found != test.found || h != test.want {
+			t.Errorf("FindHeader(%d) = %+v, %v; want %+v, %v", test.offset, h, found, test.want, test.found)
+		}
+	}
+}
+
+func TestDataHeaderString(t *testing.T) {
+	tests := []struct {
+		h    DataHeader
+		want string
+	}{
+		{DataHeader{Kind: StringHeader, Len: 5, Text: "hello"}, `string "hello" (len 5)`},
+		{DataHeader{Kind: StringHeader, Len: 100, Text: "a\tb"}, `string "a\tb"... (len 100)`},
+		{DataHeader{Kind: StringHeader, Len: 7}, "string len 7"},
+		{DataHeader{Kind: SliceHeader, Len: 2, Cap: 4}, "slice len 2 cap 4"},
+	}
+	for _, test := range tests {
+		if got := test.h.String(); got != test.want {
+			t.Errorf("String() = %q; want %q", got, test.want)
+		}
+	}
+}
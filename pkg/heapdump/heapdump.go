@@ -8,16 +8,29 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
+	"time"
+
+	"github.com/adamroach/heapspurs/pkg/gotype"
 )
 
 type Record interface {
 	Read(r *bufio.Reader) error
 }
 
+// Records that keep a pointer back to the Dump they were read through.
+type dumpRecord interface {
+	setDump(d *Dump)
+}
+
 type Addressable interface {
 	GetAddress() uint64
 }
 
+// Records whose type is known can name the fields they contain.
+type FieldNamer interface {
+	FieldName(offset uint64) string
+}
+
 type Owner interface {
 	Addressable
 	GetContents() []byte
@@ -66,7 +79,7 @@ func ReadHeader(reader *bufio.Reader) (err error) {
 	return
 }
 
-func ReadRecord(reader *bufio.Reader) (record Record, err error) {
+func (d *Dump) ReadRecord(reader *bufio.Reader) (record Record, err error) {
 	rt, err := binary.ReadUvarint(reader)
 	if err != nil {
 		return
@@ -113,10 +126,41 @@ func ReadRecord(reader *bufio.Reader) (record Record, err error) {
 	}
 
 	err = record.Read(reader)
+	if err != nil {
+		return
+	}
+	if r, isDumpRecord := record.(dumpRecord); isDumpRecord {
+		r.setDump(d)
+	}
+	d.observe(record)
 
 	return
 }
 
+// Notes whatever a record tells us about the names of things.
+func (d *Dump) observe(record Record) {
+	switch r := record.(type) {
+	case *Object:
+		// Assign a class name if this object starts with an OID
+		if len(r.Contents) > 8 {
+			oid := binary.LittleEndian.Uint64(r.Contents[:])
+			className, found := d.oidMap[oid]
+			if found {
+				r.Name = className
+				d.AddName(r.Address, className)
+			}
+		}
+	case *TypeDescriptor:
+		d.AddType(r)
+	case *Itab:
+		d.AddItab(r.Address, r.TypeDescriptorAddress)
+	case *DataSegment:
+		d.observeSegment("runtime.data", r.Address)
+	case *BssSegment:
+		d.observeSegment("runtime.bss", r.Address)
+	}
+}
+
 func GetPointers(o Owner, p *DumpParams) (pointers []uint64) {
 	_, pointers = GetPointerInfo(o, p)
 	return
@@ -133,10 +177,6 @@ func GetPointersSourceAddress(o Owner, target uint64, p *DumpParams) uint64 {
 }
 
 func GetPointerInfo(o Owner, p *DumpParams) (pointerSource, pointerTarget []uint64) {
-	var byteOrder binary.ByteOrder = binary.LittleEndian
-	if p.BigEndian {
-		byteOrder = binary.BigEndian
-	}
 	contents := o.GetContents()
 	fields := o.GetFields()
 	pointerSource = make([]uint64, len(fields))
@@ -144,20 +184,30 @@ func GetPointerInfo(o Owner, p *DumpParams) (pointerSource, pointerTarget []uint
 	for i := 0; i < len(fields); i++ {
 		offset := fields[i]
 		pointerSource[i] = o.GetAddress() + offset
-		switch p.PointerSize {
-		case 2:
-			pointerTarget[i] = uint64(byteOrder.Uint16(contents[offset:]))
-		case 4:
-			pointerTarget[i] = uint64(byteOrder.Uint32(contents[offset:]))
-		case 8:
-			pointerTarget[i] = byteOrder.Uint64(contents[offset:])
-		default:
-			panic(fmt.Sprintf("Cannot handle pointers of size %d", p.PointerSize))
-		}
+		pointerTarget[i] = ReadWord(contents, offset, p)
 	}
 	return
 }
 
+// Reads a pointer-sized word from the indicated offset in contents,
+// using the byte order of the architecture that produced the dump.
+func ReadWord(contents []byte, offset uint64, p *DumpParams) uint64 {
+	var byteOrder binary.ByteOrder = binary.LittleEndian
+	if p.BigEndian {
+		byteOrder = binary.BigEndian
+	}
+	switch p.PointerSize {
+	case 2:
+		return uint64(byteOrder.Uint16(contents[offset:]))
+	case 4:
+		return uint64(byteOrder.Uint32(contents[offset:]))
+	case 8:
+		return byteOrder.Uint64(contents[offset:])
+	default:
+		panic(fmt.Sprintf("Cannot handle pointers of size %d", p.PointerSize))
+	}
+}
+
 ///////////////////////////////////////////////////////////////////////////
 
 type Eof struct {
@@ -176,6 +226,12 @@ type Object struct {
 	Contents []byte   // contents of object
 	Fields   []uint64 // describes pointer-containing fields of the object
 	Name     string
+	Type     *gotype.Type // if known; the object holds one or more of these
+	Matches  []TypeMatch  // types that the object's shape fits, if it has no name
+	Shape    string       // synthetic name for the object's shape, if it has no name
+	Map      *MapInfo     // the map that this object is part of, if any
+	Chan     *ChanInfo    // the channel that this object is part of, if any
+	dumpRef
 }
 
 func (r *Object) GetAddress() uint64 {
@@ -194,20 +250,73 @@ func (r *Object) GetName() string {
 	if len(r.Name) > 0 {
 		return r.Name
 	}
+	if len(r.Shape) > 0 {
+		return r.Shape
+	}
 	return "Object"
 }
 
+// Returns the name of the field at the indicated offset, such as
+// "m.freelink", or an empty string if the object's type isn't known.
+func (r *Object) FieldName(offset uint64) string {
+	if r.Type == nil || r.Type.Size == 0 {
+		return ""
+	}
+	name := r.Type.ShortName()
+	array := uint64(len(r.Contents)) >= 2*r.Type.Size
+	if array {
+		name += fmt.Sprintf("[%d]", offset/r.Type.Size)
+	}
+	path := fieldPath(name, r.Type, offset%r.Type.Size)
+	if path == name && !array {
+		// A lone pointer (or similar) has no fields to speak of.
+		return ""
+	}
+	return path
+}
+
+// Appends the path to the field at the indicated offset to a name.
+func fieldPath(name string, t *gotype.Type, offset uint64) string {
+	slot, ok := t.SlotAt(offset)
+	if !ok {
+		return ""
+	}
+	if len(slot.Path) > 0 {
+		if slot.Path[0] != '[' {
+			name += "."
+		}
+		name += slot.Path
+	}
+	if slot.Offset != offset {
+		name += fmt.Sprintf("+0x%x", offset-slot.Offset)
+	}
+	return name
+}
+
 func (r *Object) AddrPretty() string {
-	name := GetNameWithSize(r.Address, len(r.Contents))
+	name := r.dump.GetNameWithSize(r.Address, len(r.Contents))
 	if name != "" {
 		return fmt.Sprintf("0x%x (%s)", uint64(r.Address), name)
 	}
-	// return fmt.Sprintf("0x%x", uint64(r.Address))
-	return Addr(r.Address).String()
+	// Named objects already lead with their name; don't repeat it.
+	if len(r.Name) > 0 || len(r.Shape) > 0 {
+		return fmt.Sprintf("0x%x", uint64(r.Address))
+	}
+	return r.dump.Addr(r.Address)
 }
 
 func (r *Object) String() string {
-	return fmt.Sprintf("%s @ %s with %d pointers in %d bytes", r.GetName(), r.AddrPretty(), len(r.Fields), len(r.Contents))
+	s := fmt.Sprintf("%s @ %s with %d pointers in %d bytes", r.GetName(), r.AddrPretty(), len(r.Fields), len(r.Contents))
+	if r.Map != nil && r.Map.Header == r {
+		s += fmt.Sprintf(" (map: %s)", r.Map)
+	}
+	if r.Chan != nil && r.Chan.Header == r {
+		s += fmt.Sprintf(" (chan: %s)", r.Chan)
+	}
+	if len(r.Matches) > 1 {
+		s += fmt.Sprintf(" (maybe %s)", r.MatchSummary())
+	}
+	return s
 }
 
 func (r *Object) Read(reader *bufio.Reader) (err error) {
@@ -247,16 +356,6 @@ func (r *Object) Read(reader *bufio.Reader) (err error) {
 		r.Fields = append(r.Fields, value)
 	}
 
-	// Assign a class name if this object starts with an OID
-	if len(r.Contents) > 8 {
-		oid := binary.LittleEndian.Uint64(r.Contents[:])
-		className, found := oidMap[oid]
-		if found {
-			r.Name = className
-			AddName(r.Address, className)
-		}
-	}
-
 	return
 }
 
@@ -353,12 +452,22 @@ type Goroutine struct {
 	Status                    StatusType // status
 	System                    bool       // is a Go routine started by the system
 	Background                bool       // is a background Go routine
-	WaitStart                 uint64     // approximate time the go routine last started waiting (nanoseconds since the Epoch)
+	WaitStart                 uint64     // approximate time the go routine last started waiting (runtime's monotonic clock; 0 if no GC has seen it waiting)
 	WaitReason                string     // textual reason why it is waiting
 	CurrentContextPointer     uint64     // context pointer of currently running frame
 	OsThreadDescriptorAddress uint64     // address of os thread descriptor
 	TopDefer                  uint64     // top defer record
 	TopPanic                  uint64     // top panic record
+
+	Frames []*StackFrame  // the goroutine's stack, top first; filled in by InferTypes
+	Chans  []*ChanInfo    // the channels it's blocked on, if any
+	Defers []*DeferRecord // its pending deferred calls, the next to run first
+	Panics []*PanicRecord // the panics it's in the middle of, the latest first
+	Thread *OsThread      // the OS thread it's running on, if any
+
+	StackSize uint64 // bytes allocated for its stack, if we know the layout of runtime.g; filled in by InferTypes
+	LastGC    uint64 // when the last GC happened, on the same clock as WaitStart; filled in by InferTypes
+	dumpRef
 }
 
 func (r *Goroutine) GetAddress() uint64 {
@@ -366,10 +475,14 @@ func (r *Goroutine) GetAddress() uint64 {
 }
 
 func (r *Goroutine) String() string {
+	s := fmt.Sprintf("Goroutine[%d] @ 0x%x: %s, Stack @ 0x%x", r.RoutineId, r.Address, r.Status.String(), r.StackPointer)
 	if r.Status == Waiting {
-		return fmt.Sprintf("Goroutine[%d] @ 0x%x: %s (%s), Stack @ 0x%x", r.RoutineId, r.Address, r.Status.String(), r.WaitReason, r.StackPointer)
+		s = fmt.Sprintf("Goroutine[%d] @ 0x%x: %s (%s), Stack @ 0x%x", r.RoutineId, r.Address, r.Status.String(), r.WaitReason, r.StackPointer)
 	}
-	return fmt.Sprintf("Goroutine[%d] @ 0x%x: %s, Stack @ 0x%x", r.RoutineId, r.Address, r.Status.String(), r.StackPointer)
+	if r.CreatorPointer != 0 {
+		s += fmt.Sprintf(", Created by %s", r.dump.ReturnPc(r.CreatorPointer))
+	}
+	return s
 }
 
 type StatusType uint64
@@ -488,15 +601,17 @@ func (r *Goroutine) Read(reader *bufio.Reader) (err error) {
 }
 
 type StackFrame struct {
-	Address        uint64   // stack pointer (lowest address in frame)
-	Depth          uint64   // depth in stack (0 = top of stack)
-	ChildPointer   uint64   // stack pointer of child frame (or 0 if none)
-	Contents       []byte   // contents of stack frame
-	EntryPc        uint64   // entry pc for function
-	CurrentPc      uint64   // current pc for function
-	ContinuationPc uint64   // continuation pc for function (where function may resume, if anywhere)
-	Name           string   // function name
-	Fields         []uint64 // list of kind and offset of pointer-containing fields in this frame
+	Address        uint64               // stack pointer (lowest address in frame)
+	Depth          uint64               // depth in stack (0 = top of stack)
+	ChildPointer   uint64               // stack pointer of child frame (or 0 if none)
+	Contents       []byte               // contents of stack frame
+	EntryPc        uint64               // entry pc for function
+	CurrentPc      uint64               // current pc for function
+	ContinuationPc uint64               // continuation pc for function (where function may resume, if anywhere)
+	Name           string               // function name
+	Fields         []uint64             // list of kind and offset of pointer-containing fields in this frame
+	Vars           map[uint64]*FrameVar // the variables in pointer-containing fields, if we know them
+	dumpRef
 }
 
 func (r *StackFrame) GetAddress() uint64 {
@@ -511,12 +626,49 @@ func (r *StackFrame) GetFields() []uint64 {
 	return r.Fields
 }
 
+// Returns the name of the variable at the indicated offset, such as
+// "sess" or "req.ctx", or an empty string if we don't know it. Frames
+// also hold the arguments of the functions that they call.
+func (r *StackFrame) FieldName(offset uint64) string {
+	v, found := r.Vars[offset]
+	switch {
+	case !found:
+		return ""
+	case v.Function != r.Name:
+		return fmt.Sprintf("%s (%s)", v.Name, v.Function)
+	}
+	return v.Name
+}
+
 func (r *StackFrame) String() string {
+	name := r.Name
+	if source := r.Source(); len(source) > 0 {
+		name += " at " + source
+	}
 	return fmt.Sprintf("StackFrame[%d] @ 0x%x: %s with %d pointers in %d bytes; child = 0x%x",
-		r.Depth, r.Address, r.Name, len(r.Fields), len(r.Contents), r.ChildPointer,
+		r.Depth, r.Address, name, len(r.Fields), len(r.Contents), r.ChildPointer,
 	)
 }
 
+// Returns the source file and line that the frame is executing (or, for
+// frames other than the innermost, the call that it's waiting on to
+// return), or an empty string if we don't have the program's line table.
+func (r *StackFrame) Source() string {
+	if _, file, line, found := r.dump.SourceLine(r.pc()); found {
+		return fmt.Sprintf("%s:%d", file, line)
+	}
+	return ""
+}
+
+// Every frame but the innermost is stopped at a call, and its current
+// PC is the return address, just past the call instruction.
+func (r *StackFrame) pc() uint64 {
+	if r.Depth > 0 && r.CurrentPc > r.EntryPc {
+		return r.CurrentPc - 1
+	}
+	return r.CurrentPc
+}
+
 func (r *StackFrame) Read(reader *bufio.Reader) (err error) {
 	// Read Address as uvarint
 	r.Address, err = binary.ReadUvarint(reader)
@@ -686,14 +838,16 @@ type RegisteredFinalizer struct {
 	FinalizerEntryPc uint64 // PC of finalizer entry point
 	FinalizerType    uint64 // type of finalizer argument
 	ObjectType       uint64 // type of object
+	dumpRef
 }
 
 func (r *RegisteredFinalizer) String() string {
-	return fmt.Sprintf("RegisteredFinalizer @ 0x%x: FuncVal: 0x%x, Type: 0x%x, Object Type: 0x%x",
+	return fmt.Sprintf("RegisteredFinalizer @ 0x%x: FuncVal: 0x%x, Entry: %s, Type: %s, Object Type: %s",
 		r.ObjectAddress,
 		r.FinalizerAddress,
-		r.FinalizerType,
-		r.ObjectType,
+		r.dump.Pc(r.FinalizerEntryPc),
+		r.dump.TypeAddr(r.FinalizerType),
+		r.dump.TypeAddr(r.ObjectType),
 	)
 }
 
@@ -764,6 +918,17 @@ type OsThread struct {
 	ThreadDescriptorAddress uint64 // address of this os thread descriptor
 	GoId                    uint64 // Go internal id of thread
 	OsId                    uint64 // os's id for thread
+
+	Goroutine *Goroutine // the goroutine running on it, if any; filled in by InferTypes
+	M         *Object    // its runtime.m, unless that isn't in the heap (as with runtime.m0)
+
+	// From its runtime.m, if we know that type's layout; filled in by
+	// InferTypes.
+	Described bool
+	LockedTo  uint64 // goroutine locked to it by LockOSThread (or a cgo callback), if any
+	CgoCalls  uint64 // number of cgo calls it has made
+	InCgo     bool   // whether it's in a cgo call
+	HasP      bool   // whether it holds a P, and so may run Go code
 }
 
 func (r *OsThread) String() string {
@@ -822,7 +987,30 @@ type MemStats struct {
 }
 
 func (r *MemStats) String() string {
-	return fmt.Sprintf("MemStats: %+v", *r)
+	last := "none"
+	if pauses := r.Pauses(); len(pauses) > 0 {
+		last = time.Duration(pauses[len(pauses)-1]).String()
+	}
+	return fmt.Sprintf("MemStats: Alloc = %d; TotalAlloc = %d; Sys = %d; Lookups = %d; Mallocs = %d; Frees = %d; "+
+		"HeapAlloc = %d; HeapSys = %d; HeapIdle = %d; HeapInuse = %d; HeapReleased = %d; HeapObjects = %d; "+
+		"StackInuse = %d; StackSys = %d; MSpanInuse = %d; MSpanSys = %d; MCacheInuse = %d; MCacheSys = %d; "+
+		"BuckHashSys = %d; GCSys = %d; OtherSys = %d; NextGC = %d; LastGC = %d; PauseTotalNs = %d; NumGC = %d; last pause = %s",
+		r.Alloc, r.TotalAlloc, r.Sys, r.Lookups, r.Mallocs, r.Frees,
+		r.HeapAlloc, r.HeapSys, r.HeapIdle, r.HeapInuse, r.HeapReleased, r.HeapObjects,
+		r.StackInuse, r.StackSys, r.MSpanInuse, r.MSpanSys, r.MCacheInuse, r.MCacheSys,
+		r.BuckHashSys, r.GCSys, r.OtherSys, r.NextGC, r.LastGC, r.PauseTotalNs, r.NumGC, last)
+}
+
+// Returns the lengths of the most recent GC pauses, in nanoseconds,
+// oldest first. PauseNs is a circular buffer, so it only holds the last
+// 256 of them.
+func (r *MemStats) Pauses() []uint64 {
+	n := min(r.NumGC, uint64(len(r.PauseNs)))
+	pauses := make([]uint64, 0, n)
+	for i := r.NumGC - n; i < r.NumGC; i++ {
+		pauses = append(pauses, r.PauseNs[i%uint64(len(r.PauseNs))])
+	}
+	return pauses
 }
 
 func (r *MemStats) Read(reader *bufio.Reader) (err error) {
@@ -993,14 +1181,16 @@ type QueuedFinalizer struct {
 	FinalizerEntryPc uint64 // PC of finalizer entry point
 	FinalizerType    uint64 // type of finalizer argument
 	ObjectType       uint64 // type of object
+	dumpRef
 }
 
 func (r *QueuedFinalizer) String() string {
-	return fmt.Sprintf("QueuedFinalizer @ 0x%x: FuncVal: 0x%x, Type: 0x%x, Object Type: 0x%x",
+	return fmt.Sprintf("QueuedFinalizer @ 0x%x: FuncVal: 0x%x, Entry: %s, Type: %s, Object Type: %s",
 		r.ObjectAddress,
 		r.FinalizerAddress,
-		r.FinalizerType,
-		r.ObjectType,
+		r.dump.Pc(r.FinalizerEntryPc),
+		r.dump.TypeAddr(r.FinalizerType),
+		r.dump.TypeAddr(r.ObjectType),
 	)
 }
 
@@ -1165,17 +1355,42 @@ func (r *BssSegment) Read(reader *bufio.Reader) (err error) {
 type DeferRecord struct {
 	Address             uint64 // defer record address
 	ContainingGoroutine uint64 // containing goroutine
-	Arcp                uint64 // argp
+	Arcp                uint64 // stack pointer of the frame that deferred the call (argp, in older versions)
 	Pc                  uint64 // pc
 	FuncVal             uint64 // FuncVal of defer
 	EntryPointPc        uint64 // PC of defer entry point
 	Next                uint64 // link to next defer record
+
+	// The record's pointer to its FuncVal, which keeps the deferred
+	// closure alive; filled in by InferTypes.
+	Contents []byte
+	Fields   []uint64
+	dumpRef
 }
 
 func (r *DeferRecord) GetAddress() uint64 {
 	return r.Address
 }
 
+func (r *DeferRecord) GetContents() []byte {
+	return r.Contents
+}
+
+func (r *DeferRecord) GetFields() []uint64 {
+	return r.Fields
+}
+
+func (r *DeferRecord) FieldName(offset uint64) string {
+	return "fn"
+}
+
+// The PC is where the deferring function will carry on from, once the
+// deferred call returns; it's just past the defer statement.
+func (r *DeferRecord) String() string {
+	return fmt.Sprintf("DeferRecord @ 0x%x: Goroutine 0x%x, calls %s, deferred at %s, FuncVal 0x%x; next = 0x%x",
+		r.Address, r.ContainingGoroutine, r.dump.Pc(r.EntryPointPc), r.dump.ReturnPc(r.Pc), r.FuncVal, r.Next)
+}
+
 func (r *DeferRecord) Read(reader *bufio.Reader) (err error) {
 	// Read Address as uvarint
 	r.Address, err = binary.ReadUvarint(reader)
@@ -1227,14 +1442,42 @@ type PanicRecord struct {
 	Goroutine      uint64 // containing goroutine
 	PanicArgType   uint64 // type ptr of panic arg eface
 	PanicArgData   uint64 // data field of panic arg eface
-	DeferRecordPtr uint64 // ptr to defer record that's currently running
+	DeferRecordPtr uint64 // ptr to defer record that's currently running (no longer recorded)
 	Next           uint64 // link to next panic record
+
+	Arg string // the value passed to panic, as best we can tell; filled in by InferTypes
+
+	// The record's pointer to the value passed to panic; filled in by
+	// InferTypes.
+	Contents []byte
+	Fields   []uint64
+	dumpRef
 }
 
 func (r *PanicRecord) GetAddress() uint64 {
 	return r.Address
 }
 
+func (r *PanicRecord) GetContents() []byte {
+	return r.Contents
+}
+
+func (r *PanicRecord) GetFields() []uint64 {
+	return r.Fields
+}
+
+func (r *PanicRecord) FieldName(offset uint64) string {
+	return "arg"
+}
+
+func (r *PanicRecord) String() string {
+	arg := r.Arg
+	if len(arg) == 0 {
+		arg = fmt.Sprintf("%s, %s", r.dump.TypeAddr(r.PanicArgType), r.dump.Addr(r.PanicArgData))
+	}
+	return fmt.Sprintf("PanicRecord @ 0x%x: Goroutine 0x%x, panic(%s); next = 0x%x", r.Address, r.Goroutine, arg, r.Next)
+}
+
 func (r *PanicRecord) Read(reader *bufio.Reader) (err error) {
 	// Read Address as uvarint
 	r.Address, err = binary.ReadUvarint(reader)
@@ -0,0 +1,30 @@
+package heapdump
+
+import (
+	"encoding/binary"
+	"sort"
+)
+
+// The tests build their records by hand, as a 64-bit, little-endian
+// runtime would lay them out.
+var testParams = &DumpParams{PointerSize: 8, HeapStart: 0x1000, HeapEnd: 0x100000}
+
+// Lays out a series of words.
+func words(values ...uint64) []byte {
+	b := make([]byte, 8*len(values))
+	for i, v := range values {
+		binary.LittleEndian.PutUint64(b[8*i:], v)
+	}
+	return b
+}
+
+// Returns a dump whose heap holds the indicated objects, as InferTypes
+// would leave it.
+func newTestDump(objects ...*Object) *Dump {
+	d := NewDump()
+	d.heapObjects = append([]*Object(nil), objects...)
+	sort.Slice(d.heapObjects, func(i, j int) bool {
+		return d.heapObjects[i].Address < d.heapObjects[j].Address
+	})
+	return d
+}
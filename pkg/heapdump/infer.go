@@ -0,0 +1,292 @@
+package heapdump
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/adamroach/heapspurs/pkg/gotype"
+)
+
+// Assigns names to objects based on information found elsewhere in the
+// dump. This needs to see every record before it can do its work,
+// since the records that tell us about an object (e.g., stack frames
+// and data segments) are generally written after the object itself.
+// Objects that already have a name (e.g., from an OID) are left alone.
+func (d *Dump) InferTypes(records []Record, p *DumpParams) {
+	objects := make(map[uint64]*Object)
+	heapObjects := d.heapObjects[:0]
+	segments := d.segments[:0]
+	for _, record := range records {
+		switch r := record.(type) {
+		case *Object:
+			objects[r.Address] = r
+			heapObjects = append(heapObjects, r)
+		case *DataSegment, *BssSegment:
+			segments = append(segments, r.(Owner))
+		}
+	}
+	sort.Slice(heapObjects, func(i, j int) bool {
+		return heapObjects[i].Address < heapObjects[j].Address
+	})
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i].GetAddress() < segments[j].GetAddress()
+	})
+	d.heapObjects = heapObjects
+	d.segments = segments
+
+	// Finalizers record the exact type of their object, so they
+	// take precedence over anything we infer from interfaces.
+	for _, record := range records {
+		switch r := record.(type) {
+		case *RegisteredFinalizer:
+			d.inferFinalizerType(r.ObjectAddress, r.ObjectType, r.FinalizerType, objects)
+		case *QueuedFinalizer:
+			d.inferFinalizerType(r.ObjectAddress, r.ObjectType, r.FinalizerType, objects)
+		}
+	}
+
+	for _, record := range records {
+		o, isOwner := record.(Owner)
+		if isOwner {
+			d.inferInterfaceTypes(o, objects, p)
+		}
+	}
+
+	pr := d.propagateTypes(records, objects, p)
+
+	// Whatever is left, we try to recognize by its shape, and then
+	// follow the pointers out of anything we're sure about.
+	for _, o := range d.matchTypes(records, p) {
+		pr.setType(o, o.Matches[0].Type)
+	}
+	pr.run()
+
+	d.findMaps(p)
+	d.findTextSlide(records)
+	goroutines := linkGoroutines(records)
+	d.nameFrameVars(goroutines, p)
+	d.linkDefers(records, goroutines, p)
+	d.linkThreads(records, goroutines, p)
+	d.findStackSizes(goroutines, p)
+	lastGC, estimated := d.findLastGC(goroutines, p)
+	for _, g := range goroutines {
+		g.LastGC = lastGC
+	}
+	d.lastGCEstimated = estimated
+	d.findChans(goroutines, p)
+	d.clusterShapes(records, objects, p)
+}
+
+// The object type of a finalizer is the pointer type that was passed to
+// runtime.SetFinalizer, so the object itself is whatever that points to.
+// The finalizer argument type is usually the same, but may also be an
+// interface; we fall back to it only if the object type doesn't help.
+func (d *Dump) inferFinalizerType(address uint64, objectType uint64, finalizerType uint64, objects map[uint64]*Object) {
+	target, found := objects[address]
+	if !found || len(target.Name) > 0 {
+		return
+	}
+	for _, typeAddr := range []uint64{objectType, finalizerType} {
+		t := d.GetType(typeAddr)
+		if t == nil || !strings.HasPrefix(t.Name, "*") {
+			continue
+		}
+		name := pointeeName(t)
+		if name != "" {
+			target.Name = name
+			d.AddName(target.Address, name)
+			return
+		}
+	}
+}
+
+// Interface values are two words long: a pointer to a type descriptor
+// (for interface{}) or an itab (for everything else), followed by a
+// pointer to the data. Older runtimes report both words as pointers,
+// while newer ones treat the first word as a scalar; either way, we can
+// find interfaces by checking whether the word in front of a pointer
+// lands on a known type, and use that type to name the object the
+// pointer refers to.
+func (d *Dump) inferInterfaceTypes(o Owner, objects map[uint64]*Object, p *DumpParams) {
+	contents := o.GetContents()
+	for _, offset := range o.GetFields() {
+		if offset < p.PointerSize {
+			continue
+		}
+		t := d.GetType(ReadWord(contents, offset-p.PointerSize, p))
+		if t == nil {
+			continue
+		}
+		name := pointeeName(t)
+		if name == "" {
+			continue
+		}
+		target, found := objects[ReadWord(contents, offset, p)]
+		if !found || len(target.Name) > 0 {
+			continue
+		}
+		target.Name = name
+		d.AddName(target.Address, name)
+	}
+}
+
+// Returns the name of the thing an interface holding a value of the
+// indicated type points to. Note that the runtime sets the "Indirect"
+// flag for every type that contains pointers -- including pointer types
+// themselves -- so we can't use it to tell whether the data word is a
+// *T or a T; we go by the type name instead.
+func pointeeName(t *TypeDescriptor) string {
+	// Types that carry methods are written as "<pkgpath>.<name>", and
+	// unnamed types (most notably, pointers to named types) have an
+	// empty name. That leaves us with only the package path, which
+	// isn't enough to go on.
+	if strings.HasSuffix(t.Name, ".") {
+		return ""
+	}
+	return strings.TrimPrefix(t.Name, "*")
+}
+
+// Once we know the type of something, we know the types of the things
+// it points to. Starting from the global variables (whose types come
+// from the program's debug information) and any objects we've already
+// named, we follow typed pointers through the heap, labeling each
+// object along the way.
+type propagator struct {
+	dump    *Dump
+	objects map[uint64]*Object
+	params  *DumpParams
+	queue   []*Object
+}
+
+func (d *Dump) propagateTypes(records []Record, objects map[uint64]*Object, p *DumpParams) *propagator {
+	pr := &propagator{dump: d, objects: objects, params: p}
+
+	for _, record := range records {
+		o, isObject := record.(*Object)
+		if isObject && len(o.Name) > 0 {
+			if t := d.types.Lookup(o.Name); t != nil {
+				pr.assign(o.Address, t, o.Name)
+			}
+		}
+	}
+
+	for _, record := range records {
+		var seg Owner
+		switch r := record.(type) {
+		case *DataSegment:
+			seg = r
+		case *BssSegment:
+			seg = r
+		default:
+			continue
+		}
+		contents := seg.GetContents()
+		for _, offset := range seg.GetFields() {
+			sym, symOffset := d.GetSymbol(seg.GetAddress() + offset)
+			if sym == nil {
+				continue
+			}
+			t := d.globalTypeMap[sym.Name]
+			if t == nil {
+				continue
+			}
+			slot, ok := t.SlotAt(symOffset)
+			if ok {
+				slot.Offset = offset - (symOffset - slot.Offset)
+				pr.follow(slot, offset, contents)
+			}
+		}
+	}
+
+	pr.run()
+	return pr
+}
+
+// Follows the pointers in every object that has been typed so far.
+func (pr *propagator) run() {
+	for len(pr.queue) > 0 {
+		o := pr.queue[0]
+		pr.queue = pr.queue[1:]
+		for _, offset := range o.Fields {
+			base := offset - offset%o.Type.Size
+			slot, ok := o.Type.SlotAt(offset - base)
+			if ok {
+				slot.Offset += base
+				pr.follow(slot, offset, o.Contents)
+			}
+		}
+	}
+}
+
+// Assigns a type to the object that starts at the indicated address.
+// The type is only used if the object's pointers line up with it;
+// otherwise, we've most likely been led astray by an interior pointer
+// or a stale field.
+func (pr *propagator) assign(address uint64, t *gotype.Type, name string) {
+	target, found := pr.objects[address]
+	if !found || target.Type != nil || (len(target.Name) > 0 && target.Name != name) {
+		return
+	}
+	if t != nil && !fitsType(target, t, pr.params) {
+		return
+	}
+	if len(target.Name) == 0 {
+		target.Name = name
+		pr.dump.AddName(target.Address, name)
+	}
+	if t != nil {
+		pr.setType(target, t)
+	}
+}
+
+func (pr *propagator) setType(o *Object, t *gotype.Type) {
+	o.Type = t
+	pr.queue = append(pr.queue, o)
+}
+
+// Follows the pointer found in a leaf of a typed value.
+func (pr *propagator) follow(slot gotype.Slot, offset uint64, contents []byte) {
+	p := pr.params
+	t := slot.Type
+	if offset != slot.Offset {
+		return
+	}
+	ptr := ReadWord(contents, offset, p)
+	switch t.Kind {
+	case gotype.Pointer:
+		if t.Elem.Size > 0 {
+			pr.assign(ptr, t.Elem, t.Elem.Name)
+		}
+	case gotype.Slice:
+		if t.Elem.Size > 0 {
+			capacity := ReadWord(contents, offset+2*p.PointerSize, p)
+			pr.assign(ptr, t.Elem, fmt.Sprintf("[%d]%s", capacity, t.Elem.Name))
+		}
+	case gotype.String:
+		pr.assign(ptr, nil, "string")
+	case gotype.Map, gotype.Chan:
+		if t.Elem != nil {
+			pr.assign(ptr, t.Elem, t.Name)
+		}
+	}
+}
+
+// Checks that every pointer in an object falls somewhere that the
+// indicated type (or an array of it) can hold a pointer.
+func fitsType(o *Object, t *gotype.Type, p *DumpParams) bool {
+	if t.Size == 0 || uint64(len(o.Contents)) < t.Size {
+		return false
+	}
+	end := uint64(len(o.Contents)) - uint64(len(o.Contents))%t.Size
+	for _, offset := range o.Fields {
+		if offset >= end {
+			continue
+		}
+		slot, ok := t.SlotAt(offset % t.Size)
+		if !ok || !slot.Type.HoldsPointerAt(offset%t.Size-slot.Offset, p.PointerSize) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,93 @@
+package heapdump
+
+import (
+	"fmt"
+
+	"github.com/adamroach/heapspurs/pkg/gotype"
+)
+
+// A parameter or local variable that holds a pointer in a stack frame.
+type FrameVar struct {
+	Function string // the function it belongs to
+	Name     string // e.g. "sess", or "req.ctx" for part of a struct
+	Param    bool
+}
+
+func (v *FrameVar) String() string {
+	if v.Param {
+		return fmt.Sprintf("argument `%s`", v.Name)
+	}
+	return fmt.Sprintf("local `%s`", v.Name)
+}
+
+// Works out which variable each pointer in each stack frame belongs
+// to, using the program's description of where its functions keep
+// their variables at each PC. Arguments that a function keeps on the
+// stack live at the bottom of its caller's frame, so a slot that isn't
+// one of the frame's own may belong to the function that it called.
+func (d *Dump) nameFrameVars(goroutines map[uint64]*Goroutine, p *DumpParams) {
+	for _, g := range goroutines {
+		for i, frame := range g.Frames {
+			frame.Vars = nil
+			for _, offset := range frame.Fields {
+				addr := frame.Address + offset
+				v := d.frameVar(frame, addr, p)
+				if v == nil && i > 0 {
+					v = d.frameVar(g.Frames[i-1], addr, p)
+				}
+				if v == nil {
+					continue
+				}
+				if frame.Vars == nil {
+					frame.Vars = make(map[uint64]*FrameVar)
+				}
+				frame.Vars[offset] = v
+			}
+		}
+	}
+}
+
+// Returns the variable that a frame's function keeps at the indicated
+// address, if any.
+func (d *Dump) frameVar(frame *StackFrame, addr uint64, p *DumpParams) *FrameVar {
+	fn := d.types.Function(frame.Name)
+	if fn == nil {
+		return nil
+	}
+	// Locations are given relative to the frame's CFA, which is the top
+	// of the frame, and by link-time PC.
+	offset := int64(addr - (frame.Address + uint64(len(frame.Contents))))
+	pc := frame.pc() - frame.EntryPc + fn.Entry
+	for _, v := range fn.Vars {
+		for _, loc := range v.Locations {
+			if loc.Low != loc.High && (pc < loc.Low || pc >= loc.High) {
+				continue
+			}
+			size := loc.Size
+			if size == 0 {
+				size = p.PointerSize
+				if v.Type != nil && v.Type.Size > loc.Piece {
+					size = v.Type.Size - loc.Piece
+				}
+			}
+			if offset < loc.Offset || offset >= loc.Offset+int64(size) {
+				continue
+			}
+			return &FrameVar{Function: fn.Name, Name: varPath(v, loc.Piece+uint64(offset-loc.Offset)), Param: v.Param}
+		}
+	}
+	return nil
+}
+
+// Names the part of a variable at the indicated offset into it.
+func varPath(v gotype.LocalVariable, offset uint64) string {
+	if v.Type != nil {
+		if name := fieldPath(v.Name, v.Type, offset); len(name) > 0 {
+			return name
+		}
+	}
+	if offset > 0 {
+		return fmt.Sprintf("%s+0x%x", v.Name, offset)
+	}
+	return v.Name
+}
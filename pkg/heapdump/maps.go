@@ -0,0 +1,314 @@
+package heapdump
+
+import (
+	"fmt"
+	"math/bits"
+	"strings"
+
+	"github.com/adamroach/heapspurs/pkg/gotype"
+)
+
+// A Go map, pieced together from the runtime objects that implement
+// it: the header, plus (for Swiss tables, Go 1.24 and later) the
+// directory, tables and groups, or (for the classic hash map) the
+// bucket arrays and overflow buckets.
+type MapInfo struct {
+	Header     *Object
+	Name       string // e.g. "map[string]string", or just "map" if we don't know the type
+	Swiss      bool
+	Entries    uint64
+	Capacity   uint64    // slots
+	Tombstones uint64    // Swiss tables only: deleted slots that haven't been reclaimed
+	Overflow   uint64    // classic maps only: overflow buckets
+	Objects    []*Object // every object that makes up the map, header first
+	Bytes      uint64    // total size of Objects
+	Wasted     uint64    // bytes taken up by tombstones or overflow buckets
+
+	roles []string // what each of Objects is, e.g. "table"
+}
+
+func (m *MapInfo) String() string {
+	return fmt.Sprintf("%d entries in %d objects, %d bytes, %d wasted", m.Entries, len(m.Objects), m.Bytes, m.Wasted)
+}
+
+const mapGroupSlots = 8
+
+// Works out which implementation a map header belongs to from its type.
+// The debug information describes a header struct for each map type
+// (e.g., "map<string,string>" or "hash<string,string>"), while the
+// runtime's own type descriptors only know about the generic one.
+func mapImplementation(t *gotype.Type) (swiss bool, classic bool) {
+	switch {
+	case t.Name == "internal/runtime/maps.Map" || t.Name == "maps.Map" || strings.HasPrefix(t.Name, "map<"):
+		return true, false
+	case t.Name == "runtime.hmap" || strings.HasPrefix(t.Name, "hash<"):
+		return false, true
+	}
+	return false, false
+}
+
+// Finds map headers, and gathers up the objects that belong to them.
+// Headers with a known type are taken at their word; otherwise, we
+// check that the header and its tables (or buckets) are consistent
+// with each other before believing that we've found a map.
+func (d *Dump) findMaps(p *DumpParams) []*MapInfo {
+	maps := make([]*MapInfo, 0)
+	for _, o := range d.heapObjects {
+		if o.Map != nil {
+			continue
+		}
+		typed := o.Type != nil
+		swiss, classic := true, true
+		if typed {
+			swiss, classic = mapImplementation(o.Type)
+		} else if len(o.Name) > 0 && !strings.HasPrefix(o.Name, "map[") {
+			continue
+		}
+		var m *MapInfo
+		if swiss {
+			m = d.swissMap(o, typed, p)
+		}
+		if m == nil && classic {
+			m = d.classicMap(o, typed, p)
+		}
+		if m == nil {
+			continue
+		}
+
+		m.Name = "map"
+		if strings.HasPrefix(o.Name, "map[") {
+			m.Name = o.Name
+		} else if len(o.Name) == 0 {
+			o.Name = m.Name
+			d.AddName(o.Address, m.Name)
+		}
+		for i, member := range m.Objects {
+			member.Map = m
+			m.Bytes += uint64(len(member.Contents))
+			if len(member.Name) == 0 {
+				member.Name = fmt.Sprintf("%s (%s)", m.Name, m.roles[i])
+				d.AddName(member.Address, member.Name)
+			}
+		}
+		maps = append(maps, m)
+	}
+	return maps
+}
+
+// Returns the object that a pointer points to the start of. Objects
+// with a malloc header (see heapShapes) are pointed to one word in.
+func (d *Dump) objectAt(ptr uint64, p *DumpParams) (*Object, bool) {
+	o := d.FindObject(ptr)
+	if o == nil || (ptr != o.Address && ptr != o.Address+p.PointerSize) {
+		return nil, false
+	}
+	return o, true
+}
+
+func (m *MapInfo) add(o *Object, role string) {
+	if o != nil && o.Map == nil {
+		for _, member := range m.Objects {
+			if member == o {
+				return
+			}
+		}
+		m.Objects = append(m.Objects, o)
+		m.roles = append(m.roles, role)
+	}
+}
+
+// Reads a little piece of an object, or zero if it's too short.
+func readUint(o *Object, offset uint64, size uint64, p *DumpParams) uint64 {
+	if offset+size > uint64(len(o.Contents)) {
+		return 0
+	}
+	if size == p.PointerSize {
+		return ReadWord(o.Contents, offset, p)
+	}
+	v := uint64(0)
+	for i := uint64(0); i < size; i++ {
+		b := uint64(o.Contents[offset+i])
+		if p.BigEndian {
+			v = v<<8 | b
+		} else {
+			v |= b << (8 * i)
+		}
+	}
+	return v
+}
+
+// Swiss tables: the header (internal/runtime/maps.Map) points either
+// to a single group, for small maps, or to a directory of tables, each
+// of which has an array of groups. Each group is a word of control
+// bytes followed by eight slots.
+func (d *Dump) swissMap(o *Object, typed bool, p *DumpParams) *MapInfo {
+	ps := p.PointerSize
+	if uint64(len(o.Contents)) < 8+4*ps {
+		return nil
+	}
+	if !typed && (len(o.Fields) != 1 || o.Fields[0] != 8+ps) {
+		return nil
+	}
+	used := readUint(o, 0, 8, p)
+	dirPtr := ReadWord(o.Contents, 8+ps, p)
+	dirLen := ReadWord(o.Contents, 8+2*ps, p)
+	depth := readUint(o, 8+3*ps, 1, p)
+
+	m := &MapInfo{Header: o, Swiss: true, Entries: used}
+	m.add(o, "header")
+	if dirPtr == 0 {
+		if !typed || used != 0 {
+			return nil
+		}
+		return m
+	}
+
+	if dirLen == 0 {
+		group, found := d.objectAt(dirPtr, p)
+		if !found || used > mapGroupSlots {
+			return nil
+		}
+		ctrl := dirPtr - group.Address
+		if uint64(len(group.Contents)) < ctrl+8 {
+			return nil
+		}
+		full := uint64(0)
+		for i := uint64(0); i < mapGroupSlots; i++ {
+			if group.Contents[ctrl+i]&0x80 == 0 {
+				full++
+			}
+		}
+		if full != used && !typed {
+			return nil
+		}
+		m.Capacity = mapGroupSlots
+		m.add(group, "group")
+		return m
+	}
+
+	if dirLen&(dirLen-1) != 0 || depth != uint64(bits.TrailingZeros64(dirLen)) {
+		return nil
+	}
+	dir, found := d.objectAt(dirPtr, p)
+	if !found || uint64(len(dir.Contents)) < dirLen*ps {
+		return nil
+	}
+	m.add(dir, "directory")
+	total := uint64(0)
+	var last uint64
+	for i := uint64(0); i < dirLen; i++ {
+		tablePtr := ReadWord(dir.Contents, i*ps, p)
+		if tablePtr == last {
+			// Tables can cover more than one directory entry.
+			continue
+		}
+		last = tablePtr
+		table, found := d.objectAt(tablePtr, p)
+		if !found || uint64(len(table.Contents)) < 8+3*ps {
+			return nil
+		}
+		tableUsed := readUint(table, 0, 2, p)
+		capacity := readUint(table, 2, 2, p)
+		growthLeft := readUint(table, 4, 2, p)
+		groupsPtr := ReadWord(table.Contents, 8+ps, p)
+		lengthMask := readUint(table, 8+2*ps, 8, p)
+		groups, found := d.objectAt(groupsPtr, p)
+		if !found || capacity < mapGroupSlots || capacity&(capacity-1) != 0 ||
+			tableUsed > capacity || lengthMask+1 != capacity/mapGroupSlots {
+			return nil
+		}
+		maxGrowthLeft := capacity * 7 / 8
+		if tableUsed+growthLeft > maxGrowthLeft {
+			return nil
+		}
+		tombstones := maxGrowthLeft - tableUsed - growthLeft
+		m.Capacity += capacity
+		m.Tombstones += tombstones
+		m.Wasted += uint64(len(groups.Contents)) * tombstones / capacity
+		total += tableUsed
+		m.add(table, "table")
+		m.add(groups, "groups")
+	}
+	if total != used && !typed {
+		return nil
+	}
+	return m
+}
+
+// Classic maps: the header (runtime.hmap) points to an array of 2^B
+// buckets, and during growth, to the old array as well. Overflow
+// buckets are chained from the last word of each bucket; we pick up the
+// ones listed in the mapextra struct (which, for maps whose buckets
+// have no pointers, is all of them), and count the rest.
+func (d *Dump) classicMap(o *Object, typed bool, p *DumpParams) *MapInfo {
+	ps := p.PointerSize
+	if uint64(len(o.Contents)) < 4*ps+8+ps {
+		return nil
+	}
+	bucketsAt, oldAt, extraAt := ps+8, 2*ps+8, 4*ps+8
+	if !typed {
+		if len(o.Fields) == 0 || o.Fields[0] != bucketsAt {
+			return nil
+		}
+		for _, f := range o.Fields {
+			if f != bucketsAt && f != oldAt && f != extraAt {
+				return nil
+			}
+		}
+	}
+	count := ReadWord(o.Contents, 0, p)
+	flags := readUint(o, ps, 1, p)
+	b := readUint(o, ps+1, 1, p)
+	noverflow := readUint(o, ps+2, 2, p)
+	bucketsPtr := ReadWord(o.Contents, bucketsAt, p)
+	if b > 8*ps-8 || flags > 0xf {
+		return nil
+	}
+
+	m := &MapInfo{Header: o, Entries: count, Overflow: noverflow}
+	m.add(o, "header")
+	if bucketsPtr == 0 {
+		if !typed || count != 0 {
+			return nil
+		}
+		return m
+	}
+	buckets, found := d.objectAt(bucketsPtr, p)
+	nbuckets := uint64(1) << b
+	if !found || uint64(len(buckets.Contents)) < nbuckets*(8+ps) {
+		return nil
+	}
+	m.Capacity = nbuckets * mapGroupSlots
+	if count > m.Capacity+noverflow*mapGroupSlots {
+		return nil
+	}
+	m.add(buckets, "buckets")
+	if old, found := d.objectAt(ReadWord(o.Contents, oldAt, p), p); found {
+		m.add(old, "old buckets")
+	}
+
+	// Overflow buckets, as listed in mapextra.
+	if extra, found := d.objectAt(ReadWord(o.Contents, extraAt, p), p); found {
+		m.add(extra, "extra")
+		for _, offset := range []uint64{0, ps} {
+			list, found := d.objectAt(readUint(extra, offset, ps, p), p)
+			if !found || uint64(len(list.Contents)) < 3*ps {
+				continue
+			}
+			m.add(list, "overflow list")
+			array, found := d.objectAt(ReadWord(list.Contents, 0, p), p)
+			if !found {
+				continue
+			}
+			m.add(array, "overflow list")
+			n := min(ReadWord(list.Contents, ps, p), uint64(len(array.Contents))/ps)
+			for i := uint64(0); i < n; i++ {
+				if bucket, found := d.objectAt(ReadWord(array.Contents, i*ps, p), p); found {
+					m.add(bucket, "overflow")
+				}
+			}
+		}
+	}
+	m.Wasted = noverflow * (uint64(len(buckets.Contents)) / nbuckets)
+	return m
+}
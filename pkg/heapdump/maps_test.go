@@ -0,0 +1,186 @@
+package heapdump
+
+import (
+	"testing"
+
+	"github.com/adamroach/heapspurs/pkg/gotype"
+)
+
+func TestSwissSmallMap(t *testing.T) {
+	const header, group = 0x1000, 0x2000
+	tests := []struct {
+		name  string
+		used  uint64
+		full  int // slots whose control byte says they're in use
+		typed bool
+		found bool
+	}{
+		{name: "empty", used: 0, full: 0, found: true},
+		{name: "one", used: 1, full: 1, found: true},
+		{name: "full", used: 8, full: 8, found: true},
+		{name: "full typed", used: 8, full: 8, typed: true, found: true},
+		{name: "too many", used: 9, full: 8},
+		{name: "too many typed", used: 9, full: 8, typed: true},
+		{name: "count mismatch", used: 3, full: 2},
+		{name: "count mismatch typed", used: 3, full: 2, typed: true, found: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Used, seed, dirPtr, dirLen, globalDepth and friends.
+			h := &Object{Address: header, Contents: words(test.used, 0, group, 0, 0), Fields: []uint64{16}}
+			if test.typed {
+				h.Type = &gotype.Type{Name: "internal/runtime/maps.Map"}
+			}
+			ctrl := make([]byte, 8)
+			for i := range ctrl {
+				ctrl[i] = 0x80
+				if i < test.full {
+					ctrl[i] = 0x01
+				}
+			}
+			g := &Object{Address: group, Contents: append(ctrl, make([]byte, 8*16)...)}
+			d := newTestDump(h, g)
+
+			m := d.swissMap(h, test.typed, testParams)
+			if (m != nil) != test.found {
+				t.Fatalf("swissMap() = %v; want found %v", m, test.found)
+			}
+			if m == nil {
+				return
+			}
+			if m.Entries != test.used || m.Capacity != mapGroupSlots || len(m.Objects) != 2 || m.Objects[1] != g {
+				t.Errorf("swissMap() = %d entries, capacity %d, %d objects; want %d entries, capacity %d, header and group",
+					m.Entries, m.Capacity, len(m.Objects), test.used, mapGroupSlots)
+			}
+		})
+	}
+}
+
+func TestSwissTables(t *testing.T) {
+	const header, dir, table1, groups1, table2, groups2 = 0x1000, 0x2000, 0x3000, 0x4000, 0x5000, 0x6000
+	// A table's used, capacity and growthLeft, then its index, groups
+	// and length mask.
+	table := func(addr uint64, used, growthLeft uint64, groups uint64) *Object {
+		return &Object{Address: addr, Contents: words(used|16<<16|growthLeft<<32, 0, groups, 1), Fields: []uint64{16}}
+	}
+	tests := []struct {
+		name       string
+		used       uint64
+		dirLen     uint64
+		depth      uint64
+		tables     []uint64
+		found      bool
+		tombstones uint64
+		objects    int
+	}{
+		{name: "two tables", used: 8, dirLen: 2, depth: 1, tables: []uint64{table1, table2}, found: true, tombstones: 2, objects: 6},
+		{name: "shared table", used: 5, dirLen: 2, depth: 1, tables: []uint64{table1, table1}, found: true, tombstones: 2, objects: 4},
+		{name: "count mismatch", used: 9, dirLen: 2, depth: 1, tables: []uint64{table1, table2}},
+		{name: "directory not a power of two", used: 8, dirLen: 3, depth: 1, tables: []uint64{table1, table2, table2}},
+		{name: "wrong depth", used: 8, dirLen: 2, depth: 2, tables: []uint64{table1, table2}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h := &Object{Address: header, Contents: words(test.used, 0, dir, test.dirLen, test.depth), Fields: []uint64{16}}
+			d := newTestDump(h,
+				&Object{Address: dir, Contents: words(test.tables...)},
+				// 5 used with 7 left to grow into means two tombstones.
+				table(table1, 5, 7, groups1),
+				&Object{Address: groups1, Contents: make([]byte, 2*(8+8*16))},
+				table(table2, 3, 11, groups2),
+				&Object{Address: groups2, Contents: make([]byte, 2*(8+8*16))},
+			)
+
+			m := d.swissMap(h, false, testParams)
+			if (m != nil) != test.found {
+				t.Fatalf("swissMap() = %v; want found %v", m, test.found)
+			}
+			if m == nil {
+				return
+			}
+			capacity := 16 * uint64(test.objects-2) / 2
+			if m.Entries != test.used || m.Capacity != capacity || m.Tombstones != test.tombstones || len(m.Objects) != test.objects {
+				t.Errorf("swissMap() = %d entries, capacity %d, %d tombstones, %d objects; want %d, %d, %d, %d",
+					m.Entries, m.Capacity, m.Tombstones, len(m.Objects), test.used, capacity, test.tombstones, test.objects)
+			}
+			// Each tombstone wastes a slot's share of its groups.
+			if want := test.tombstones * 2 * (8 + 8*16) / 16; m.Wasted != want {
+				t.Errorf("Wasted = %d; want %d", m.Wasted, want)
+			}
+		})
+	}
+}
+
+func TestClassicMap(t *testing.T) {
+	const header, buckets, extra, list, array, overflow = 0x1000, 0x2000, 0x3000, 0x4000, 0x5000, 0x6000
+	// Two buckets of eight tophash bytes, eight string keys, eight
+	// pointer values and an overflow pointer.
+	const bucketSize = 8 + 8*16 + 8*8 + 8
+	tests := []struct {
+		name      string
+		count     uint64
+		flags     uint64
+		noverflow uint64
+		extra     uint64
+		found     bool
+		objects   int
+	}{
+		{name: "no overflow", count: 10, found: true, objects: 2},
+		{name: "empty", count: 0, found: true, objects: 2},
+		{name: "overflow", count: 18, noverflow: 1, extra: extra, found: true, objects: 6},
+		{name: "too many entries", count: 17},
+		{name: "bad flags", count: 10, flags: 0x10},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Count; flags, B and noverflow; hash0; buckets,
+			// oldbuckets, nevacuate and extra.
+			h := &Object{
+				Address:  header,
+				Contents: words(test.count, test.flags|1<<8|test.noverflow<<16, buckets, 0, 0, test.extra),
+				Fields:   []uint64{16, 24, 40},
+			}
+			d := newTestDump(h,
+				&Object{Address: buckets, Contents: make([]byte, 2*bucketSize)},
+				&Object{Address: extra, Contents: words(list, 0, 0)},
+				&Object{Address: list, Contents: words(array, 1, 1)},
+				&Object{Address: array, Contents: words(overflow)},
+				&Object{Address: overflow, Contents: make([]byte, bucketSize)},
+			)
+
+			m := d.classicMap(h, false, testParams)
+			if (m != nil) != test.found {
+				t.Fatalf("classicMap() = %v; want found %v", m, test.found)
+			}
+			if m == nil {
+				return
+			}
+			if m.Entries != test.count || m.Capacity != 2*mapGroupSlots || m.Overflow != test.noverflow || len(m.Objects) != test.objects {
+				t.Errorf("classicMap() = %d entries, capacity %d, %d overflow, %d objects; want %d, %d, %d, %d",
+					m.Entries, m.Capacity, m.Overflow, len(m.Objects), test.count, 2*mapGroupSlots, test.noverflow, test.objects)
+			}
+			if want := test.noverflow * bucketSize; m.Wasted != want {
+				t.Errorf("Wasted = %d; want %d", m.Wasted, want)
+			}
+		})
+	}
+}
+
+func TestMapImplementation(t *testing.T) {
+	tests := []struct {
+		name           string
+		swiss, classic bool
+	}{
+		{"internal/runtime/maps.Map", true, false},
+		{"map<string,int>", true, false},
+		{"runtime.hmap", false, true},
+		{"hash<string,int>", false, true},
+		{"main.Session", false, false},
+	}
+	for _, test := range tests {
+		swiss, classic := mapImplementation(&gotype.Type{Name: test.name})
+		if swiss != test.swiss || classic != test.classic {
+			t.Errorf("mapImplementation(%s) = %v, %v; want %v, %v", test.name, swiss, classic, test.swiss, test.classic)
+		}
+	}
+}
@@ -0,0 +1,260 @@
+package heapdump
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/adamroach/heapspurs/pkg/gotype"
+)
+
+// A type that an object might be, based on its size and the positions
+// of its pointers. The confidence is the type's share of the evidence
+// among all the types that fit: a type whose size is exactly the
+// object's counts for more than one that leaves some of its size class
+// unused, one whose pointers are all accounted for counts for more than
+// one that needs its interface type words to go unreported, and one
+// that needs a malloc header to fit counts for less.
+type TypeMatch struct {
+	Type       *gotype.Type
+	Confidence float64 // 1.0 for a definite match
+}
+
+// How much less a type counts for, for each way in which it only just
+// fits an object.
+const (
+	sizeClassSlackWeight = 0.5
+	partialBitmapWeight  = 0.5
+	mallocHeaderWeight   = 0.5
+)
+
+// The sizes of the runtime's small object size classes. Anything larger
+// is rounded up to a whole number of pages.
+var sizeClasses = []uint64{
+	0, 8, 16, 24, 32, 48, 64, 80, 96, 112, 128, 144, 160, 176, 192, 208,
+	224, 240, 256, 288, 320, 352, 384, 416, 448, 480, 512, 576, 640, 704,
+	768, 896, 1024, 1152, 1280, 1408, 1536, 1792, 2048, 2304, 2688, 3072,
+	3200, 3456, 4096, 4864, 5376, 6144, 6528, 6784, 6912, 8192, 9472, 9728,
+	10240, 10880, 12288, 13568, 14336, 16384, 18432, 19072, 20480, 21760,
+	24576, 27264, 28672, 32768,
+}
+
+const pageSize = 8192
+
+func allocationSize(size uint64) uint64 {
+	if size > sizeClasses[len(sizeClasses)-1] {
+		return (size + pageSize - 1) &^ (pageSize - 1)
+	}
+	i := sort.Search(len(sizeClasses), func(i int) bool {
+		return sizeClasses[i] >= size
+	})
+	return sizeClasses[i]
+}
+
+type shapeKey struct {
+	size     uint64
+	pointers string
+}
+
+func newShapeKey(size uint64, pointers []uint64) shapeKey {
+	return shapeKey{size, fmt.Sprint(pointers)}
+}
+
+// One way that a type can look in the heap: the shape, the number of
+// bytes of it that the type itself uses, and how much the match should
+// count for, before considering the object's actual size.
+type heapShape struct {
+	key    shapeKey
+	size   uint64
+	weight float64
+}
+
+// Returns every shape that an object of the indicated type can take on
+// in the heap. Since Go 1.22, small objects with pointers that are too
+// large to describe with the span's bitmap start with a one-word header,
+// which pushes everything else down by a word; older runtimes don't do
+// this, so we allow for both. Interface type words may or may not be
+// reported as pointers, depending on the runtime version.
+func heapShapes(t *gotype.Type, ptrSize uint64) []heapShape {
+	all := t.PointerOffsets(ptrSize)
+	if len(all) == 0 || t.Size == 0 {
+		return nil
+	}
+	layouts := [][]uint64{all}
+	weights := []float64{1}
+	if typeWords := t.TypeWordOffsets(ptrSize); len(typeWords) > 0 {
+		skip := make(map[uint64]bool)
+		for _, o := range typeWords {
+			skip[o] = true
+		}
+		required := make([]uint64, 0, len(all))
+		for _, o := range all {
+			if !skip[o] {
+				required = append(required, o)
+			}
+		}
+		layouts = append(layouts, required)
+		weights = append(weights, partialBitmapWeight)
+	}
+
+	shapes := make([]heapShape, 0)
+	for i, layout := range layouts {
+		shapes = append(shapes, heapShape{newShapeKey(allocationSize(t.Size), layout), t.Size, weights[i]})
+		if t.Size > 8*ptrSize*ptrSize && t.Size <= sizeClasses[len(sizeClasses)-1] {
+			shifted := make([]uint64, len(layout))
+			for i, o := range layout {
+				shifted[i] = o + ptrSize
+			}
+			shapes = append(shapes, heapShape{newShapeKey(allocationSize(t.Size+ptrSize), shifted), t.Size + ptrSize, weights[i] * mallocHeaderWeight})
+		}
+	}
+	return shapes
+}
+
+// A type that fits a shape, with what it takes to fit.
+type shapeCandidate struct {
+	t      *gotype.Type
+	size   uint64
+	weight float64
+}
+
+// How much a candidate counts for, for an object of the indicated size.
+func (c shapeCandidate) weightFor(size uint64) float64 {
+	if c.size != size {
+		return c.weight * sizeClassSlackWeight
+	}
+	return c.weight
+}
+
+// Finds every known type that each unnamed object could be, based on
+// its size and the positions of its pointers. Objects without pointers
+// are left alone, since far too many types would fit them. Objects that
+// only one type fits are named after that type, and returned.
+func (d *Dump) matchTypes(records []Record, p *DumpParams) []*Object {
+	if d.types.Len() == 0 {
+		return nil
+	}
+	shapes := make(map[shapeKey][]shapeCandidate)
+	d.types.Each(func(t *gotype.Type) {
+		// Generic instantiations share "shape" types with the same
+		// layout, which only serve to muddy the waters.
+		if strings.Contains(t.Name, "go.shape.") {
+			return
+		}
+		for _, shape := range heapShapes(t, p.PointerSize) {
+			list := shapes[shape.key]
+			candidate := shapeCandidate{t, shape.size, shape.weight}
+			switch {
+			case len(list) == 0 || list[len(list)-1].t != t:
+				shapes[shape.key] = append(list, candidate)
+			case list[len(list)-1].weight < shape.weight:
+				// The same type fits the same shape in more than one
+				// way; keep the most convincing.
+				list[len(list)-1] = candidate
+			}
+		}
+	})
+
+	definite := make([]*Object, 0)
+	for _, record := range records {
+		o, isObject := record.(*Object)
+		if !isObject || len(o.Name) > 0 || o.Type != nil || len(o.Fields) == 0 {
+			continue
+		}
+		candidates := shapes[newShapeKey(uint64(len(o.Contents)), o.Fields)]
+		if len(candidates) == 0 {
+			continue
+		}
+		size := uint64(len(o.Contents))
+		total := 0.0
+		for _, c := range candidates {
+			total += c.weightFor(size)
+		}
+		o.Matches = make([]TypeMatch, len(candidates))
+		for i, c := range candidates {
+			o.Matches[i] = TypeMatch{c.t, c.weightFor(size) / total}
+		}
+		sort.SliceStable(o.Matches, func(i, j int) bool {
+			return o.Matches[i].Confidence > o.Matches[j].Confidence
+		})
+		if len(candidates) == 1 {
+			o.Name = candidates[0].t.Name
+			d.AddName(o.Address, o.Name)
+			definite = append(definite, o)
+		}
+	}
+	return definite
+}
+
+// Describes the types that an object might be, e.g.
+// "main.A 50%, main.B 50%".
+func (r *Object) MatchSummary() string {
+	if len(r.Matches) > 3 {
+		return fmt.Sprintf("one of %d types", len(r.Matches))
+	}
+	list := make([]string, 0, len(r.Matches))
+	for _, m := range r.Matches {
+		list = append(list, fmt.Sprintf("%s %.0f%%", m.Type.Name, 100*m.Confidence))
+	}
+	return strings.Join(list, ", ")
+}
+
+// Reads a file of type layouts, one per line, in the form
+//
+//	<size> <pointer offsets> <name>
+//
+// where the pointer offsets are a comma-separated list of byte offsets
+// (or "-" if there are none), e.g. "88 8,24,48,56,64 main.Session".
+// Blank lines and lines starting with "#" are ignored.
+func (d *Dump) ReadTypeFile(r io.Reader) error {
+	ptrSize := d.types.PtrSize
+	if ptrSize == 0 {
+		ptrSize = 8
+		d.types.PtrSize = ptrSize
+	}
+	s := bufio.NewScanner(r)
+	for line := 1; s.Scan(); line++ {
+		text := strings.TrimSpace(s.Text())
+		if len(text) == 0 || strings.HasPrefix(text, "#") {
+			continue
+		}
+		parts := strings.SplitN(text, " ", 3)
+		if len(parts) != 3 {
+			return fmt.Errorf("Line %d: expected '<size> <pointer offsets> <name>'", line)
+		}
+		size, err := strconv.ParseUint(parts[0], 0, 64)
+		if err != nil {
+			return fmt.Errorf("Line %d: bad size '%s': %w", line, parts[0], err)
+		}
+		t := &gotype.Type{Name: strings.TrimSpace(parts[2]), Kind: gotype.Struct, Size: size}
+		t.Bitmap = make([]byte, (size/ptrSize+7)/8)
+		if parts[1] != "-" {
+			for _, o := range strings.Split(parts[1], ",") {
+				offset, err := strconv.ParseUint(o, 0, 64)
+				if err != nil || offset%ptrSize != 0 || offset >= size {
+					return fmt.Errorf("Line %d: bad pointer offset '%s'", line, o)
+				}
+				t.Bitmap[offset/ptrSize/8] |= 1 << (offset / ptrSize % 8)
+			}
+		}
+		d.types.Add(t)
+	}
+	return s.Err()
+}
+
+// Reads the types declared in a Go source file. Types that the program
+// file already describes are left as they are.
+func (d *Dump) ReadTypeSource(filename string, r io.Reader) error {
+	if d.types.PtrSize == 0 {
+		d.types.PtrSize = 8
+	}
+	t, err := gotype.ParseSource(filename, r, d.types.PtrSize)
+	if err != nil {
+		return err
+	}
+	t.Each(d.types.Add)
+	return nil
+}
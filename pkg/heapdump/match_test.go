@@ -0,0 +1,171 @@
+package heapdump
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestAllocationSize(t *testing.T) {
+	tests := []struct {
+		size, want uint64
+	}{
+		{1, 8},
+		{8, 8},
+		{9, 16},
+		{33, 48},
+		{520, 576},
+		{32768, 32768},
+		{32769, 40960},
+	}
+	for _, test := range tests {
+		if got := allocationSize(test.size); got != test.want {
+			t.Errorf("allocationSize(%d) = %d; want %d", test.size, got, test.want)
+		}
+	}
+}
+
+// Types for the shape matching tests to tell apart.
+const matchSource = `package main
+
+type Pair struct {
+	a, b *int
+	n    int
+}
+
+type OtherPair struct {
+	a, b *string
+	n    int
+}
+
+type Forty struct {
+	p *int
+	a [4]int
+}
+
+type FortyEight struct {
+	p *int
+	a [5]int
+}
+
+type Tail struct {
+	n int
+	p *int
+	m int
+}
+
+type Boxed struct {
+	v interface{}
+	n int
+}
+
+type Big struct {
+	p *int
+	a [70]int
+}
+`
+
+func TestMatchTypes(t *testing.T) {
+	tests := []struct {
+		name    string
+		size    uint64
+		fields  []uint64
+		matches string // type and percentage of each match, likeliest first
+		named   string
+	}{
+		{
+			// Older runtimes report Boxed's type word as a pointer,
+			// which gives it the same shape as the pairs.
+			name:    "same shape",
+			size:    24,
+			fields:  []uint64{0, 8},
+			matches: "main.Boxed 33%, main.OtherPair 33%, main.Pair 33%",
+		},
+		{
+			// Forty leaves a word of its size class unused.
+			name:    "size class slack",
+			size:    48,
+			fields:  []uint64{0},
+			matches: "main.FortyEight 67%, main.Forty 33%",
+		},
+		{
+			// Boxed only fits if its interface's type word isn't
+			// reported as a pointer.
+			name:    "partial bitmap",
+			size:    24,
+			fields:  []uint64{8},
+			matches: "main.Tail 67%, main.Boxed 33%",
+		},
+		{
+			name:    "malloc header",
+			size:    576,
+			fields:  []uint64{8},
+			matches: "main.Big 100%",
+			named:   "main.Big",
+		},
+		{
+			name:   "no fit",
+			size:   32,
+			fields: []uint64{24},
+		},
+		{
+			name: "no pointers",
+			size: 24,
+		},
+	}
+
+	d := NewDump()
+	if err := d.ReadTypeSource("match.go", strings.NewReader(matchSource)); err != nil {
+		t.Fatalf("ReadTypeSource: %v", err)
+	}
+	records := make([]Record, len(tests))
+	for i, test := range tests {
+		records[i] = &Object{Address: uint64(0x1000 * (i + 1)), Contents: make([]byte, test.size), Fields: test.fields}
+	}
+	named := &Object{Address: 0x100000, Contents: make([]byte, 24), Fields: []uint64{0, 8}, Name: "main.Known"}
+	records = append(records, named)
+
+	definite := d.matchTypes(records, testParams)
+	for i, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			o := records[i].(*Object)
+			list := make([]string, 0)
+			for _, m := range o.Matches {
+				list = append(list, fmt.Sprintf("%s %.0f%%", m.Type.Name, 100*m.Confidence))
+			}
+			if got := strings.Join(list, ", "); got != test.matches {
+				t.Errorf("Matches = %q; want %q", got, test.matches)
+			}
+			if o.Name != test.named {
+				t.Errorf("Name = %q; want %q", o.Name, test.named)
+			}
+		})
+	}
+	if len(named.Matches) != 0 || named.Name != "main.Known" {
+		t.Errorf("Named object was matched: %v, %q", named.Matches, named.Name)
+	}
+	if want := []*Object{records[3].(*Object)}; !reflect.DeepEqual(definite, want) {
+		t.Errorf("matchTypes() returned %d objects; want just the one with a malloc header", len(definite))
+	}
+}
+
+func TestReadTypeFile(t *testing.T) {
+	d := NewDump()
+	err := d.ReadTypeFile(strings.NewReader("# size, pointers, name\n\n88 8,24,48,56,64 main.Session\n16 - main.Point\n"))
+	if err != nil {
+		t.Fatalf("ReadTypeFile: %v", err)
+	}
+	if got := d.LookupType("main.Session").PointerOffsets(8); !reflect.DeepEqual(got, []uint64{8, 24, 48, 56, 64}) {
+		t.Errorf("main.Session pointers = %v", got)
+	}
+	if got := d.LookupType("main.Point"); got == nil || got.Size != 16 || len(got.PointerOffsets(8)) != 0 {
+		t.Errorf("main.Point = %v", got)
+	}
+
+	for _, bad := range []string{"88 main.Session", "x 8 main.Session", "88 4 main.Session", "88 88 main.Session"} {
+		if err := NewDump().ReadTypeFile(strings.NewReader(bad)); err == nil {
+			t.Errorf("ReadTypeFile(%q) succeeded; want an error", bad)
+		}
+	}
+}
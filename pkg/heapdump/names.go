@@ -1,55 +1,138 @@
 package heapdump
 
 import (
+	"debug/gosym"
 	"fmt"
 	"io"
-	"strconv"
+	"os"
+	"sort"
+
+	"github.com/adamroach/heapspurs/pkg/gotype"
+	"github.com/adamroach/heapspurs/pkg/program"
 )
 
-var nameMap map[uint64]string
-var nameSizeMap map[uint64]map[int]string
-var oidMap map[uint64]string
+// Everything we know about what's where in one heap dump: the names
+// and types that the program file, OID file and so on give us, and
+// whatever we work out from the dump's own records. Records read
+// through a Dump keep a pointer back to it, so that they can name the
+// things they point to when they're printed.
+type Dump struct {
+	nameMap       map[uint64]string
+	nameSizeMap   map[uint64]map[int]string
+	oidMap        map[uint64]string
+	typeMap       map[uint64]*TypeDescriptor
+	itabMap       map[uint64]uint64
+	symbols       []program.Symbol // Sorted by address
+	slide         uint64           // Offset of runtime addresses from link-time addresses
+	slideFrom     string           // Symbol that the current slide was computed from
+	types         *gotype.Table
+	globalTypeMap map[string]*gotype.Type
+	descriptors   map[uint64]*gotype.Type // Runtime type descriptors, by link-time address
+	heapObjects   []*Object               // Sorted by address; filled in by InferTypes
+	segments      []Owner                 // Data and BSS segments, sorted by address; filled in by InferTypes
+	lines         *gosym.Table            // From the program's pclntab, if we have it
+	textSlide     uint64                  // Offset of runtime code addresses from link-time addresses
 
-func init() {
-	nameMap = make(map[uint64]string)
-	nameSizeMap = make(map[uint64]map[int]string)
-	oidMap = make(map[uint64]string)
+	lastGCEstimated bool // Whether Goroutine.LastGC is the latest WaitStart, rather than read from the runtime
 }
 
-func AddOid(oid uint64, name string) {
-	oidMap[oid] = name
+func NewDump() *Dump {
+	return &Dump{
+		nameMap:       make(map[uint64]string),
+		nameSizeMap:   make(map[uint64]map[int]string),
+		oidMap:        make(map[uint64]string),
+		typeMap:       make(map[uint64]*TypeDescriptor),
+		itabMap:       make(map[uint64]uint64),
+		types:         gotype.NewTable(),
+		globalTypeMap: make(map[string]*gotype.Type),
+	}
 }
 
-func AddName(addr uint64, name string) {
-	nameMap[addr] = name
+// Records that need the rest of the dump to describe themselves embed
+// this. It's nil for records that weren't read through a Dump, which
+// are described without any names.
+type dumpRef struct {
+	dump *Dump
 }
 
-func AddNameWithSize(addr uint64, size int, name string) {
-	if _, found := nameSizeMap[addr]; !found {
-		nameSizeMap[addr] = make(map[int]string)
+func (r *dumpRef) setDump(d *Dump) {
+	r.dump = d
+}
+
+func (d *Dump) AddOid(oid uint64, name string) {
+	d.oidMap[oid] = name
+}
+
+func (d *Dump) AddName(addr uint64, name string) {
+	d.nameMap[addr] = name
+}
+
+func (d *Dump) AddNameWithSize(addr uint64, size int, name string) {
+	if _, found := d.nameSizeMap[addr]; !found {
+		d.nameSizeMap[addr] = make(map[int]string)
 	}
 
-	nameSizeMap[addr][size] = name
+	d.nameSizeMap[addr][size] = name
+}
+
+func (d *Dump) AddType(t *TypeDescriptor) {
+	d.typeMap[t.Address] = t
+}
+
+func (d *Dump) AddItab(addr uint64, typeAddr uint64) {
+	d.itabMap[addr] = typeAddr
 }
 
-func GetNameWithSize(addr uint64, size int) string {
-	if _, found := nameSizeMap[addr]; found {
-		if name, found := nameSizeMap[addr][size]; found {
+// Returns the type descriptor at the indicated address. Because
+// the first word of an interface value may point to either a type
+// descriptor (for interface{}) or an itab (for non-empty interfaces),
+// itab addresses are resolved to their underlying type as well.
+func (d *Dump) GetType(addr uint64) *TypeDescriptor {
+	if d == nil {
+		return nil
+	}
+	if typeAddr, found := d.itabMap[addr]; found {
+		addr = typeAddr
+	}
+	return d.typeMap[addr]
+}
+
+func (d *Dump) GetNameWithSize(addr uint64, size int) string {
+	if d == nil {
+		return ""
+	}
+	if _, found := d.nameSizeMap[addr]; found {
+		if name, found := d.nameSizeMap[addr][size]; found {
 			return name
 		}
 	}
 	return ""
 }
 
-func GetName(addr uint64) string {
-	name, found := nameMap[addr]
+func (d *Dump) GetName(addr uint64) string {
+	if d == nil {
+		return ""
+	}
+	name, found := d.nameMap[addr]
 	if found {
 		return name + "(?)"
 	}
+	sym, offset := d.GetSymbol(addr)
+	if sym != nil {
+		if offset == 0 {
+			return sym.Name
+		}
+		if t, found := d.globalTypeMap[sym.Name]; found {
+			if name := fieldPath(sym.Name, t, offset); len(name) > 0 {
+				return name
+			}
+		}
+		return fmt.Sprintf("%s+0x%x", sym.Name, offset)
+	}
 	return ""
 }
 
-func ReadOids(r io.Reader) error {
+func (d *Dump) ReadOids(r io.Reader) error {
 	var oid uint64
 	var name string
 	for {
@@ -61,36 +144,189 @@ func ReadOids(r io.Reader) error {
 			return err
 		}
 		if n == 2 && oid > 0 && len(name) > 0 {
-			oidMap[oid] = name
+			d.oidMap[oid] = name
 		}
 	}
 	return nil
 }
 
-func ReadSymbols(r io.Reader) error {
-	var addr, kind, name string
-	for {
-		n, err := fmt.Fscanln(r, &addr, &kind, &name)
-		if err == io.EOF {
-			break
+func (d *Dump) ReadSymbols(p *program.Program) error {
+	if len(p.Symbols) == 0 {
+		return fmt.Errorf("No symbols found")
+	}
+	d.symbols = append([]program.Symbol(nil), p.Symbols...)
+	d.slide = 0
+	d.slideFrom = ""
+	return nil
+}
+
+func (d *Dump) ReadTypes(t *gotype.Table) {
+	d.types = t
+	for _, v := range t.Globals {
+		d.globalTypeMap[v.Name] = v.Type
+	}
+}
+
+// Reads the names and layouts of the runtime's type descriptors, which
+// lets us name the types of interface values, even if the dump didn't
+// describe them.
+func (d *Dump) ReadTypeDescriptors(t *gotype.Table) {
+	d.descriptors = t.Descriptors
+}
+
+// Returns the type whose runtime descriptor is at the indicated address.
+func (d *Dump) GetDescriptorType(addr uint64) *gotype.Type {
+	if d == nil {
+		return nil
+	}
+	return d.descriptors[addr-d.slide]
+}
+
+func (d *Dump) ReadLineTable(t *gosym.Table) {
+	d.lines = t
+	d.textSlide = 0
+}
+
+// Returns the type with the indicated name, if the program describes it.
+func (d *Dump) LookupType(name string) *gotype.Type {
+	return d.types.Lookup(name)
+}
+
+// Returns the type of the indicated global variable, if known.
+func (d *Dump) GetGlobalType(name string) *gotype.Type {
+	return d.globalTypeMap[name]
+}
+
+// Position-independent executables (the default on several platforms)
+// are loaded at an address of the OS's choosing, so symbol values only
+// match runtime addresses once we account for the difference. The dump
+// tells us where the data and BSS segments actually ended up; comparing
+// that to the symbols that mark the start of those segments tells us
+// how far everything has moved. Every symbol is adjusted accordingly.
+func (d *Dump) observeSegment(marker string, address uint64) {
+	symbols := d.symbols
+	for i := range symbols {
+		if symbols[i].Name != marker {
+			continue
 		}
-		if err == nil && n == 3 {
-			addrInt, err := strconv.ParseUint(addr, 16, 64)
-			if err == nil {
-				nameMap[addrInt] = name
-			}
+		linkAddress := symbols[i].Address - d.slide
+		newSlide := address - linkAddress
+		if len(d.slideFrom) > 0 && newSlide != d.slide {
+			fmt.Fprintf(os.Stderr, "Warning: %s is offset by 0x%x, but %s is offset by 0x%x; symbol names may be wrong\n",
+				marker, newSlide, d.slideFrom, d.slide)
+		}
+		for j := range symbols {
+			symbols[j].Address += newSlide - d.slide
 		}
+		d.slide = newSlide
+		d.slideFrom = marker
+		return
 	}
-	return nil
 }
 
-// Print out address and, if relevant, the name of what resides there
-type Addr uint64
+// Returns the symbol that contains the indicated address, along with
+// the offset of the address into that symbol.
+func (d *Dump) GetSymbol(addr uint64) (*program.Symbol, uint64) {
+	if d == nil {
+		return nil, 0
+	}
+	symbols := d.symbols
+	i := sort.Search(len(symbols), func(i int) bool {
+		return symbols[i].Address > addr
+	})
+	// Symbols can share a starting address with zero-length markers
+	// (and, occasionally, each other), so look back a little way for
+	// the one that actually contains the address.
+	var exact *program.Symbol
+	for j := i - 1; j >= 0 && j >= i-8; j-- {
+		s := &symbols[j]
+		if addr < s.Address+s.Size {
+			return s, addr - s.Address
+		}
+		if s.Address == addr && exact == nil {
+			exact = s
+		}
+	}
+	if exact != nil {
+		return exact, 0
+	}
+	return nil, 0
+}
+
+// Works out how far the program's code has moved from its link-time
+// address by finding a function that we know the runtime address of.
+// Stack frames tell us both the name and entry point of their function.
+// Reports whether any of the records did.
+func (d *Dump) findTextSlide(records []Record) bool {
+	if d.lines == nil {
+		return false
+	}
+	for _, record := range records {
+		frame, isFrame := record.(*StackFrame)
+		if !isFrame {
+			continue
+		}
+		if fn := d.lines.LookupFunc(frame.Name); fn != nil {
+			d.textSlide = frame.EntryPc - fn.Entry
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the function, source file and line that a program counter
+// belongs to, if we have the program's line table.
+func (d *Dump) SourceLine(pc uint64) (fn string, file string, line int, found bool) {
+	if d == nil || d.lines == nil {
+		return "", "", 0, false
+	}
+	file, line, f := d.lines.PCToLine(pc - d.textSlide)
+	if f == nil {
+		return "", "", 0, false
+	}
+	return f.Name, file, line, true
+}
+
+// Formats a program counter and, if known, the function and source
+// line that it's in.
+func (d *Dump) Pc(pc uint64) string {
+	if fn, file, line, found := d.SourceLine(pc); found {
+		return fmt.Sprintf("0x%x (%s at %s:%d)", pc, fn, file, line)
+	}
+	return d.Addr(pc)
+}
+
+// Formats a return address, such as the PC of any stack frame but the
+// innermost, or the PC that created a goroutine. These point just past
+// the call instruction, which may be on a different line (or even in a
+// different function, if the call was the last thing in it).
+func (d *Dump) ReturnPc(pc uint64) string {
+	if fn, file, line, found := d.SourceLine(pc - 1); found {
+		return fmt.Sprintf("0x%x (%s at %s:%d)", pc, fn, file, line)
+	}
+	return d.Addr(pc)
+}
 
-func (a Addr) String() string {
-	name := GetName(uint64(a))
+// Formats an address and, if relevant, the name of what resides there.
+func (d *Dump) Addr(addr uint64) string {
+	name := d.GetName(addr)
 	if name != "" {
-		return fmt.Sprintf("0x%x (%s)", uint64(a), name)
+		return fmt.Sprintf("0x%x (%s)", addr, name)
+	}
+	return fmt.Sprintf("0x%x", addr)
+}
+
+// Formats the address of a type descriptor and, if known, its name.
+// The dump only describes a type after the records that refer to it,
+// so when we're printing records as we read them, the program's own
+// descriptors are often all we have to go on.
+func (d *Dump) TypeAddr(addr uint64) string {
+	t := d.GetType(addr)
+	if t != nil {
+		return fmt.Sprintf("0x%x (%s)", addr, t.Name)
+	}
+	if t := d.GetDescriptorType(addr); t != nil && len(t.Name) > 0 && t.Name != "?" {
+		return fmt.Sprintf("0x%x (%s)", addr, t.Name)
 	}
-	return fmt.Sprintf("0x%x", uint64(a))
+	return fmt.Sprintf("0x%x", addr)
 }
@@ -4,57 +4,150 @@ import (
 	"bufio"
 	"fmt"
 	"regexp"
-)
-
-func PrintRecords(reader *bufio.Reader, search string) error {
+	"strconv"
+	"strings"
 
-	re, err := regexp.Compile(search)
-	if err != nil {
-		return fmt.Errorf("Bad regex '%s': %w\n", search, err)
-	}
+	"github.com/adamroach/heapspurs/pkg/gotype"
+)
 
-	err = ReadHeader(reader)
+// Prints every record in the dump as it's read, so that this works on
+// dumps too large to hold in memory. Objects are named only from what
+// we already know about their addresses (OIDs, symbols and so on),
+// since inferring their types means reading the whole dump first.
+func (d *Dump) PrintRecords(reader *bufio.Reader) error {
+	err := ReadHeader(reader)
 	if err != nil {
 		return fmt.Errorf("Reading header: %w\n", err)
 	}
 
 	var params *DumpParams
+	slid := false
 
 	for {
-		record, err := ReadRecord(reader)
+		record, err := d.ReadRecord(reader)
 		if err != nil {
 			return (err)
 		}
-		p, isParams := record.(*DumpParams)
-		if isParams {
-			params = p
+		switch r := record.(type) {
+		case *DumpParams:
+			params = r
+		case *StackFrame:
+			// The first frame we can find in the line table tells us
+			// where the program's code was loaded.
+			if !slid {
+				slid = d.findTextSlide([]Record{r})
+			}
+		}
+		d.printRecord(record, params)
+		if _, isEof := record.(*Eof); isEof {
+			return nil
 		}
+	}
+}
 
+// Prints the objects whose names match the indicated regular
+// expression. Unlike PrintRecords, this reads the whole dump and infers
+// the types of its objects first, so that they can be found by type or
+// by shape.
+func (d *Dump) FindRecords(reader *bufio.Reader, search string) error {
+	re, err := regexp.Compile(search)
+	if err != nil {
+		return fmt.Errorf("Bad regex '%s': %w\n", search, err)
+	}
+
+	records, params, err := d.ReadRecords(reader)
+	if err != nil {
+		return err
+	}
+
+	d.InferTypes(records, params)
+
+	for _, record := range records {
 		_, isEof := record.(*Eof)
 		obj, isObject := record.(*Object)
-		if len(search) > 0 && !isEof && (!isObject || !(re.MatchString(obj.Name) || re.MatchString(obj.AddrPretty()))) {
+		if !isEof && (!isObject || !(re.MatchString(obj.GetName()) || re.MatchString(obj.AddrPretty()))) {
 			continue
 		}
-		s, canString := record.(fmt.Stringer)
-		if canString {
-			fmt.Printf("%s\n", s.String())
-		} else {
-			fmt.Printf("%T\n", record)
-		}
-		o, isOwner := record.(Owner)
-		if isOwner {
-			pointers := GetPointers(o, params)
-			for i := 0; i < len(pointers); i++ {
-				if pointers[i] != 0 {
-					a, _ := record.(Addressable)
-					address := a.GetAddress() + o.GetFields()[i]
-					fmt.Printf("  Pointer[%d]@%s = %s\n", i, Addr(address), Addr(pointers[i]))
+		d.printRecord(record, params)
+	}
+	return nil
+}
+
+func (d *Dump) printRecord(record Record, params *DumpParams) {
+	s, canString := record.(fmt.Stringer)
+	if canString {
+		fmt.Printf("%s\n", s.String())
+	} else {
+		fmt.Printf("%T\n", record)
+	}
+	o, isOwner := record.(Owner)
+	if !isOwner {
+		return
+	}
+	pointers := GetPointers(o, params)
+	for i := 0; i < len(pointers); i++ {
+		if pointers[i] != 0 {
+			a, _ := record.(Addressable)
+			address := a.GetAddress() + o.GetFields()[i]
+			label := fmt.Sprintf("Pointer[%d]", i)
+			if f, hasFields := record.(FieldNamer); hasFields {
+				if name := f.FieldName(o.GetFields()[i]); len(name) > 0 {
+					label = name
 				}
 			}
+			target := d.Addr(pointers[i])
+			if h, isHeader := d.FindHeader(o, o.GetFields()[i], params); isHeader {
+				target += " " + h.String()
+			}
+			fmt.Printf("  %s@%s = %s\n", label, d.Addr(address), target)
+		}
+	}
+}
+
+// Prints every type we know the layout of, along with the offsets of
+// its pointers.
+func (d *Dump) PrintTypes() error {
+	if d.types.Len() == 0 {
+		fmt.Printf("No types loaded; use --program to specify the program file\n")
+		return nil
+	}
+	fmt.Printf("%10s %8s  %-40s %s\n", "Size", "Pointers", "Type", "Pointer Offsets")
+	d.types.Each(func(t *gotype.Type) {
+		offsets := t.PointerOffsets(d.types.PtrSize)
+		list := make([]string, 0)
+		for i, o := range offsets {
+			if i == 8 {
+				list = append(list, "...")
+				break
+			}
+			list = append(list, strconv.FormatUint(o, 10))
+		}
+		fmt.Printf("%10d %8d  %-40s %s\n", t.Size, len(offsets), t.Name, strings.Join(list, ","))
+	})
+	return nil
+}
+
+// Reads every record in the dump, up to and including the Eof record.
+func (d *Dump) ReadRecords(reader *bufio.Reader) (records []Record, params *DumpParams, err error) {
+	err = ReadHeader(reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Reading header: %w\n", err)
+	}
+
+	for {
+		var record Record
+		record, err = d.ReadRecord(reader)
+		if err != nil {
+			return
 		}
+		records = append(records, record)
+		p, isParams := record.(*DumpParams)
+		if isParams {
+			params = p
+		}
+		_, isEof := record.(*Eof)
 		if isEof {
-			break
+			return
 		}
 	}
-	return nil
 }
@@ -0,0 +1,81 @@
+package heapdump
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"strings"
+)
+
+// Groups the objects that we still don't have a name for by their
+// shape: their size, the positions of their pointers, and the names (or
+// basic shapes) of the objects they point to. Each group gets a
+// synthetic name, like "shape#1f3a9c07[64B,ptrs@0,16]", so that even
+// without any type information we can tell that there are two million
+// of the same thing. The ID is taken from a hash of the shape, so the
+// same shape gets the same name from one dump to the next.
+func (d *Dump) clusterShapes(records []Record, objects map[uint64]*Object, p *DumpParams) {
+	unnamed := make([]*Object, 0)
+	base := make(map[*Object]string)
+	for _, record := range records {
+		o, isObject := record.(*Object)
+		if isObject && len(o.Name) == 0 {
+			unnamed = append(unnamed, o)
+			base[o] = fmt.Sprintf("%d:%v", len(o.Contents), o.Fields)
+		}
+	}
+
+	clusters := make(map[uint64][]*Object)
+	for _, o := range unnamed {
+		h := fnv.New64a()
+		h.Write([]byte(base[o]))
+		for _, offset := range o.Fields {
+			h.Write([]byte{0})
+			target, found := objects[ReadWord(o.Contents, offset, p)]
+			switch {
+			case !found:
+				h.Write([]byte("-"))
+			case len(target.Name) > 0:
+				h.Write([]byte(target.Name))
+			default:
+				h.Write([]byte(base[target]))
+			}
+		}
+		key := h.Sum64()
+		clusters[key] = append(clusters[key], o)
+	}
+
+	// Eight hex digits are plenty to tell the shapes in a dump apart,
+	// but if two of them do collide, they both get all sixteen.
+	ids := make(map[uint64]int)
+	for key := range clusters {
+		ids[key>>32]++
+	}
+	for key, cluster := range clusters {
+		id := fmt.Sprintf("%08x", key>>32)
+		if ids[key>>32] > 1 {
+			id = fmt.Sprintf("%016x", key)
+		}
+		name := shapeName(id, cluster[0])
+		for _, o := range cluster {
+			o.Shape = name
+			d.AddName(o.Address, name)
+		}
+	}
+}
+
+// Formats a shape name, listing up to four pointer offsets.
+func shapeName(id string, o *Object) string {
+	if len(o.Fields) == 0 {
+		return fmt.Sprintf("shape#%s[%dB,noptrs]", id, len(o.Contents))
+	}
+	list := make([]string, 0)
+	for i, offset := range o.Fields {
+		if i == 4 {
+			list = append(list, "...")
+			break
+		}
+		list = append(list, strconv.FormatUint(offset, 10))
+	}
+	return fmt.Sprintf("shape#%s[%dB,ptrs@%s]", id, len(o.Contents), strings.Join(list, ","))
+}
@@ -0,0 +1,86 @@
+package heapdump
+
+import (
+	"reflect"
+	"regexp"
+	"testing"
+)
+
+func TestShapeName(t *testing.T) {
+	tests := []struct {
+		size   int
+		fields []uint64
+		want   string
+	}{
+		{16, nil, "shape#0123abcd[16B,noptrs]"},
+		{24, []uint64{0, 16}, "shape#0123abcd[24B,ptrs@0,16]"},
+		{64, []uint64{0, 8, 16, 24, 32}, "shape#0123abcd[64B,ptrs@0,8,16,24,...]"},
+	}
+	for _, test := range tests {
+		o := &Object{Contents: make([]byte, test.size), Fields: test.fields}
+		if got := shapeName("0123abcd", o); got != test.want {
+			t.Errorf("shapeName(%d bytes, %v) = %q; want %q", test.size, test.fields, got, test.want)
+		}
+	}
+}
+
+// Builds the same little heap at the indicated base address, with its
+// objects in either order, and returns the shape that each is given.
+func clusterTestHeap(base uint64, reverse bool) []string {
+	known := &Object{Address: base, Contents: make([]byte, 16), Name: "main.Known"}
+	leaf := &Object{Address: base + 0x100, Contents: make([]byte, 16)}
+	objects := []*Object{
+		known,
+		leaf,
+		// Two objects that point to the same kind of thing, and one
+		// of the same size and layout that doesn't.
+		{Address: base + 0x200, Contents: words(base), Fields: []uint64{0}},
+		{Address: base + 0x300, Contents: words(base), Fields: []uint64{0}},
+		{Address: base + 0x400, Contents: words(base + 0x100), Fields: []uint64{0}},
+		// And one that points outside the heap.
+		{Address: base + 0x500, Contents: words(0x42), Fields: []uint64{0}},
+	}
+	records := make([]Record, len(objects))
+	byAddress := make(map[uint64]*Object)
+	for i, o := range objects {
+		if reverse {
+			records[len(objects)-1-i] = o
+		} else {
+			records[i] = o
+		}
+		byAddress[o.Address] = o
+	}
+	newTestDump(objects...).clusterShapes(records, byAddress, testParams)
+	shapes := make([]string, len(objects))
+	for i, o := range objects {
+		shapes[i] = o.Shape
+	}
+	return shapes
+}
+
+func TestClusterShapes(t *testing.T) {
+	shapes := clusterTestHeap(0x1000, false)
+	if shapes[0] != "" {
+		t.Errorf("Named object got shape %q", shapes[0])
+	}
+	pattern := regexp.MustCompile(`^shape#[0-9a-f]{8}\[8B,ptrs@0\]$`)
+	for i, shape := range shapes[2:] {
+		if !pattern.MatchString(shape) {
+			t.Errorf("Object %d has shape %q; want one like %v", i+2, shape, pattern)
+		}
+	}
+	if !regexp.MustCompile(`^shape#[0-9a-f]{8}\[16B,noptrs\]$`).MatchString(shapes[1]) {
+		t.Errorf("Leaf has shape %q", shapes[1])
+	}
+	if shapes[2] != shapes[3] {
+		t.Errorf("Objects pointing to the same type got shapes %q and %q", shapes[2], shapes[3])
+	}
+	if shapes[2] == shapes[4] || shapes[2] == shapes[5] || shapes[4] == shapes[5] {
+		t.Errorf("Objects pointing to different things share a shape: %q, %q, %q", shapes[2], shapes[4], shapes[5])
+	}
+
+	// Names don't depend on where things are, or what order they're in.
+	if moved := clusterTestHeap(0x7f0000, true); !reflect.DeepEqual(moved, shapes) {
+		t.Errorf("Shapes changed when the heap moved: %v; want %v", moved, shapes)
+	}
+}
@@ -0,0 +1,36 @@
+// A small program that leaves a goroutine blocked across two garbage
+// collections, and then writes a heap dump to the file named by its
+// argument.
+package main
+
+import (
+	"os"
+	"runtime"
+	"runtime/debug"
+	"time"
+)
+
+// The first collection to find a goroutine waiting notes when the one
+// before it finished, so it takes two for the wait to show.
+//
+//go:noinline
+func blocked(c chan int) {
+	<-c
+}
+
+func main() {
+	c := make(chan int)
+	go blocked(c)
+	time.Sleep(10 * time.Millisecond)
+	runtime.GC()
+	time.Sleep(10 * time.Millisecond)
+	runtime.GC()
+
+	f, err := os.Create(os.Args[1])
+	if err != nil {
+		panic(err)
+	}
+	debug.WriteHeapDump(f.Fd())
+	f.Close()
+	close(c)
+}
@@ -0,0 +1,87 @@
+package heapdump
+
+import "sort"
+
+// Gives each OS thread the goroutine that's running on it, and what its
+// runtime.m says about it, if we know the layout of runtime.m. The
+// thread's descriptor address is the address of its runtime.m, which is
+// in the heap for every thread but the first (runtime.m0).
+func (d *Dump) linkThreads(records []Record, goroutines map[uint64]*Goroutine, p *DumpParams) {
+	threads := make(map[uint64]*OsThread)
+	for _, record := range records {
+		t, isThread := record.(*OsThread)
+		if !isThread {
+			continue
+		}
+		threads[t.ThreadDescriptorAddress] = t
+		t.Goroutine = nil
+		t.M = nil
+		// Objects with a malloc header are pointed to one word in.
+		if o := d.FindObject(t.ThreadDescriptorAddress); o != nil && t.ThreadDescriptorAddress-o.Address <= p.PointerSize {
+			t.M = o
+			if len(o.Name) == 0 {
+				o.Name = "runtime.m"
+				d.AddName(o.Address, o.Name)
+			}
+		}
+		m := func(field string) uint64 {
+			v, _ := d.readField(t.ThreadDescriptorAddress, "runtime.m", field, p)
+			return v
+		}
+		_, t.Described = d.readField(t.ThreadDescriptorAddress, "runtime.m", "curg", p)
+		t.LockedTo = m("lockedg")
+		t.CgoCalls = m("ncgocall")
+		t.InCgo = m("incgo") != 0
+		t.HasP = m("p") != 0
+	}
+	for _, g := range goroutines {
+		g.Thread = nil
+		if t, found := threads[g.OsThreadDescriptorAddress]; found && g.OsThreadDescriptorAddress != 0 {
+			g.Thread = t
+			t.Goroutine = g
+		}
+	}
+}
+
+// Reads a field of a runtime structure at the indicated address, which
+// may be in the heap or in a data segment. Reports false if we don't
+// know the structure's layout, or don't have its memory.
+func (d *Dump) readField(addr uint64, typeName string, field string, p *DumpParams) (uint64, bool) {
+	t := d.types.Lookup(typeName)
+	if t == nil {
+		return 0, false
+	}
+	for _, f := range t.Fields {
+		if f.Name != field || f.Type == nil || f.Type.Size == 0 || f.Type.Size > 8 {
+			continue
+		}
+		data := d.readMemory(addr+f.Offset, f.Type.Size)
+		if data == nil {
+			return 0, false
+		}
+		return readUint(&Object{Contents: data}, 0, f.Type.Size, p), true
+	}
+	return 0, false
+}
+
+// Returns the indicated bytes of the heap or of the data segments, or
+// nil if the dump doesn't have all of them.
+func (d *Dump) readMemory(addr uint64, size uint64) []byte {
+	if o := d.FindObject(addr); o != nil {
+		if addr+size <= o.Address+uint64(len(o.Contents)) {
+			return o.Contents[addr-o.Address:][:size]
+		}
+		return nil
+	}
+	i := sort.Search(len(d.segments), func(i int) bool {
+		return d.segments[i].GetAddress() > addr
+	}) - 1
+	if i < 0 {
+		return nil
+	}
+	seg := d.segments[i]
+	if addr+size > seg.GetAddress()+uint64(len(seg.GetContents())) {
+		return nil
+	}
+	return seg.GetContents()[addr-seg.GetAddress():][:size]
+}
@@ -0,0 +1,272 @@
+package program
+
+import (
+	"debug/dwarf"
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	"github.com/adamroach/heapspurs/pkg/gotype"
+)
+
+func (p *Program) DWARF() (*dwarf.Data, error) {
+	switch {
+	case p.elf != nil:
+		return p.elf.DWARF()
+	case p.macho != nil:
+		return p.macho.DWARF()
+	case p.pe != nil:
+		return p.pe.DWARF()
+	}
+	return nil, fmt.Errorf("No executable loaded")
+}
+
+func (p *Program) byteOrder() binary.ByteOrder {
+	switch {
+	case p.elf != nil:
+		return p.elf.ByteOrder
+	case p.macho != nil:
+		return p.macho.ByteOrder
+	}
+	return binary.LittleEndian
+}
+
+// Reads the layout of every named type, along with the type of every
+// global variable and where each function keeps its variables, from
+// the program's DWARF debugging information.
+func (p *Program) Types() (*gotype.Table, error) {
+	d, err := p.DWARF()
+	if err != nil {
+		return nil, fmt.Errorf("Reading DWARF: %w", err)
+	}
+
+	c := &dwarfConverter{
+		data:  d,
+		order: p.byteOrder(),
+		types: make(map[dwarf.Type]*gotype.Type),
+		table: gotype.NewTable(),
+		locs:  p.newLocationReader(),
+	}
+	r := d.Reader()
+	for {
+		e, err := r.Next()
+		if err != nil {
+			return nil, fmt.Errorf("Reading DWARF: %w", err)
+		}
+		if e == nil {
+			break
+		}
+		switch e.Tag {
+		case dwarf.TagCompileUnit:
+			c.locs.startUnit(e)
+		case dwarf.TagSubprogram:
+			c.addFunction(r, e)
+		case dwarf.TagVariable:
+			c.addGlobal(e)
+		case dwarf.TagTypedef, dwarf.TagStructType, dwarf.TagPointerType,
+			dwarf.TagArrayType, dwarf.TagBaseType:
+			t, err := d.Type(e.Offset)
+			if err == nil {
+				c.table.Add(c.convert(t))
+			}
+			r.SkipChildren()
+		}
+	}
+	c.table.Sort()
+	return c.table, nil
+}
+
+type dwarfConverter struct {
+	data  *dwarf.Data
+	order binary.ByteOrder
+	types map[dwarf.Type]*gotype.Type
+	table *gotype.Table
+	locs  *locationReader
+}
+
+// Reads a function's parameters and local variables, including those
+// of functions that have been inlined into it, since they share its
+// stack frame.
+func (c *dwarfConverter) addFunction(r *dwarf.Reader, e *dwarf.Entry) {
+	if !e.Children {
+		return
+	}
+	_, concrete := e.Val(dwarf.AttrLowpc).(uint64)
+	name, _ := c.attr(e, dwarf.AttrName).(string)
+	if !concrete || len(name) == 0 {
+		// An abstract function, which only describes what it looks
+		// like when it's inlined.
+		r.SkipChildren()
+		return
+	}
+	fn := &gotype.Function{Name: name, Entry: e.Val(dwarf.AttrLowpc).(uint64)}
+	base, _ := e.Val(dwarf.AttrFrameBase).([]byte)
+	frameBaseIsCFA := len(base) == 1 && base[0] == opCallFrameCFA
+
+	for depth := 1; depth > 0; {
+		child, err := r.Next()
+		if err != nil || child == nil {
+			break
+		}
+		if child.Tag == 0 {
+			depth--
+			continue
+		}
+		if child.Children {
+			depth++
+		}
+		if child.Tag != dwarf.TagVariable && child.Tag != dwarf.TagFormalParameter {
+			continue
+		}
+		field := child.AttrField(dwarf.AttrLocation)
+		if field == nil {
+			continue
+		}
+		// The parameters of inlined functions are just locals, as far
+		// as the frame is concerned.
+		v := gotype.LocalVariable{Param: child.Tag == dwarf.TagFormalParameter && depth == 1}
+		v.Name, _ = c.attr(child, dwarf.AttrName).(string)
+		if typeOffset, hasType := c.attr(child, dwarf.AttrType).(dwarf.Offset); hasType {
+			if t, err := c.data.Type(typeOffset); err == nil {
+				v.Type = c.convert(t)
+			}
+		}
+		v.Locations = c.locs.locations(field, frameBaseIsCFA)
+		if len(v.Name) > 0 && len(v.Locations) > 0 {
+			fn.Vars = append(fn.Vars, v)
+		}
+	}
+	c.table.AddFunction(fn)
+}
+
+// Returns an attribute of an entry, or of the abstract entry that it's
+// an instance of: names and types of inlined functions and variables
+// are only recorded once, on the abstract entry.
+func (c *dwarfConverter) attr(e *dwarf.Entry, attr dwarf.Attr) interface{} {
+	if v := e.Val(attr); v != nil {
+		return v
+	}
+	origin, hasOrigin := e.Val(dwarf.AttrAbstractOrigin).(dwarf.Offset)
+	if !hasOrigin {
+		return nil
+	}
+	r := c.data.Reader()
+	r.Seek(origin)
+	if abstract, err := r.Next(); err == nil && abstract != nil {
+		return abstract.Val(attr)
+	}
+	return nil
+}
+
+func (c *dwarfConverter) addGlobal(e *dwarf.Entry) {
+	name, _ := e.Val(dwarf.AttrName).(string)
+	loc, _ := e.Val(dwarf.AttrLocation).([]byte)
+	typeOffset, hasType := e.Val(dwarf.AttrType).(dwarf.Offset)
+	// Globals are located with a single DW_OP_addr, followed by the
+	// address in the target's byte order.
+	if len(name) == 0 || !hasType || len(loc) < 2 || loc[0] != 0x03 {
+		return
+	}
+	var address uint64
+	switch len(loc) - 1 {
+	case 8:
+		address = c.order.Uint64(loc[1:])
+	case 4:
+		address = uint64(c.order.Uint32(loc[1:]))
+	default:
+		return
+	}
+	t, err := c.data.Type(typeOffset)
+	if err != nil {
+		return
+	}
+	c.table.AddGlobal(gotype.Variable{Name: name, Address: address, Type: c.convert(t)})
+}
+
+// Converts a DWARF type into our own representation. Types are
+// memoized before their contents are filled in, so that recursive
+// types (e.g., linked list nodes) terminate.
+func (c *dwarfConverter) convert(dt dwarf.Type) *gotype.Type {
+	if t, found := c.types[dt]; found {
+		return t
+	}
+	t := &gotype.Type{Name: dt.Common().Name, Size: uint64(max(dt.Size(), 0))}
+	c.types[dt] = t
+
+	switch x := dt.(type) {
+	case *dwarf.TypedefType:
+		u := c.convert(x.Type)
+		switch {
+		case strings.HasPrefix(t.Name, "map["):
+			// Maps and channels are pointers to a runtime header.
+			t.Kind, t.Elem = gotype.Map, u.Elem
+		case strings.HasPrefix(t.Name, "chan ") || strings.HasPrefix(t.Name, "<-chan ") ||
+			strings.HasPrefix(t.Name, "chan<- "):
+			t.Kind, t.Elem = gotype.Chan, u.Elem
+		case strings.HasPrefix(t.Name, "func("):
+			t.Kind = gotype.Func
+		default:
+			t.Kind, t.Elem, t.Len, t.Fields = u.Kind, u.Elem, u.Len, u.Fields
+		}
+		t.Size = u.Size
+	case *dwarf.StructType:
+		t.Name = x.StructName
+		switch {
+		case t.Name == "string":
+			t.Kind = gotype.String
+			if len(x.Field) > 0 {
+				t.Elem = c.convert(x.Field[0].Type).Elem
+			}
+		case strings.HasPrefix(t.Name, "[]") && len(x.Field) > 0:
+			t.Kind = gotype.Slice
+			t.Elem = c.convert(x.Field[0].Type).Elem
+		default:
+			t.Kind = gotype.Struct
+			if t.Name == "runtime.iface" || t.Name == "runtime.eface" {
+				t.Kind = gotype.Interface
+			}
+			for _, f := range x.Field {
+				t.Fields = append(t.Fields, gotype.Field{
+					Name:   f.Name,
+					Offset: uint64(f.ByteOffset),
+					Type:   c.convert(f.Type),
+				})
+			}
+		}
+	case *dwarf.PtrType:
+		if _, isVoid := x.Type.(*dwarf.VoidType); isVoid || x.Type == nil || t.Name == "unsafe.Pointer" {
+			t.Kind = gotype.UnsafePointer
+			t.Name = "unsafe.Pointer"
+			break
+		}
+		t.Kind = gotype.Pointer
+		c.table.PtrSize = t.Size
+		t.Elem = c.convert(x.Type)
+		if len(t.Name) == 0 {
+			t.Name = "*" + t.Elem.Name
+		}
+	case *dwarf.ArrayType:
+		t.Kind = gotype.Array
+		t.Elem = c.convert(x.Type)
+		t.Len = uint64(max(x.Count, 0))
+		if len(t.Name) == 0 {
+			t.Name = fmt.Sprintf("[%d]%s", t.Len, t.Elem.Name)
+		}
+	case *dwarf.FuncType:
+		t.Kind = gotype.Func
+	case *dwarf.BoolType:
+		t.Kind = gotype.Bool
+	case *dwarf.IntType:
+		t.Kind = gotype.Int
+	case *dwarf.UintType, *dwarf.UcharType:
+		t.Kind = gotype.Uint
+		if t.Name == "uintptr" {
+			t.Kind = gotype.Uintptr
+		}
+	case *dwarf.FloatType:
+		t.Kind = gotype.Float
+	case *dwarf.ComplexType:
+		t.Kind = gotype.Complex
+	}
+	return t
+}
@@ -0,0 +1,44 @@
+package program
+
+import (
+	"debug/elf"
+	"errors"
+	"fmt"
+)
+
+func (p *Program) readElfSymbols() error {
+	syms, err := p.elf.Symbols()
+	if errors.Is(err, elf.ErrNoSymbols) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Reading ELF symbols: %w", err)
+	}
+	for _, s := range syms {
+		if elf.ST_TYPE(s.Info) == elf.STT_FILE || elf.ST_TYPE(s.Info) == elf.STT_SECTION {
+			continue
+		}
+		if s.Section == elf.SHN_UNDEF || s.Section >= elf.SectionIndex(len(p.elf.Sections)) {
+			continue
+		}
+		p.Symbols = append(p.Symbols, Symbol{
+			Name:    s.Name,
+			Address: s.Value,
+			Size:    s.Size,
+			Kind:    elfKind(p.elf.Sections[s.Section]),
+		})
+	}
+	return nil
+}
+
+func elfKind(s *elf.Section) rune {
+	switch {
+	case s.Flags&elf.SHF_EXECINSTR != 0:
+		return 'T'
+	case s.Type == elf.SHT_NOBITS:
+		return 'B'
+	case s.Flags&elf.SHF_WRITE != 0:
+		return 'D'
+	}
+	return 'R'
+}
@@ -0,0 +1,49 @@
+package program
+
+import (
+	"debug/gosym"
+	"fmt"
+)
+
+// Returns a table that maps the program's (link-time) code addresses to
+// functions, source files and line numbers, from the pclntab. This is
+// present even in stripped binaries.
+func (p *Program) LineTable() (*gosym.Table, error) {
+	addr, _, err := p.findPclntab()
+	if err != nil {
+		return nil, err
+	}
+	var data []byte
+	for _, s := range p.sections {
+		if addr >= s.addr && addr < s.addr+s.size {
+			contents, err := s.contents()
+			if err != nil {
+				return nil, err
+			}
+			data = contents[addr-s.addr:]
+			break
+		}
+	}
+
+	text, found := p.textStart()
+	if data == nil || !found {
+		return nil, fmt.Errorf("Could not find the program's text")
+	}
+	return gosym.NewTable(nil, gosym.NewLineTable(data, text))
+}
+
+// Function offsets in the pclntab are relative to runtime.text, which
+// is also where the text section starts.
+func (p *Program) textStart() (uint64, bool) {
+	for _, s := range p.Symbols {
+		if s.Name == "runtime.text" {
+			return s.Address, true
+		}
+	}
+	for _, name := range []string{".text", "__text"} {
+		if s := p.findSection(name); s != nil {
+			return s.addr, true
+		}
+	}
+	return 0, false
+}
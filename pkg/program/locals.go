@@ -0,0 +1,369 @@
+package program
+
+import (
+	"bytes"
+	"compress/zlib"
+	"debug/dwarf"
+	"debug/elf"
+	"debug/macho"
+	"debug/pe"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/adamroach/heapspurs/pkg/gotype"
+)
+
+// DWARF expression opcodes that we understand, at least well enough to
+// find variables that live on the stack.
+const (
+	opConsts       = 0x11
+	opPlus         = 0x22
+	opPlusUconst   = 0x23
+	opReg0         = 0x50
+	opBreg31       = 0x8f
+	opFbreg        = 0x91
+	opPiece        = 0x93
+	opCallFrameCFA = 0x9c
+)
+
+// Location list entry kinds, from DWARF 5.
+const (
+	lleEndOfList      = 0x00
+	lleBaseAddressx   = 0x01
+	lleStartxEndx     = 0x02
+	lleStartxLength   = 0x03
+	lleOffsetPair     = 0x04
+	lleDefaultLoc     = 0x05
+	lleBaseAddress    = 0x06
+	lleStartEnd       = 0x07
+	lleStartLength    = 0x08
+	locationListLimit = 1000 // entries in any one list, in case it's garbage
+)
+
+// Reads the locations of variables. Variables whose location changes
+// as the function runs (as most do, in optimized code) have a list of
+// locations, by PC range, that the debug/dwarf package doesn't decode.
+type locationReader struct {
+	order    binary.ByteOrder
+	addrSize int
+	loclists []byte // DWARF 5
+	loc      []byte // DWARF 4
+	addr     []byte // DWARF 5 address table
+	addrBase uint64 // for the current compilation unit (DWARF 5)
+	cuBase   uint64 // low PC of the current compilation unit
+	dwarf5   bool
+}
+
+func (p *Program) newLocationReader() *locationReader {
+	l := &locationReader{order: p.byteOrder(), addrSize: p.addressSize()}
+	l.loclists, _ = p.debugSection("loclists")
+	l.loc, _ = p.debugSection("loc")
+	l.addr, _ = p.debugSection("addr")
+	return l
+}
+
+func (l *locationReader) startUnit(e *dwarf.Entry) {
+	l.cuBase, _ = e.Val(dwarf.AttrLowpc).(uint64)
+	base, hasBase := e.Val(dwarf.AttrAddrBase).(int64)
+	l.addrBase, l.dwarf5 = uint64(base), hasBase
+}
+
+// A stretch of PCs over which a variable is described by the same
+// location expression.
+type locationRange struct {
+	low, high uint64
+	expr      []byte
+}
+
+// Returns the locations of a variable, from its DW_AT_location.
+func (l *locationReader) locations(field *dwarf.Field, frameBaseIsCFA bool) []gotype.Location {
+	var ranges []locationRange
+	switch field.Class {
+	case dwarf.ClassExprLoc:
+		expr, _ := field.Val.([]byte)
+		ranges = []locationRange{{expr: expr}}
+	case dwarf.ClassLocListPtr:
+		offset, _ := field.Val.(int64)
+		var err error
+		if l.dwarf5 || l.loc == nil {
+			ranges, err = l.readLocationList(uint64(offset))
+		} else {
+			ranges, err = l.readLegacyLocationList(uint64(offset))
+		}
+		if err != nil {
+			return nil
+		}
+	}
+	locations := make([]gotype.Location, 0)
+	for _, r := range ranges {
+		for _, loc := range stackLocations(r.expr, frameBaseIsCFA) {
+			loc.Low, loc.High = r.low, r.high
+			locations = append(locations, loc)
+		}
+	}
+	return locations
+}
+
+// Reads a DWARF 5 location list, from .debug_loclists.
+func (l *locationReader) readLocationList(offset uint64) ([]locationRange, error) {
+	buf := &dwarfBuf{data: l.loclists, pos: offset, order: l.order, addrSize: l.addrSize}
+	base := l.cuBase
+	ranges := make([]locationRange, 0)
+	for i := 0; i < locationListLimit; i++ {
+		kind := buf.uint8()
+		var low, high uint64
+		switch kind {
+		case lleEndOfList:
+			return ranges, buf.err
+		case lleBaseAddressx:
+			base = l.address(buf.uleb())
+			continue
+		case lleBaseAddress:
+			base = buf.address()
+			continue
+		case lleStartxEndx:
+			low, high = l.address(buf.uleb()), l.address(buf.uleb())
+		case lleStartxLength:
+			low = l.address(buf.uleb())
+			high = low + buf.uleb()
+		case lleOffsetPair:
+			low, high = base+buf.uleb(), base+buf.uleb()
+		case lleDefaultLoc:
+		case lleStartEnd:
+			low, high = buf.address(), buf.address()
+		case lleStartLength:
+			low = buf.address()
+			high = low + buf.uleb()
+		default:
+			return nil, fmt.Errorf("Unknown location list entry 0x%x", kind)
+		}
+		expr := buf.bytes(buf.uleb())
+		if buf.err != nil {
+			return nil, buf.err
+		}
+		ranges = append(ranges, locationRange{low, high, expr})
+	}
+	return nil, fmt.Errorf("Location list at 0x%x is too long", offset)
+}
+
+// Reads a DWARF 4 location list, from .debug_loc.
+func (l *locationReader) readLegacyLocationList(offset uint64) ([]locationRange, error) {
+	buf := &dwarfBuf{data: l.loc, pos: offset, order: l.order, addrSize: l.addrSize}
+	base := l.cuBase
+	maxAddress := ^uint64(0) >> (64 - 8*l.addrSize)
+	ranges := make([]locationRange, 0)
+	for i := 0; i < locationListLimit; i++ {
+		low, high := buf.address(), buf.address()
+		switch {
+		case buf.err != nil:
+			return nil, buf.err
+		case low == 0 && high == 0:
+			return ranges, nil
+		case low == maxAddress:
+			base = high
+			continue
+		}
+		expr := buf.bytes(uint64(buf.uint16()))
+		if buf.err != nil {
+			return nil, buf.err
+		}
+		ranges = append(ranges, locationRange{base + low, base + high, expr})
+	}
+	return nil, fmt.Errorf("Location list at 0x%x is too long", offset)
+}
+
+// Looks up an entry in the current compilation unit's address table.
+func (l *locationReader) address(index uint64) uint64 {
+	buf := &dwarfBuf{data: l.addr, pos: l.addrBase + index*uint64(l.addrSize), order: l.order, addrSize: l.addrSize}
+	return buf.address()
+}
+
+// Finds the pieces of a variable that a location expression puts on
+// the stack. Pieces in registers, and expressions that are more
+// complicated than an offset from the CFA, are left out.
+func stackLocations(expr []byte, frameBaseIsCFA bool) []gotype.Location {
+	buf := &dwarfBuf{data: expr}
+	locations := make([]gotype.Location, 0)
+	var offset, constant int64
+	onStack := false
+	piece := uint64(0)
+	for buf.pos < uint64(len(expr)) && buf.err == nil {
+		op := buf.uint8()
+		switch {
+		case op == opCallFrameCFA:
+			offset, onStack = 0, true
+		case op == opFbreg:
+			offset, onStack = buf.sleb(), frameBaseIsCFA
+		case op == opConsts:
+			constant = buf.sleb()
+		case op == opPlus:
+			offset += constant
+		case op == opPlusUconst:
+			offset += int64(buf.uleb())
+		case op >= opReg0 && op <= opBreg31:
+			// In (or relative to) a register.
+			onStack = false
+			if op > opReg0+31 {
+				buf.sleb()
+			}
+		case op == opPiece:
+			size := buf.uleb()
+			if onStack {
+				locations = append(locations, gotype.Location{Offset: offset, Piece: piece, Size: size})
+			}
+			piece += size
+			onStack = false
+		default:
+			return locations
+		}
+	}
+	if onStack && piece == 0 && buf.err == nil {
+		locations = append(locations, gotype.Location{Offset: offset})
+	}
+	return locations
+}
+
+// Reads the pieces of DWARF sections that debug/dwarf doesn't.
+type dwarfBuf struct {
+	data     []byte
+	pos      uint64
+	order    binary.ByteOrder
+	addrSize int
+	err      error
+}
+
+func (b *dwarfBuf) bytes(n uint64) []byte {
+	if b.err != nil || b.pos+n > uint64(len(b.data)) || b.pos+n < b.pos {
+		b.err = io.ErrUnexpectedEOF
+		return nil
+	}
+	out := b.data[b.pos : b.pos+n]
+	b.pos += n
+	return out
+}
+
+func (b *dwarfBuf) uint8() uint8 {
+	if data := b.bytes(1); data != nil {
+		return data[0]
+	}
+	return 0
+}
+
+func (b *dwarfBuf) uint16() uint16 {
+	if data := b.bytes(2); data != nil {
+		return b.order.Uint16(data)
+	}
+	return 0
+}
+
+func (b *dwarfBuf) address() uint64 {
+	data := b.bytes(uint64(b.addrSize))
+	switch {
+	case data == nil:
+		return 0
+	case b.addrSize == 4:
+		return uint64(b.order.Uint32(data))
+	}
+	return b.order.Uint64(data)
+}
+
+func (b *dwarfBuf) uleb() uint64 {
+	value, shift := uint64(0), 0
+	for {
+		c := b.uint8()
+		if b.err != nil {
+			return 0
+		}
+		if shift < 64 {
+			value |= uint64(c&0x7f) << shift
+		}
+		shift += 7
+		if c&0x80 == 0 {
+			return value
+		}
+	}
+}
+
+func (b *dwarfBuf) sleb() int64 {
+	value, shift := int64(0), 0
+	for {
+		c := b.uint8()
+		if b.err != nil {
+			return 0
+		}
+		if shift < 64 {
+			value |= int64(c&0x7f) << shift
+		}
+		shift += 7
+		if c&0x80 == 0 {
+			if shift < 64 && c&0x40 != 0 {
+				value |= -1 << shift
+			}
+			return value
+		}
+	}
+}
+
+// Returns the contents of a DWARF section (e.g. "loclists" for
+// .debug_loclists), decompressing it if need be.
+func (p *Program) debugSection(name string) ([]byte, error) {
+	var data []byte
+	var err error
+	switch {
+	case p.elf != nil:
+		if s := p.elf.Section(".debug_" + name); s != nil {
+			// debug/elf takes care of SHF_COMPRESSED.
+			return s.Data()
+		}
+	case p.macho != nil:
+		if s := p.macho.Section("__debug_" + name); s != nil {
+			return s.Data()
+		}
+		if s := p.macho.Section("__zdebug_" + name); s != nil {
+			data, err = s.Data()
+		}
+	case p.pe != nil:
+		if s := p.pe.Section(".debug_" + name); s != nil {
+			data, err = s.Data()
+			if err == nil && s.VirtualSize > 0 && uint32(len(data)) > s.VirtualSize {
+				data = data[:s.VirtualSize]
+			}
+			return data, err
+		}
+		if s := p.pe.Section(".zdebug_" + name); s != nil {
+			data, err = s.Data()
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if data == nil {
+		return nil, fmt.Errorf("No .debug_%s section", name)
+	}
+	// Older Go linkers compressed sections as "ZLIB", followed by the
+	// uncompressed size, followed by the zlib stream.
+	if len(data) < 12 || string(data[:4]) != "ZLIB" {
+		return nil, fmt.Errorf("Unrecognized compression in .zdebug_%s", name)
+	}
+	r, err := zlib.NewReader(bytes.NewReader(data[12:]))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+func (p *Program) addressSize() int {
+	switch {
+	case p.elf != nil && p.elf.Class == elf.ELFCLASS32:
+		return 4
+	case p.macho != nil && p.macho.Magic == macho.Magic32:
+		return 4
+	case p.pe != nil:
+		if _, is32 := p.pe.OptionalHeader.(*pe.OptionalHeader32); is32 {
+			return 4
+		}
+	}
+	return 8
+}
@@ -0,0 +1,340 @@
+package program
+
+import (
+	"encoding/binary"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/adamroach/heapspurs/pkg/gotype"
+)
+
+func TestStackLocations(t *testing.T) {
+	for _, test := range []struct {
+		name           string
+		expr           []byte
+		frameBaseIsCFA bool
+		want           []gotype.Location
+	}{
+		{"cfa", []byte{opCallFrameCFA}, false, []gotype.Location{{Offset: 0}}},
+		{"fbreg from cfa", []byte{opFbreg, 0x48}, true, []gotype.Location{{Offset: -56}}},
+		{"fbreg from something else", []byte{opFbreg, 0x48}, false, []gotype.Location{}},
+		{"plus_uconst", []byte{opCallFrameCFA, opPlusUconst, 0x10}, false, []gotype.Location{{Offset: 16}}},
+		{"consts plus", []byte{opCallFrameCFA, opConsts, 0x40, opPlus}, false, []gotype.Location{{Offset: -64}}},
+		{
+			"pieces",
+			[]byte{opCallFrameCFA, opPlusUconst, 0x08, opPiece, 0x08, opCallFrameCFA, opPlusUconst, 0x10, opPiece, 0x08},
+			false,
+			[]gotype.Location{{Offset: 8, Piece: 0, Size: 8}, {Offset: 16, Piece: 8, Size: 8}},
+		},
+		{
+			"register then stack",
+			[]byte{opReg0 + 3, opPiece, 0x08, opCallFrameCFA, opPlusUconst, 0x10, opPiece, 0x08},
+			false,
+			[]gotype.Location{{Offset: 16, Piece: 8, Size: 8}},
+		},
+		{
+			"stack then register",
+			[]byte{opFbreg, 0x40, opPiece, 0x04, opReg0, opPiece, 0x04},
+			true,
+			[]gotype.Location{{Offset: -64, Piece: 0, Size: 4}},
+		},
+		{"breg", []byte{opBreg31 - 24, 0x10}, false, []gotype.Location{}},
+		{"breg piece", []byte{opBreg31 - 24, 0x10, opPiece, 0x08}, false, []gotype.Location{}},
+		{"unknown op", []byte{0x03, 1, 2, 3, 4, 5, 6, 7, 8}, false, []gotype.Location{}},
+		{"unknown op after a piece", []byte{opCallFrameCFA, opPiece, 0x08, 0x03}, false, []gotype.Location{{Size: 8}}},
+		{"truncated", []byte{opFbreg}, true, []gotype.Location{}},
+		{"truncated leb", []byte{opFbreg, 0x80}, true, []gotype.Location{}},
+		{"empty", nil, true, []gotype.Location{}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if got := stackLocations(test.expr, test.frameBaseIsCFA); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("stackLocations(% x) = %v, want %v", test.expr, got, test.want)
+			}
+		})
+	}
+}
+
+func TestLeb128(t *testing.T) {
+	for _, test := range []struct {
+		data  []byte
+		uleb  uint64
+		sleb  int64
+		valid bool
+	}{
+		{[]byte{0x02}, 2, 2, true},
+		{[]byte{0x7f}, 127, -1, true},
+		{[]byte{0x80, 0x01}, 128, 128, true},
+		{[]byte{0x80, 0x7f}, 16256, -128, true},
+		{[]byte{0xe5, 0x8e, 0x26}, 624485, 624485, true},
+		{[]byte{0xc0, 0xbb, 0x78}, 1973696, -123456, true},
+		{[]byte{0x80}, 0, 0, false},
+		{nil, 0, 0, false},
+	} {
+		u := &dwarfBuf{data: test.data}
+		if got := u.uleb(); got != test.uleb || (u.err == nil) != test.valid {
+			t.Errorf("uleb(% x) = %d (error %v), want %d", test.data, got, u.err, test.uleb)
+		}
+		s := &dwarfBuf{data: test.data}
+		if got := s.sleb(); got != test.sleb || (s.err == nil) != test.valid {
+			t.Errorf("sleb(% x) = %d (error %v), want %d", test.data, got, s.err, test.sleb)
+		}
+	}
+}
+
+// Builds the bytes of a DWARF section by hand.
+type sectionBuilder struct {
+	order    binary.ByteOrder
+	addrSize int
+	data     []byte
+}
+
+func (b *sectionBuilder) bytes(data ...byte) *sectionBuilder {
+	b.data = append(b.data, data...)
+	return b
+}
+
+func (b *sectionBuilder) address(a uint64) *sectionBuilder {
+	data := make([]byte, 8)
+	if b.addrSize == 4 {
+		b.order.PutUint32(data, uint32(a))
+	} else {
+		b.order.PutUint64(data, a)
+	}
+	return b.bytes(data[:b.addrSize]...)
+}
+
+func (b *sectionBuilder) uint16(v uint16) *sectionBuilder {
+	data := make([]byte, 2)
+	b.order.PutUint16(data, v)
+	return b.bytes(data...)
+}
+
+func TestReadLocationList(t *testing.T) {
+	cfa := []byte{opCallFrameCFA}
+	fbreg := []byte{opFbreg, 0x48}
+
+	addr := &sectionBuilder{order: binary.LittleEndian, addrSize: 8}
+	addr.bytes(0xde, 0xad, 0xbe, 0xef) // unrelated bytes before the unit's table
+	addr.address(0x402000).address(0x402100).address(0x403000)
+
+	lists := &sectionBuilder{order: binary.LittleEndian, addrSize: 8}
+	lists.bytes(0xff, 0xff)
+	lists.bytes(lleOffsetPair, 0x10, 0x20, 1).bytes(cfa...)
+	lists.bytes(lleBaseAddressx, 1)
+	lists.bytes(lleOffsetPair, 0x00, 0x08, 2).bytes(fbreg...)
+	lists.bytes(lleBaseAddress).address(0x500000)
+	lists.bytes(lleOffsetPair, 0x04, 0x0c, 1).bytes(cfa...)
+	lists.bytes(lleStartxEndx, 0, 1, 1).bytes(cfa...)
+	lists.bytes(lleStartxLength, 2, 0x30, 1).bytes(cfa...)
+	lists.bytes(lleStartEnd).address(0x600000).address(0x600010).bytes(1).bytes(cfa...)
+	lists.bytes(lleStartLength).address(0x700000).bytes(0x80, 0x01, 2).bytes(fbreg...)
+	lists.bytes(lleDefaultLoc, 1).bytes(cfa...)
+	lists.bytes(lleEndOfList)
+	truncated := len(lists.data)
+	lists.bytes(lleStartEnd).address(0x600000)
+	unknown := len(lists.data)
+	lists.bytes(0x09, lleEndOfList)
+	unterminated := len(lists.data)
+	lists.bytes(lleOffsetPair, 0x00, 0x08, 1).bytes(cfa...)
+
+	l := &locationReader{
+		order:    binary.LittleEndian,
+		addrSize: 8,
+		loclists: lists.data,
+		addr:     addr.data,
+		addrBase: 4,
+		cuBase:   0x401000,
+		dwarf5:   true,
+	}
+	got, err := l.readLocationList(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []locationRange{
+		{0x401010, 0x401020, cfa},
+		{0x402100, 0x402108, fbreg},
+		{0x500004, 0x50000c, cfa},
+		{0x402000, 0x402100, cfa},
+		{0x403000, 0x403030, cfa},
+		{0x600000, 0x600010, cfa},
+		{0x700000, 0x700080, fbreg},
+		{0, 0, cfa},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("readLocationList = %v, want %v", got, want)
+	}
+
+	for _, offset := range []int{truncated, unknown, unterminated} {
+		if got, err := l.readLocationList(uint64(offset)); err == nil {
+			t.Errorf("readLocationList(%d) = %v, want an error", offset, got)
+		}
+	}
+}
+
+func TestReadLegacyLocationList(t *testing.T) {
+	cfa := []byte{opCallFrameCFA}
+	fbreg := []byte{opFbreg, 0x48}
+	for _, test := range []struct {
+		order    binary.ByteOrder
+		addrSize int
+	}{
+		{binary.LittleEndian, 8},
+		{binary.LittleEndian, 4},
+		{binary.BigEndian, 8},
+	} {
+		maxAddress := ^uint64(0) >> (64 - 8*test.addrSize)
+		loc := &sectionBuilder{order: test.order, addrSize: test.addrSize}
+		loc.bytes(0xff, 0xff, 0xff)
+		loc.address(0x10).address(0x20).uint16(1).bytes(cfa...)
+		loc.address(maxAddress).address(0x500000)
+		loc.address(0x04).address(0x0c).uint16(2).bytes(fbreg...)
+		loc.address(0).address(0)
+		truncated := len(loc.data)
+		loc.address(0x10).address(0x20).uint16(2).bytes(cfa...)
+
+		l := &locationReader{order: test.order, addrSize: test.addrSize, loc: loc.data, cuBase: 0x401000}
+		got, err := l.readLegacyLocationList(3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []locationRange{
+			{0x401010, 0x401020, cfa},
+			{0x500004, 0x50000c, fbreg},
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%v %d-byte readLegacyLocationList = %v, want %v", test.order, test.addrSize, got, want)
+		}
+		if got, err := l.readLegacyLocationList(uint64(truncated)); err == nil {
+			t.Errorf("%v %d-byte readLegacyLocationList(%d) = %v, want an error", test.order, test.addrSize, truncated, got)
+		}
+	}
+}
+
+// The distinct places on the stack where a variable lives, regardless
+// of PC.
+func distinctLocations(v gotype.LocalVariable) []gotype.Location {
+	seen := make(map[gotype.Location]bool)
+	locations := make([]gotype.Location, 0)
+	for _, loc := range v.Locations {
+		loc.Low, loc.High = 0, 0
+		if !seen[loc] {
+			seen[loc] = true
+			locations = append(locations, loc)
+		}
+	}
+	sort.Slice(locations, func(i, j int) bool { return locations[i].Piece < locations[j].Piece })
+	return locations
+}
+
+// Checks the locals of main.walk in the fixture. Where the parameters
+// are spilled is fixed by the calling convention; where the locals go
+// is up to the compiler, as long as it's in walk's own frame.
+func TestFixtureLocals(t *testing.T) {
+	for _, test := range []struct {
+		name        string
+		goarch      string
+		env         []string
+		section     string // the location list section the build should have
+		params      []string
+		paramPieces []gotype.Location // where label is
+		locals      []string
+	}{
+		{
+			name:        "amd64",
+			goarch:      "amd64",
+			section:     "loclists",
+			params:      []string{"label"},
+			paramPieces: []gotype.Location{{Offset: 8, Piece: 0, Size: 8}, {Offset: 16, Piece: 8, Size: 8}},
+			locals:      []string{"total", "p"},
+		},
+		{
+			name:        "amd64 dwarf4",
+			goarch:      "amd64",
+			env:         []string{"GOEXPERIMENT=nodwarf5"},
+			section:     "loc",
+			params:      []string{"label"},
+			paramPieces: []gotype.Location{{Offset: 8, Piece: 0, Size: 8}, {Offset: 16, Piece: 8, Size: 8}},
+			locals:      []string{"total", "p"},
+		},
+		{
+			name:        "386",
+			goarch:      "386",
+			section:     "loclists",
+			params:      []string{"f", "label", "~r0"},
+			paramPieces: []gotype.Location{{Offset: 4, Piece: 0, Size: 4}, {Offset: 8, Piece: 4, Size: 4}},
+			locals:      []string{"total", "p"},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			p := openFixture(t, buildFixture(t, test.goarch, "", test.env...))
+			if data, _ := p.debugSection(test.section); data == nil {
+				t.Skipf("The toolchain didn't write .debug_%s", test.section)
+			}
+			table, err := p.Types()
+			if err != nil {
+				t.Fatal(err)
+			}
+			walk := table.Function("main.walk")
+			if walk == nil {
+				t.Fatal("No variables for main.walk")
+			}
+			vars := make(map[string]gotype.LocalVariable)
+			for _, v := range walk.Vars {
+				vars[v.Name] = v
+				for _, loc := range v.Locations {
+					if loc.Low == 0 && loc.High == 0 {
+						continue
+					}
+					if loc.Low < walk.Entry || loc.High <= loc.Low {
+						t.Errorf("%s: location %+v isn't within main.walk (entry 0x%x)", v.Name, loc, walk.Entry)
+					}
+				}
+			}
+
+			for _, name := range test.params {
+				v, found := vars[name]
+				if !found || !v.Param || len(v.Locations) == 0 {
+					t.Errorf("%s: %+v, want a parameter with a stack location", name, v)
+				}
+			}
+			if got := distinctLocations(vars["label"]); !reflect.DeepEqual(got, test.paramPieces) {
+				t.Errorf("label is at %+v, want %+v", got, test.paramPieces)
+			}
+			if label := vars["label"]; label.Type == nil || label.Type.Name != "string" {
+				t.Errorf("label has type %v, want string", label.Type)
+			}
+			if test.goarch == "386" {
+				if got, want := distinctLocations(vars["f"]), []gotype.Location{{Offset: 0}}; !reflect.DeepEqual(got, want) {
+					t.Errorf("f is at %+v, want %+v", got, want)
+				}
+				if got, want := distinctLocations(vars["~r0"]), []gotype.Location{{Offset: 12}}; !reflect.DeepEqual(got, want) {
+					t.Errorf("~r0 is at %+v, want %+v", got, want)
+				}
+			}
+
+			offsets := make(map[int64]string)
+			for _, name := range test.locals {
+				v, found := vars[name]
+				if !found || v.Param {
+					t.Errorf("%s: %+v, want a local variable", name, v)
+					continue
+				}
+				inFrame := false
+				for _, loc := range distinctLocations(v) {
+					if loc.Offset >= 0 {
+						continue
+					}
+					inFrame = true
+					if other, found := offsets[loc.Offset]; found && other != name {
+						t.Errorf("%s and %s are both at %d", name, other, loc.Offset)
+					}
+					offsets[loc.Offset] = name
+				}
+				if !inFrame {
+					t.Errorf("%s is at %+v, want somewhere in main.walk's frame", name, v.Locations)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,41 @@
+package program
+
+import (
+	"debug/macho"
+)
+
+const machoStab = 0xe0 // N_STAB: debugging symbol
+
+func (p *Program) readMachOSymbols() error {
+	if p.macho.Symtab == nil {
+		return nil
+	}
+	var sections []sectionBounds
+	for _, s := range p.macho.Sections {
+		sections = append(sections, sectionBounds{s.Addr, s.Addr + s.Size})
+	}
+	for _, s := range p.macho.Symtab.Syms {
+		if s.Type&machoStab != 0 || s.Sect == 0 || int(s.Sect) > len(p.macho.Sections) {
+			continue
+		}
+		p.Symbols = append(p.Symbols, Symbol{
+			Name:    s.Name,
+			Address: s.Value,
+			Kind:    machoKind(p.macho.Sections[s.Sect-1]),
+		})
+	}
+	inferSizes(p.Symbols, sections)
+	return nil
+}
+
+func machoKind(s *macho.Section) rune {
+	switch s.Name {
+	case "__text":
+		return 'T'
+	case "__bss", "__noptrbss":
+		return 'B'
+	case "__data", "__noptrdata", "__go_buildinfo":
+		return 'D'
+	}
+	return 'R'
+}
@@ -0,0 +1,137 @@
+package program
+
+import (
+	"debug/elf"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// A loadable section of the executable, for reading the program's
+// static data by (link-time) address.
+type section struct {
+	name string
+	addr uint64
+	size uint64
+	r    io.ReaderAt
+	data []byte // read on first use
+}
+
+func (p *Program) readSections() {
+	switch {
+	case p.elf != nil:
+		for _, s := range p.elf.Sections {
+			if s.Flags&elf.SHF_ALLOC == 0 || s.Type == elf.SHT_NOBITS {
+				continue
+			}
+			p.sections = append(p.sections, &section{name: s.Name, addr: s.Addr, size: s.Size, r: s})
+		}
+	case p.macho != nil:
+		for _, s := range p.macho.Sections {
+			if s.Flags&0xff == 0x1 { // S_ZEROFILL
+				continue
+			}
+			p.sections = append(p.sections, &section{name: s.Name, addr: s.Addr, size: s.Size, r: s})
+		}
+	case p.pe != nil:
+		base := p.peImageBase()
+		for _, s := range p.pe.Sections {
+			size := uint64(min(s.VirtualSize, s.Size))
+			p.sections = append(p.sections, &section{name: s.Name, addr: base + uint64(s.VirtualAddress), size: size, r: s})
+		}
+	}
+}
+
+func (p *Program) findSection(name string) *section {
+	for _, s := range p.sections {
+		if s.name == name {
+			return s
+		}
+	}
+	return nil
+}
+
+func (s *section) contents() ([]byte, error) {
+	if s.data == nil {
+		s.data = make([]byte, s.size)
+		if _, err := s.r.ReadAt(s.data, 0); err != nil && err != io.EOF {
+			s.data = nil
+			return nil, err
+		}
+	}
+	return s.data, nil
+}
+
+// Reads the program's static data at a given link-time address.
+type memory struct {
+	sections []*section
+	order    binary.ByteOrder
+	ptrSize  uint64
+	reads    func(addr uint64, n uint64) // if set, told about every read (for making test fixtures)
+}
+
+func (m *memory) read(addr uint64, n uint64) ([]byte, error) {
+	for _, s := range m.sections {
+		if addr >= s.addr && addr+n <= s.addr+s.size {
+			data, err := s.contents()
+			if err != nil {
+				return nil, err
+			}
+			if m.reads != nil {
+				m.reads(addr, n)
+			}
+			return data[addr-s.addr : addr-s.addr+n], nil
+		}
+	}
+	return nil, fmt.Errorf("Address 0x%x is not in the program file", addr)
+}
+
+func (m *memory) readable(addr uint64) bool {
+	_, err := m.read(addr, 1)
+	return err == nil
+}
+
+func (m *memory) uint8(addr uint64) (uint8, error) {
+	b, err := m.read(addr, 1)
+	if err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+func (m *memory) uint16(addr uint64) (uint16, error) {
+	b, err := m.read(addr, 2)
+	if err != nil {
+		return 0, err
+	}
+	return m.order.Uint16(b), nil
+}
+
+func (m *memory) uint32(addr uint64) (uint32, error) {
+	b, err := m.read(addr, 4)
+	if err != nil {
+		return 0, err
+	}
+	return m.order.Uint32(b), nil
+}
+
+func (m *memory) word(addr uint64) (uint64, error) {
+	if m.ptrSize == 4 {
+		v, err := m.uint32(addr)
+		return uint64(v), err
+	}
+	b, err := m.read(addr, 8)
+	if err != nil {
+		return 0, err
+	}
+	return m.order.Uint64(b), nil
+}
+
+// Reads a slice header, returning its data pointer and length.
+func (m *memory) slice(addr uint64) (data uint64, length uint64, err error) {
+	if data, err = m.word(addr); err != nil {
+		return
+	}
+	length, err = m.word(addr + m.ptrSize)
+	return
+}
@@ -0,0 +1,306 @@
+package program
+
+// Locates the runtime's moduledata structure in an executable, even one
+// that has been stripped of its symbol table. The moduledata is what
+// the runtime uses to find its own type descriptors, so it's our way
+// into the type information of programs built without DWARF.
+
+import (
+	"bytes"
+	"debug/buildinfo"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// The position of the fields we care about in each version's
+// moduledata, counted in words. Slices take three words, and the
+// fields before `text` have been stable since Go 1.16.
+type moduledataLayout struct {
+	version     int // first Go 1.x release with this layout
+	types       int
+	etypes      int
+	typedesclen int // -1 if absent
+	itaboffset  int // -1 if absent
+	itabsize    int // -1 if absent
+	typelinks   int // -1 if absent
+	itablinks   int // -1 if absent
+
+	embeddedOffsets bool // struct field offsets are shifted left, with the low bit flagging embedding
+	mapTypeWords    uint64
+}
+
+const (
+	moduledataMinPC = 20
+	moduledataMaxPC = 21
+	moduledataText  = 22
+	moduledataEText = 23
+)
+
+// Newest first.
+var moduledataLayouts = []moduledataLayout{
+	// Typelinks are no longer listed; instead, the typelinked
+	// descriptors come first in the types section, followed by the
+	// rest of the types and then the itabs.
+	{version: 27, types: 37, typedesclen: 38, etypes: 39, itaboffset: 40, itabsize: 41,
+		typelinks: -1, itablinks: -1, mapTypeWords: 11},
+	// epclntab was added after gofunc.
+	{version: 26, types: 37, etypes: 38, typedesclen: -1, itaboffset: -1, itabsize: -1,
+		typelinks: 45, itablinks: 48},
+	// covctrs and ecovctrs were added after enoptrbss.
+	{version: 20, types: 37, etypes: 38, typedesclen: -1, itaboffset: -1, itabsize: -1,
+		typelinks: 44, itablinks: 47},
+	{version: 19, types: 35, etypes: 36, typedesclen: -1, itaboffset: -1, itabsize: -1,
+		typelinks: 42, itablinks: 45},
+	{version: 18, types: 35, etypes: 36, typedesclen: -1, itaboffset: -1, itabsize: -1,
+		typelinks: 42, itablinks: 45, embeddedOffsets: true},
+}
+
+type moduledata struct {
+	address uint64
+	layout  *moduledataLayout
+	types   uint64
+	etypes  uint64
+	roots   []uint64 // type descriptors to start from
+	itabs   []uint64 // itabs whose types we should also pick up
+}
+
+// The pcHeader magic numbers for each pclntab format we understand.
+var pclntabMagics = []uint32{
+	0xfffffff1, // Go 1.20 and later
+	0xfffffff0, // Go 1.18 and 1.19
+}
+
+func (p *Program) goVersion() int {
+	info, err := buildinfo.Read(p.file)
+	if err != nil {
+		return 0
+	}
+	v := strings.TrimPrefix(info.GoVersion, "go1.")
+	if i := strings.IndexAny(v, ".-rb "); i >= 0 {
+		v = v[:i]
+	}
+	minor, _ := strconv.Atoi(v)
+	return minor
+}
+
+// Finds the pclntab, which tells us the pointer size and is what the
+// moduledata's first word points to.
+func (p *Program) findPclntab() (uint64, *memory, error) {
+	m := &memory{sections: p.sections, order: p.byteOrder()}
+	candidates := make([]uint64, 0)
+	for _, name := range []string{".gopclntab", "__gopclntab"} {
+		if s := p.findSection(name); s != nil {
+			candidates = append(candidates, s.addr)
+		}
+	}
+	if len(candidates) == 0 {
+		// PE files (and stripped Mach-O files) don't name the section,
+		// so look for the header's magic number.
+		for _, s := range p.sections {
+			data, err := s.contents()
+			if err != nil {
+				continue
+			}
+			for _, magic := range pclntabMagics {
+				pattern := make([]byte, 4)
+				m.order.PutUint32(pattern, magic)
+				for i := 0; ; {
+					j := bytes.Index(data[i:], pattern)
+					if j < 0 {
+						break
+					}
+					if (i+j)%4 == 0 {
+						candidates = append(candidates, s.addr+uint64(i+j))
+					}
+					i += j + 1
+				}
+			}
+		}
+	}
+
+	for _, addr := range candidates {
+		header, err := m.read(addr, 8)
+		if err != nil {
+			continue
+		}
+		magic := m.order.Uint32(header)
+		known := false
+		for _, k := range pclntabMagics {
+			known = known || magic == k
+		}
+		minLC, ptrSize := header[6], header[7]
+		if known && header[4] == 0 && header[5] == 0 &&
+			(minLC == 1 || minLC == 2 || minLC == 4) && (ptrSize == 4 || ptrSize == 8) {
+			m.ptrSize = uint64(ptrSize)
+			return addr, m, nil
+		}
+	}
+	return 0, nil, fmt.Errorf("Could not find the pclntab (unsupported Go version?)")
+}
+
+func (p *Program) findModuledata() (*moduledata, *memory, error) {
+	pclntab, m, err := p.findPclntab()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	candidates := make([]uint64, 0)
+	for _, s := range p.Symbols {
+		if s.Name == "runtime.firstmoduledata" {
+			candidates = append(candidates, s.Address)
+		}
+	}
+	if len(candidates) == 0 {
+		pattern := make([]byte, m.ptrSize)
+		if m.ptrSize == 4 {
+			m.order.PutUint32(pattern, uint32(pclntab))
+		} else {
+			m.order.PutUint64(pattern, pclntab)
+		}
+		for _, s := range p.sections {
+			data, err := s.contents()
+			if err != nil {
+				continue
+			}
+			for i := 0; ; {
+				j := bytes.Index(data[i:], pattern)
+				if j < 0 {
+					break
+				}
+				if uint64(i+j)%m.ptrSize == 0 {
+					candidates = append(candidates, s.addr+uint64(i+j))
+				}
+				i += j + 1
+			}
+		}
+	}
+
+	md, err := findLayout(m, candidates, p.goVersion())
+	if err != nil {
+		return nil, nil, err
+	}
+	return md, m, nil
+}
+
+// Reads the moduledata at the first of the candidate addresses that
+// holds one, trying each layout that the indicated Go version (or any
+// version, if it's zero) might use.
+func findLayout(m *memory, candidates []uint64, version int) (*moduledata, error) {
+	layouts := make([]*moduledataLayout, 0)
+	for i := range moduledataLayouts {
+		if version == 0 || moduledataLayouts[i].version <= version {
+			layouts = append(layouts, &moduledataLayouts[i])
+		}
+	}
+	for _, addr := range candidates {
+		for _, layout := range layouts {
+			md, err := readModuledata(m, addr, layout)
+			if err == nil {
+				return md, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("Could not find the runtime's moduledata (unsupported Go version?)")
+}
+
+// Reads the moduledata at the indicated address, checking that its
+// contents make sense for the layout.
+func readModuledata(m *memory, addr uint64, layout *moduledataLayout) (*moduledata, error) {
+	field := func(index int) uint64 {
+		v, err := m.word(addr + uint64(index)*m.ptrSize)
+		if err != nil {
+			return 0
+		}
+		return v
+	}
+	bad := fmt.Errorf("Not a go1.%d moduledata", layout.version)
+
+	text, etext := field(moduledataText), field(moduledataEText)
+	minpc, maxpc := field(moduledataMinPC), field(moduledataMaxPC)
+	if text == 0 || text > minpc || minpc > maxpc || maxpc > etext {
+		return nil, bad
+	}
+	md := &moduledata{
+		address: addr,
+		layout:  layout,
+		types:   field(layout.types),
+		etypes:  field(layout.etypes),
+	}
+	if md.types >= md.etypes || !m.readable(md.types) {
+		return nil, bad
+	}
+	typesLen := md.etypes - md.types
+
+	if layout.typedesclen >= 0 {
+		typedesclen := field(layout.typedesclen)
+		itaboffset, itabsize := field(layout.itaboffset), field(layout.itabsize)
+		if typedesclen > typesLen || itaboffset > typesLen || itaboffset+itabsize > typesLen {
+			return nil, bad
+		}
+		// The runtime skips a word at the start of the types section
+		// (see runtime.moduleTypelinks), and so do we.
+		for td := md.types + m.ptrSize; td < md.types+typedesclen; {
+			td = alignUp(td, m.ptrSize)
+			size, err := descriptorSize(m, td, layout)
+			if err != nil {
+				break
+			}
+			md.roots = append(md.roots, td)
+			td += size
+		}
+		for itab := md.types + itaboffset; itab < md.types+itaboffset+itabsize; {
+			itab = alignUp(itab, m.ptrSize)
+			size, err := itabSize(m, itab)
+			if err != nil {
+				break
+			}
+			md.itabs = append(md.itabs, itab)
+			itab += size
+		}
+	}
+
+	if layout.typelinks >= 0 {
+		data, length := field(layout.typelinks), field(layout.typelinks+1)
+		if length == 0 || length != field(layout.typelinks+2) || !m.readable(data) {
+			return nil, bad
+		}
+		for i := uint64(0); i < length; i++ {
+			off, err := m.uint32(data + 4*i)
+			if err != nil || uint64(off) >= typesLen {
+				return nil, bad
+			}
+			md.roots = append(md.roots, md.types+uint64(off))
+		}
+		data, length = field(layout.itablinks), field(layout.itablinks+1)
+		if length != field(layout.itablinks+2) {
+			return nil, bad
+		}
+		for i := uint64(0); i < length; i++ {
+			itab, err := m.word(data + i*m.ptrSize)
+			if err != nil {
+				return nil, bad
+			}
+			md.itabs = append(md.itabs, itab)
+		}
+	}
+	return md, nil
+}
+
+func alignUp(n uint64, a uint64) uint64 {
+	return (n + a - 1) &^ (a - 1)
+}
+
+// The size of an itab: the interface and type pointers, the hash
+// (padded to a word), and one function pointer per method.
+func itabSize(m *memory, itab uint64) (uint64, error) {
+	inter, err := m.word(itab)
+	if err != nil {
+		return 0, err
+	}
+	_, methods, err := m.slice(inter + abiTypeSize(m) + m.ptrSize)
+	if err != nil {
+		return 0, err
+	}
+	return (3 + max(methods, 1)) * m.ptrSize, nil
+}
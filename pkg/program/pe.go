@@ -0,0 +1,49 @@
+package program
+
+import (
+	"debug/pe"
+)
+
+func (p *Program) readPESymbols() error {
+	imageBase := p.peImageBase()
+	var sections []sectionBounds
+	for _, s := range p.pe.Sections {
+		start := imageBase + uint64(s.VirtualAddress)
+		sections = append(sections, sectionBounds{start, start + uint64(s.VirtualSize)})
+	}
+	for _, s := range p.pe.Symbols {
+		if s.SectionNumber <= 0 || int(s.SectionNumber) > len(p.pe.Sections) {
+			continue
+		}
+		section := p.pe.Sections[s.SectionNumber-1]
+		p.Symbols = append(p.Symbols, Symbol{
+			Name:    s.Name,
+			Address: imageBase + uint64(section.VirtualAddress) + uint64(s.Value),
+			Kind:    peKind(section),
+		})
+	}
+	inferSizes(p.Symbols, sections)
+	return nil
+}
+
+func (p *Program) peImageBase() uint64 {
+	switch oh := p.pe.OptionalHeader.(type) {
+	case *pe.OptionalHeader32:
+		return uint64(oh.ImageBase)
+	case *pe.OptionalHeader64:
+		return oh.ImageBase
+	}
+	return 0
+}
+
+func peKind(s *pe.Section) rune {
+	switch {
+	case s.Characteristics&pe.IMAGE_SCN_CNT_CODE != 0:
+		return 'T'
+	case s.Characteristics&pe.IMAGE_SCN_CNT_UNINITIALIZED_DATA != 0:
+		return 'B'
+	case s.Characteristics&pe.IMAGE_SCN_MEM_WRITE != 0:
+		return 'D'
+	}
+	return 'R'
+}
@@ -0,0 +1,128 @@
+package program
+
+// Reads information out of the executable that produced a heap dump.
+// ELF, Mach-O, and PE executables are supported.
+
+import (
+	"debug/elf"
+	"debug/macho"
+	"debug/pe"
+	"fmt"
+	"os"
+	"sort"
+)
+
+type Program struct {
+	Symbols  []Symbol // Sorted by address
+	file     *os.File
+	sections []*section
+	elf      *elf.File
+	macho    *macho.File
+	pe       *pe.File
+}
+
+type Symbol struct {
+	Name    string
+	Address uint64 // link-time address
+	Size    uint64
+	Kind    rune // 'T' = text, 'R' = read-only data, 'D' = data, 'B' = bss
+}
+
+func (s *Symbol) String() string {
+	return fmt.Sprintf("0x%x %c %s (%d bytes)", s.Address, s.Kind, s.Name, s.Size)
+}
+
+func Open(path string) (*Program, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Program{file: f}
+	if p.elf, err = elf.NewFile(f); err == nil {
+		err = p.readElfSymbols()
+	} else if p.macho, err = macho.NewFile(f); err == nil {
+		err = p.readMachOSymbols()
+	} else if p.pe, err = pe.NewFile(f); err == nil {
+		err = p.readPESymbols()
+	} else {
+		err = fmt.Errorf("Unrecognized executable format")
+	}
+	if err != nil {
+		p.Close()
+		return nil, err
+	}
+	p.readSections()
+
+	sort.SliceStable(p.Symbols, func(i, j int) bool {
+		return p.Symbols[i].Address < p.Symbols[j].Address
+	})
+	return p, nil
+}
+
+func (p *Program) Close() error {
+	switch {
+	case p.elf != nil:
+		p.elf.Close()
+	case p.macho != nil:
+		p.macho.Close()
+	case p.pe != nil:
+		p.pe.Close()
+	}
+	return p.file.Close()
+}
+
+type sectionBounds struct {
+	start, end uint64
+}
+
+// Some formats (Mach-O, PE) don't record symbol sizes. For those, we
+// assume that each symbol extends up to the next symbol in the same
+// section -- which is the same thing `go tool nm -size` does.
+func inferSizes(symbols []Symbol, sections []sectionBounds) {
+	sort.SliceStable(symbols, func(i, j int) bool {
+		return symbols[i].Address < symbols[j].Address
+	})
+	for i := range symbols {
+		if symbols[i].Size != 0 || isMarker(symbols[i].Name) {
+			continue
+		}
+		end := uint64(0)
+		for _, s := range sections {
+			if symbols[i].Address >= s.start && symbols[i].Address < s.end {
+				end = s.end
+				break
+			}
+		}
+		for j := i + 1; j < len(symbols); j++ {
+			if symbols[j].Address > symbols[i].Address {
+				if symbols[j].Address < end {
+					end = symbols[j].Address
+				}
+				break
+			}
+		}
+		if end > symbols[i].Address {
+			symbols[i].Size = end - symbols[i].Address
+		}
+	}
+}
+
+// The linker emits zero-length symbols to mark the boundaries of each
+// section; these share their addresses with real symbols, and should
+// not be considered to contain them.
+func isMarker(name string) bool {
+	switch name {
+	case "runtime.text", "runtime.etext",
+		"runtime.rodata", "runtime.erodata",
+		"runtime.types", "runtime.etypes",
+		"runtime.noptrdata", "runtime.enoptrdata",
+		"runtime.data", "runtime.edata",
+		"runtime.bss", "runtime.ebss",
+		"runtime.noptrbss", "runtime.enoptrbss",
+		"runtime.covctrs", "runtime.ecovctrs",
+		"runtime.end":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,42 @@
+package program
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// Builds the program in testdata/fixture with the installed Go
+// toolchain, for the indicated architecture and with the indicated
+// linker flags and extra environment variables, and returns the
+// executable's path. Skips the test if there's no toolchain to build
+// it with.
+func buildFixture(t *testing.T, goarch string, ldflags string, env ...string) string {
+	t.Helper()
+	if testing.Short() {
+		t.Skip("Skipping fixture build in short mode")
+	}
+	goTool, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("No Go toolchain to build the fixture with")
+	}
+	out := filepath.Join(t.TempDir(), "fixture")
+	cmd := exec.Command(goTool, "build", "-trimpath", "-ldflags="+ldflags, "-o", out, ".")
+	cmd.Dir = filepath.Join("testdata", "fixture")
+	cmd.Env = append(os.Environ(), append([]string{"GOOS=linux", "GOARCH=" + goarch, "CGO_ENABLED=0", "GOFLAGS="}, env...)...)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("Building the fixture: %v\n%s", err, output)
+	}
+	return out
+}
+
+func openFixture(t *testing.T, path string) *Program {
+	t.Helper()
+	p, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open %s: %v", path, err)
+	}
+	t.Cleanup(func() { p.Close() })
+	return p
+}
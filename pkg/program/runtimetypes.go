@@ -0,0 +1,315 @@
+package program
+
+// Decodes the runtime's type descriptors (abi.Type, and the kind-specific
+// structures that extend it) into type layouts.
+
+import (
+	"fmt"
+
+	"github.com/adamroach/heapspurs/pkg/gotype"
+)
+
+// abi.Kind values
+const (
+	abiBool          = 1
+	abiInt           = 2
+	abiInt64         = 6
+	abiUint          = 7
+	abiUint64        = 11
+	abiUintptr       = 12
+	abiFloat32       = 13
+	abiFloat64       = 14
+	abiComplex64     = 15
+	abiComplex128    = 16
+	abiArray         = 17
+	abiChan          = 18
+	abiFunc          = 19
+	abiInterface     = 20
+	abiMap           = 21
+	abiPointer       = 22
+	abiSlice         = 23
+	abiString        = 24
+	abiStruct        = 25
+	abiUnsafePointer = 26
+
+	abiKindMask   = 1<<5 - 1
+	abiKindGCProg = 1 << 6 // before Go 1.24
+
+	abiTFlagUncommon       = 1 << 0
+	abiTFlagExtraStar      = 1 << 1
+	abiTFlagGCMaskOnDemand = 1 << 4 // Go 1.24 and later
+	abiUncommonTypeSize    = 16
+	abiMethodSize          = 16
+	abiImethodSize         = 8
+)
+
+// The size of abi.Type: four words (Size_, PtrBytes, Equal, GCData)
+// plus sixteen bytes of smaller fields.
+func abiTypeSize(m *memory) uint64 {
+	return 4*m.ptrSize + 16
+}
+
+// Mirrors abi.Type.DescriptorSize: the kind-specific structure,
+// followed by the uncommon type (if any), the variable-length data
+// for the kind, and the methods.
+func descriptorSize(m *memory, addr uint64, layout *moduledataLayout) (uint64, error) {
+	t := abiTypeSize(m)
+	tflag, err := m.uint8(addr + 2*m.ptrSize + 4)
+	if err != nil {
+		return 0, err
+	}
+	kind, err := m.uint8(addr + 2*m.ptrSize + 7)
+	if err != nil {
+		return 0, err
+	}
+
+	var base, add uint64
+	switch kind & abiKindMask {
+	case abiArray:
+		base = t + 3*m.ptrSize
+	case abiChan:
+		base = t + 2*m.ptrSize
+	case abiFunc:
+		base = t + m.ptrSize
+		in, err := m.uint16(addr + t)
+		if err != nil {
+			return 0, err
+		}
+		out, err := m.uint16(addr + t + 2)
+		if err != nil {
+			return 0, err
+		}
+		add = uint64(in+out&(1<<15-1)) * m.ptrSize
+	case abiInterface:
+		base = t + 4*m.ptrSize
+		_, methods, err := m.slice(addr + t + m.ptrSize)
+		if err != nil {
+			return 0, err
+		}
+		add = methods * abiImethodSize
+	case abiMap:
+		base = t + layout.mapTypeWords*m.ptrSize
+	case abiPointer, abiSlice:
+		base = t + m.ptrSize
+	case abiStruct:
+		base = t + 4*m.ptrSize
+		_, fields, err := m.slice(addr + t + m.ptrSize)
+		if err != nil {
+			return 0, err
+		}
+		add = fields * 3 * m.ptrSize
+	default:
+		if kind&abiKindMask == 0 || kind&abiKindMask > abiUnsafePointer {
+			return 0, fmt.Errorf("Invalid type descriptor at 0x%x", addr)
+		}
+		base = t
+	}
+
+	size := base + add
+	if tflag&abiTFlagUncommon != 0 {
+		mcount, err := m.uint16(addr + base + 4)
+		if err != nil {
+			return 0, err
+		}
+		size += abiUncommonTypeSize + uint64(mcount)*abiMethodSize
+	}
+	return size, nil
+}
+
+// Reads the type layouts from the runtime type descriptors embedded in
+// the program. This works even for stripped binaries, but only knows
+// about types that the runtime does: named types, types that can be
+// built by reflection, and the types that they refer to.
+func (p *Program) RuntimeTypes() (*gotype.Table, error) {
+	md, m, err := p.findModuledata()
+	if err != nil {
+		return nil, err
+	}
+	return readRuntimeTypes(md, m)
+}
+
+func readRuntimeTypes(md *moduledata, m *memory) (*gotype.Table, error) {
+	r := &runtimeTypeReader{
+		mem:   m,
+		md:    md,
+		types: make(map[uint64]*gotype.Type),
+		table: gotype.NewTable(),
+	}
+	r.table.PtrSize = m.ptrSize
+	for _, addr := range md.roots {
+		r.convert(addr)
+	}
+	for _, itab := range md.itabs {
+		if typ, err := m.word(itab + m.ptrSize); err == nil && typ != 0 {
+			r.convert(typ)
+		}
+	}
+	if r.table.Len() == 0 {
+		return nil, fmt.Errorf("No runtime types found")
+	}
+	r.table.Descriptors = r.types
+	return r.table, nil
+}
+
+type runtimeTypeReader struct {
+	mem   *memory
+	md    *moduledata
+	types map[uint64]*gotype.Type
+	table *gotype.Table
+}
+
+// Reads a name (abi.Name): a flag byte, then a varint length, then the
+// bytes of the name.
+func (r *runtimeTypeReader) name(addr uint64) string {
+	length, shift := uint64(0), 0
+	p := addr + 1
+	for {
+		b, err := r.mem.uint8(p)
+		if err != nil {
+			return ""
+		}
+		p++
+		length |= uint64(b&0x7f) << shift
+		shift += 7
+		if b&0x80 == 0 || shift > 28 {
+			break
+		}
+	}
+	data, err := r.mem.read(p, length)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+// Converts the type descriptor at the indicated address, along with
+// everything it refers to. Like the DWARF reader, types are memoized
+// before their contents are filled in, so that recursion terminates.
+func (r *runtimeTypeReader) convert(addr uint64) *gotype.Type {
+	if t, found := r.types[addr]; found {
+		return t
+	}
+	m := r.mem
+	t := &gotype.Type{Name: "?"}
+	r.types[addr] = t
+
+	header, err := m.read(addr, abiTypeSize(m))
+	if err != nil {
+		return t
+	}
+	word := func(off uint64) uint64 {
+		if m.ptrSize == 4 {
+			return uint64(m.order.Uint32(header[off:]))
+		}
+		return m.order.Uint64(header[off:])
+	}
+	t.Size = word(0)
+	ptrBytes := word(m.ptrSize)
+	tflag := header[2*m.ptrSize+4]
+	kind := header[2*m.ptrSize+7]
+	gcdata := word(3*m.ptrSize + 8)
+	str := m.order.Uint32(header[4*m.ptrSize+8:])
+	ptrToThis := m.order.Uint32(header[4*m.ptrSize+12:])
+
+	t.Name = r.name(r.md.types + uint64(str))
+	if tflag&abiTFlagExtraStar != 0 && len(t.Name) > 0 {
+		t.Name = t.Name[1:]
+	}
+
+	// Large types may describe their pointers with a GC program (older
+	// runtimes), or have their bitmap built on demand (newer ones); we
+	// fall back to the type's structure for those.
+	if ptrBytes > 0 && kind&abiKindGCProg == 0 && tflag&abiTFlagGCMaskOnDemand == 0 {
+		words := ptrBytes / m.ptrSize
+		if mask, err := m.read(gcdata, (words+7)/8); err == nil {
+			t.Bitmap = append([]byte(nil), mask...)
+			if words%8 != 0 {
+				t.Bitmap[len(t.Bitmap)-1] &= 1<<(words%8) - 1
+			}
+		}
+	}
+
+	extra := addr + abiTypeSize(m)
+	switch k := kind & abiKindMask; {
+	case k == abiBool:
+		t.Kind = gotype.Bool
+	case k >= abiInt && k <= abiInt64:
+		t.Kind = gotype.Int
+	case k >= abiUint && k <= abiUint64:
+		t.Kind = gotype.Uint
+	case k == abiUintptr:
+		t.Kind = gotype.Uintptr
+	case k == abiFloat32 || k == abiFloat64:
+		t.Kind = gotype.Float
+	case k == abiComplex64 || k == abiComplex128:
+		t.Kind = gotype.Complex
+	case k == abiString:
+		t.Kind = gotype.String
+	case k == abiUnsafePointer:
+		t.Kind = gotype.UnsafePointer
+	case k == abiFunc:
+		t.Kind = gotype.Func
+	case k == abiMap:
+		t.Kind = gotype.Map
+	case k == abiChan:
+		t.Kind = gotype.Chan
+	case k == abiPointer || k == abiSlice:
+		t.Kind = gotype.Pointer
+		if k == abiSlice {
+			t.Kind = gotype.Slice
+		}
+		if elem, err := m.word(extra); err == nil && elem != 0 {
+			t.Elem = r.convert(elem)
+		}
+		if t.Elem == nil {
+			t.Kind = gotype.UnsafePointer
+		}
+	case k == abiArray:
+		t.Kind = gotype.Array
+		elem, err := m.word(extra)
+		if err == nil && elem != 0 {
+			t.Elem = r.convert(elem)
+		} else {
+			t.Elem = &gotype.Type{Name: "?"}
+		}
+		t.Len, _ = m.word(extra + 2*m.ptrSize)
+	case k == abiInterface:
+		t.Kind = gotype.Interface
+		_, methods, _ := m.slice(extra + m.ptrSize)
+		first := "tab"
+		if methods == 0 {
+			first = "_type"
+		}
+		word := &gotype.Type{Name: "unsafe.Pointer", Kind: gotype.UnsafePointer, Size: m.ptrSize}
+		t.Fields = []gotype.Field{{Name: first, Type: word}, {Name: "data", Offset: m.ptrSize, Type: word}}
+	case k == abiStruct:
+		t.Kind = gotype.Struct
+		data, length, err := m.slice(extra + m.ptrSize)
+		if err != nil {
+			break
+		}
+		for i := uint64(0); i < length; i++ {
+			f := data + i*3*m.ptrSize
+			namePtr, err1 := m.word(f)
+			typ, err2 := m.word(f + m.ptrSize)
+			offset, err3 := m.word(f + 2*m.ptrSize)
+			if err1 != nil || err2 != nil || err3 != nil || typ == 0 {
+				break
+			}
+			if r.md.layout.embeddedOffsets {
+				offset >>= 1
+			}
+			t.Fields = append(t.Fields, gotype.Field{
+				Name:   r.name(namePtr),
+				Offset: offset,
+				Type:   r.convert(typ),
+			})
+		}
+	}
+
+	r.table.Add(t)
+	if ptrToThis != 0 {
+		r.convert(r.md.types + uint64(ptrToThis))
+	}
+	return t
+}
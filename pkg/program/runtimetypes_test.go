@@ -0,0 +1,294 @@
+package program
+
+import (
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/gob"
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/adamroach/heapspurs/pkg/gotype"
+)
+
+var update = flag.Bool("update", false, "rebuild the memory images in testdata, using the toolchains they're named after")
+
+// Memory images of the fixture, built with the first release of each of
+// the two newest moduledata layouts. When a Go release changes the
+// layout, add an image built with it (and run the tests with -update).
+var images = []struct {
+	file      string
+	toolchain string
+	layout    int
+}{
+	{"go1.26.0.mem.gz", "go1.26.0", 26},
+	{"go1.27.1.mem.gz", "go1.27.1", 27},
+}
+
+// A sparse copy of a program's static data: just the parts of it that
+// reading the runtime's type descriptors touches.
+type memoryImage struct {
+	Version    int
+	PtrSize    uint64
+	BigEndian  bool
+	Moduledata uint64
+	Ranges     []memoryRange
+}
+
+type memoryRange struct {
+	Address uint64
+	Data    []byte
+}
+
+func (img *memoryImage) memory() *memory {
+	m := &memory{order: binary.LittleEndian, ptrSize: img.PtrSize}
+	if img.BigEndian {
+		m.order = binary.BigEndian
+	}
+	for _, r := range img.Ranges {
+		m.sections = append(m.sections, &section{name: "image", addr: r.Address, size: uint64(len(r.Data)), data: r.Data})
+	}
+	return m
+}
+
+// Reads the runtime types of the indicated program, keeping track of
+// every byte that's read, and writes those bytes out as an image.
+func writeImage(t *testing.T, program string, image string) {
+	p := openFixture(t, program)
+	md, m, err := p.findModuledata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	type read struct{ addr, n uint64 }
+	reads := make([]read, 0)
+	m.reads = func(addr uint64, n uint64) {
+		reads = append(reads, read{addr, n})
+	}
+	// Trying the layouts without knowing the version reads a little
+	// more, since the newer layouts have to be ruled out first.
+	for _, version := range []int{p.goVersion(), 0} {
+		md, err := findLayout(m, []uint64{md.address}, version)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := readRuntimeTypes(md, m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m.reads = nil
+
+	sort.Slice(reads, func(i, j int) bool {
+		return reads[i].addr < reads[j].addr
+	})
+	img := &memoryImage{
+		Version:    p.goVersion(),
+		PtrSize:    m.ptrSize,
+		BigEndian:  m.order == binary.BigEndian,
+		Moduledata: md.address,
+	}
+	for i := 0; i < len(reads); {
+		start, end := reads[i].addr, reads[i].addr+reads[i].n
+		j := i + 1
+		for ; j < len(reads) && reads[j].addr <= end; j++ {
+			end = max(end, reads[j].addr+reads[j].n)
+		}
+		data := make([]byte, end-start)
+		for _, r := range reads[i:j] {
+			b, _ := m.read(r.addr, r.n)
+			copy(data[r.addr-start:], b)
+		}
+		img.Ranges = append(img.Ranges, memoryRange{start, data})
+		i = j
+	}
+
+	f, err := os.Create(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	z := gzip.NewWriter(f)
+	if err := gob.NewEncoder(z).Encode(img); err != nil {
+		t.Fatal(err)
+	}
+	if err := z.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readImage(t *testing.T, image string) *memoryImage {
+	f, err := os.Open(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	z, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img := &memoryImage{}
+	if err := gob.NewDecoder(z).Decode(img); err != nil {
+		t.Fatal(err)
+	}
+	return img
+}
+
+type fieldLayout struct {
+	name   string
+	offset uint64
+	typ    string
+}
+
+// The layout of main.fixture, for 64-bit and 32-bit architectures.
+var fixtureLayouts = map[uint64]struct {
+	size     uint64
+	fields   []fieldLayout
+	pointers []uint64
+}{
+	8: {
+		size: 112,
+		fields: []fieldLayout{
+			{"flag", 0, "bool"},
+			{"ptr", 8, "*int"},
+			{"name", 16, "string"},
+			{"data", 32, "[]uint8"},
+			{"table", 56, "map[string]int"},
+			{"value", 64, "interface {}"},
+			{"words", 80, "[3]uintptr"},
+			{"next", 104, "*main.fixture"},
+		},
+		// The runtime doesn't count an empty interface's type word as a
+		// pointer, since type descriptors aren't in the heap.
+		pointers: []uint64{8, 16, 32, 56, 72, 104},
+	},
+	4: {
+		size: 56,
+		fields: []fieldLayout{
+			{"flag", 0, "bool"},
+			{"ptr", 4, "*int"},
+			{"name", 8, "string"},
+			{"data", 16, "[]uint8"},
+			{"table", 28, "map[string]int"},
+			{"value", 32, "interface {}"},
+			{"words", 40, "[3]uintptr"},
+			{"next", 52, "*main.fixture"},
+		},
+		pointers: []uint64{4, 8, 16, 28, 36, 52},
+	},
+}
+
+func fieldsOf(typ *gotype.Type) []fieldLayout {
+	fields := make([]fieldLayout, 0)
+	for _, f := range typ.Fields {
+		name := ""
+		if f.Type != nil {
+			name = f.Type.Name
+		}
+		fields = append(fields, fieldLayout{f.Name, f.Offset, name})
+	}
+	return fields
+}
+
+// Checks the layout of main.fixture, and of a few of the types it
+// refers to, as read from the runtime's type descriptors.
+func checkFixtureTypes(t *testing.T, table *gotype.Table, ptrSize uint64) {
+	t.Helper()
+	want := fixtureLayouts[ptrSize]
+	typ := table.Lookup("main.fixture")
+	if typ == nil {
+		t.Fatalf("main.fixture not found")
+	}
+	if typ.Kind != gotype.Struct || typ.Size != want.size {
+		t.Errorf("main.fixture is a %s of %d bytes, want a struct of %d bytes", typ.Kind, typ.Size, want.size)
+	}
+	if got := fieldsOf(typ); !reflect.DeepEqual(got, want.fields) {
+		t.Errorf("main.fixture fields = %v, want %v", got, want.fields)
+	}
+	if got := typ.PointerOffsets(ptrSize); !reflect.DeepEqual(got, want.pointers) {
+		t.Errorf("main.fixture pointers = %v, want %v", got, want.pointers)
+	}
+	for name, kind := range map[string]gotype.Kind{
+		"*main.fixture":  gotype.Pointer,
+		"[]uint8":        gotype.Slice,
+		"map[string]int": gotype.Map,
+		"[3]uintptr":     gotype.Array,
+		"interface {}":   gotype.Interface,
+	} {
+		if typ := table.Lookup(name); typ == nil || typ.Kind != kind {
+			t.Errorf("%s = %v, want a %s", name, typ, kind)
+		}
+	}
+	if ptr := table.Lookup("*main.fixture"); ptr != nil && ptr.Elem != typ {
+		t.Errorf("*main.fixture points to %v, want main.fixture", ptr.Elem)
+	}
+}
+
+func TestRuntimeTypes(t *testing.T) {
+	for _, image := range images {
+		t.Run(image.toolchain, func(t *testing.T) {
+			path := filepath.Join("testdata", image.file)
+			if *update {
+				writeImage(t, buildFixture(t, "amd64", "", "GOTOOLCHAIN="+image.toolchain), path)
+			}
+			img := readImage(t, path)
+			// The layout should be found whether or not we know which
+			// version of Go built the program.
+			for _, version := range []int{img.Version, 0} {
+				m := img.memory()
+				md, err := findLayout(m, []uint64{img.Moduledata}, version)
+				if err != nil {
+					t.Fatalf("go1.%d: %v", version, err)
+				}
+				if md.layout.version != image.layout {
+					t.Errorf("go1.%d: found the go1.%d layout, want go1.%d", version, md.layout.version, image.layout)
+				}
+				table, err := readRuntimeTypes(md, m)
+				if err != nil {
+					t.Fatalf("go1.%d: %v", version, err)
+				}
+				checkFixtureTypes(t, table, img.PtrSize)
+			}
+		})
+	}
+}
+
+// Checks the runtime types of the fixture as built by the installed
+// toolchain, stripped and not, against its DWARF.
+func TestRuntimeTypesOfFixture(t *testing.T) {
+	for _, test := range []struct {
+		goarch  string
+		ptrSize uint64
+	}{
+		{"amd64", 8},
+		{"386", 4},
+	} {
+		t.Run(test.goarch, func(t *testing.T) {
+			p := openFixture(t, buildFixture(t, test.goarch, ""))
+			table, err := p.RuntimeTypes()
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkFixtureTypes(t, table, test.ptrSize)
+
+			dwarfTable, err := p.Types()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := fieldsOf(dwarfTable.Lookup("main.fixture")), fixtureLayouts[test.ptrSize].fields; !reflect.DeepEqual(got, want) {
+				t.Errorf("main.fixture fields from DWARF = %v, want %v", got, want)
+			}
+
+			stripped := openFixture(t, buildFixture(t, test.goarch, "-s -w"))
+			if _, err := stripped.Types(); err == nil {
+				t.Errorf("Stripped fixture still has DWARF")
+			}
+			table, err = stripped.RuntimeTypes()
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkFixtureTypes(t, table, test.ptrSize)
+		})
+	}
+}
@@ -0,0 +1,39 @@
+// A small program for the tests to read the types and variables of.
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+type fixture struct {
+	flag  bool
+	ptr   *int
+	name  string
+	data  []byte
+	table map[string]int
+	value any
+	words [3]uintptr
+	next  *fixture
+}
+
+var sink any
+
+// p has to live on the stack across the call to Fprintln, and so does
+// label, once it's been spilled.
+//
+//go:noinline
+func walk(f *fixture, label string) int {
+	total := len(label)
+	for p := f; p != nil; p = p.next {
+		fmt.Fprintln(os.Stderr, label, p.name)
+		total += len(p.name)
+	}
+	return total
+}
+
+func main() {
+	f := &fixture{name: "first", next: &fixture{name: "second"}}
+	sink = f
+	sink = walk(f, "fixture")
+}
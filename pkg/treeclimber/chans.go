@@ -0,0 +1,159 @@
+package treeclimber
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/adamroach/heapspurs/pkg/heapdump"
+)
+
+// How many objects we'll look through before deciding that a channel is
+// referenced by something other than the goroutines blocked on it.
+const chanLeakSearchLimit = 10000
+
+// Lists every channel, along with its buffer and the goroutines that are
+// blocked on it, busiest first. Goroutines that are blocked on channels
+// that nothing else can reach will never wake up, so they're listed
+// again at the end.
+func (c *TreeClimber) PrintChannels() error {
+	chans := make([]*heapdump.ChanInfo, 0)
+	for _, o := range c.objects {
+		if o.Chan != nil && o.Chan.Header == o {
+			chans = append(chans, o.Chan)
+		}
+	}
+	if len(chans) == 0 {
+		fmt.Printf("No channels found\n")
+		return nil
+	}
+	sort.SliceStable(chans, func(i, j int) bool {
+		if len(chans[i].Waiters) != len(chans[j].Waiters) {
+			return len(chans[i].Waiters) > len(chans[j].Waiters)
+		}
+		return chans[i].Bytes > chans[j].Bytes
+	})
+
+	type leak struct {
+		waiter heapdump.ChanWaiter
+		ch     *heapdump.ChanInfo
+	}
+	leaked := make([]leak, 0)
+	fmt.Printf("%12s %10s %10s %10s  %s\n", "Buffer", "Capacity", "Buffered", "Waiting", "Channel")
+	for _, ch := range chans {
+		s := fmt.Sprintf("%s @ 0x%x", ch.Name, ch.Header.Address)
+		if ch.Closed {
+			s += " (closed)"
+		}
+		if ch.Timer {
+			s += " (timer)"
+		}
+		isLeaked := c.chanLeaked(ch)
+		if isLeaked {
+			s += " (only referenced by its waiters)"
+		}
+		fmt.Printf("%12s %10d %10d %10d  %s\n", unitize(ch.Bytes), ch.Capacity, ch.Count, len(ch.Waiters), s)
+
+		waiters := append([]heapdump.ChanWaiter{}, ch.Waiters...)
+		sort.SliceStable(waiters, func(i, j int) bool {
+			return waiters[i].Goroutine.RoutineId < waiters[j].Goroutine.RoutineId
+		})
+		for _, w := range waiters {
+			fmt.Printf("%47s%-8s %s\n", "", w.Direction, goroutineLabel(w.Goroutine))
+			if isLeaked {
+				leaked = append(leaked, leak{w, ch})
+			}
+		}
+	}
+
+	if len(leaked) > 0 {
+		fmt.Printf("\nGoroutines blocked on channels that nothing else references:\n")
+		for _, l := range leaked {
+			fmt.Printf("  %s, on %s @ 0x%x\n", goroutineLabel(l.waiter.Goroutine), l.ch.Name, l.ch.Header.Address)
+		}
+	}
+	return nil
+}
+
+// Describes a goroutine by its ID, why it's waiting, and the function
+// it's in (skipping over the runtime).
+func goroutineLabel(g *heapdump.Goroutine) string {
+	s := fmt.Sprintf("Goroutine[%d]", g.RoutineId)
+	if g.Status == heapdump.Waiting {
+		s += fmt.Sprintf(" (%s)", g.WaitReason)
+	}
+	if f := topFunction(g); len(f) > 0 {
+		s += " in " + f
+	}
+	return s
+}
+
+// Returns the function at the top of a goroutine's stack, skipping over
+// the runtime.
+func topFunction(g *heapdump.Goroutine) string {
+	for _, frame := range g.Frames {
+		if !strings.HasPrefix(frame.Name, "runtime.") {
+			return frame.Name
+		}
+	}
+	if len(g.Frames) > 0 {
+		return g.Frames[0].Name
+	}
+	return ""
+}
+
+// Reports whether the only things that can reach a channel are the
+// goroutines that are blocked on it, in which case nothing can ever
+// wake them up.
+func (c *TreeClimber) chanLeaked(ch *heapdump.ChanInfo) bool {
+	if len(ch.Waiters) == 0 || ch.Timer {
+		return false
+	}
+	theirs := make(map[uint64]bool)
+	for _, w := range ch.Waiters {
+		theirs[w.Goroutine.Address] = true
+		for _, frame := range w.Goroutine.Frames {
+			theirs[frame.Address] = true
+		}
+		if w.Sudog != nil {
+			theirs[w.Sudog.Address] = true
+		}
+	}
+
+	visited := make(map[*heapdump.Object]bool)
+	queue := []*heapdump.Object{ch.Header}
+	for len(queue) > 0 {
+		o := queue[0]
+		queue = queue[1:]
+		if visited[o] {
+			continue
+		}
+		visited[o] = true
+		if len(visited) > chanLeakSearchLimit {
+			return false
+		}
+		if _, hasFinalizer := c.finalizers[o.Address]; hasFinalizer {
+			return false
+		}
+		var owners []heapdump.Record
+		if o.Map != nil {
+			owners = c.mapOwners(o.Map)
+		} else {
+			owners = append(owners, c.owners[o.Address]...)
+			owners = append(owners, c.owners[o.Address+c.params.PointerSize]...)
+		}
+		for _, owner := range owners {
+			a, addressable := owner.(heapdump.Addressable)
+			if addressable && theirs[a.GetAddress()] {
+				continue
+			}
+			next, isObject := owner.(*heapdump.Object)
+			if !isObject {
+				// A root that isn't one of the waiting goroutines.
+				return false
+			}
+			queue = append(queue, next)
+		}
+	}
+	return true
+}
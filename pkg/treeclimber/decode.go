@@ -0,0 +1,256 @@
+package treeclimber
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/adamroach/heapspurs/pkg/gotype"
+	"github.com/adamroach/heapspurs/pkg/heapdump"
+)
+
+// The number of array elements, slice elements and string bytes that
+// we show before giving up.
+const (
+	decodeMaxElements = 16
+	decodeMaxPreview  = 4
+	decodeMaxString   = 64
+)
+
+// Renders the contents of an object (or global variable) as fields,
+// using its type: each field's offset, name, type and value. Pointers,
+// strings and slices are resolved to what they point to.
+func (c *TreeClimber) Decode(address uint64) (string, error) {
+	r, found := c.memory[address]
+	if !found {
+		return "", fmt.Errorf("Cound not find record for address 0x%x", address)
+	}
+	var t *gotype.Type
+	var path string
+	guess := ""
+	switch o := r.(type) {
+	case *heapdump.Object:
+		t = o.Type
+		if t != nil {
+			path = strings.TrimPrefix(t.ShortName(), "*")
+		}
+		if t == nil && len(o.Matches) > 0 {
+			// Our best guess is better than nothing.
+			t = o.Matches[0].Type
+			path = strings.TrimPrefix(t.ShortName(), "*")
+			guess = fmt.Sprintf("Decoded as %s, the likeliest of %d types that fit\n", t.Name, len(o.Matches))
+		}
+	case *heapdump.Global:
+		t, path = o.Type, o.Name
+	}
+	if t == nil || t.Size == 0 {
+		return "", fmt.Errorf("Type of %T at 0x%x is not known; use --program or --typefile to describe it", r, address)
+	}
+
+	d := &decoder{c: c, out: &strings.Builder{}}
+	d.out.WriteString(r.(fmt.Stringer).String() + "\n")
+	d.out.WriteString(guess)
+	d.out.WriteString(fmt.Sprintf("%8s  %-32s %-24s %s\n", "Offset", "Field", "Type", "Value"))
+	contents := r.(heapdump.Owner).GetContents()
+	if uint64(len(contents)) >= 2*t.Size {
+		// The object holds an array of these (e.g., a slice's backing
+		// array), so show each element in turn.
+		count := uint64(len(contents)) / t.Size
+		for i := uint64(0); i < min(count, decodeMaxElements); i++ {
+			d.value(fmt.Sprintf("[%d]", i), t, contents, i*t.Size)
+		}
+		if count > decodeMaxElements {
+			d.row(decodeMaxElements*t.Size, "...", "", fmt.Sprintf("%d more", count-decodeMaxElements))
+		}
+	} else {
+		d.value(path, t, contents, 0)
+	}
+	return d.out.String(), nil
+}
+
+type decoder struct {
+	c   *TreeClimber
+	out *strings.Builder
+}
+
+func (d *decoder) row(offset uint64, path string, typ string, value string) {
+	d.out.WriteString(fmt.Sprintf("%8d  %-32s %-24s %s\n", offset, path, typ, value))
+}
+
+// Writes one row for each leaf of a value.
+func (d *decoder) value(path string, t *gotype.Type, contents []byte, offset uint64) {
+	if offset+t.Size > uint64(len(contents)) {
+		d.row(offset, path, t.Name, "(truncated)")
+		return
+	}
+	switch {
+	case t.Kind == gotype.Struct && len(t.Fields) > 0:
+		for _, f := range t.Fields {
+			d.value(path+"."+f.Name, f.Type, contents, offset+f.Offset)
+		}
+	case t.Kind == gotype.Struct && t.Bitmap != nil:
+		// All we know about types from a layout file is where their
+		// pointers are.
+		ptrSize := d.c.params.PointerSize
+		pointers := make(map[uint64]bool)
+		for _, o := range t.PointerOffsets(ptrSize) {
+			pointers[o] = true
+		}
+		for w := uint64(0); w < t.Size/ptrSize; w++ {
+			if pointers[w*ptrSize] {
+				d.row(offset+w*ptrSize, fmt.Sprintf("%s.word[%d]", path, w), "pointer",
+					d.pointer(d.c.word(contents, offset+w*ptrSize)))
+			} else {
+				d.row(offset+w*ptrSize, fmt.Sprintf("%s.word[%d]", path, w), "uintptr",
+					fmt.Sprintf("0x%x", d.c.word(contents, offset+w*ptrSize)))
+			}
+		}
+	case t.Kind == gotype.Array && t.Elem != nil && t.Elem.Size == 1 && (t.Elem.Kind == gotype.Uint || t.Elem.Kind == gotype.Int):
+		d.row(offset, path, t.Name, quote(contents[offset:offset+t.Size]))
+	case t.Kind == gotype.Array && t.Elem != nil && t.Elem.Size > 0:
+		for i := uint64(0); i < min(t.Len, decodeMaxElements); i++ {
+			d.value(fmt.Sprintf("%s[%d]", path, i), t.Elem, contents, offset+i*t.Elem.Size)
+		}
+		if t.Len > decodeMaxElements {
+			d.row(offset+decodeMaxElements*t.Elem.Size, path+"[...]", "", fmt.Sprintf("%d more", t.Len-decodeMaxElements))
+		}
+	default:
+		d.row(offset, path, t.Name, d.leaf(t, contents, offset))
+	}
+}
+
+// Decodes a value that isn't a struct or an array.
+func (d *decoder) leaf(t *gotype.Type, contents []byte, offset uint64) string {
+	c := d.c
+	ptrSize := c.params.PointerSize
+	data := contents[offset : offset+t.Size]
+	switch t.Kind {
+	case gotype.Bool:
+		return strconv.FormatBool(data[0] != 0)
+	case gotype.Int:
+		v := c.uint(data)
+		shift := 64 - 8*len(data)
+		return strconv.FormatInt(int64(v<<shift)>>shift, 10)
+	case gotype.Uint:
+		return strconv.FormatUint(c.uint(data), 10)
+	case gotype.Uintptr:
+		return fmt.Sprintf("0x%x", c.uint(data))
+	case gotype.Float:
+		if len(data) == 4 {
+			return strconv.FormatFloat(float64(math.Float32frombits(uint32(c.uint(data)))), 'g', -1, 32)
+		}
+		return strconv.FormatFloat(math.Float64frombits(c.uint(data)), 'g', -1, 64)
+	case gotype.Complex:
+		half := len(data) / 2
+		re := &gotype.Type{Kind: gotype.Float, Size: uint64(half)}
+		return fmt.Sprintf("(%s%+si)", d.leaf(re, data, 0),
+			strings.TrimPrefix(d.leaf(re, data, uint64(half)), "+"))
+	case gotype.String:
+		ptr, length := c.word(contents, offset), c.word(contents, offset+ptrSize)
+		if ptr == 0 {
+			return `""`
+		}
+		if text, ok := c.read(ptr, min(length, decodeMaxString)); ok {
+			s := quote(text)
+			if length > decodeMaxString {
+				s += "..."
+			}
+			return fmt.Sprintf("%s (len %d)", s, length)
+		}
+		return fmt.Sprintf("0x%x (len %d)", ptr, length)
+	case gotype.Slice:
+		ptr := c.word(contents, offset)
+		length, capacity := c.word(contents, offset+ptrSize), c.word(contents, offset+2*ptrSize)
+		s := fmt.Sprintf("%s len %d cap %d", d.pointer(ptr), length, capacity)
+		if t.Elem != nil && t.Elem.Size > 0 && length > 0 {
+			s += " " + d.preview(t.Elem, ptr, length)
+		}
+		return s
+	case gotype.Interface:
+		typ, ptr := c.word(contents, offset), c.word(contents, offset+ptrSize)
+		if typ == 0 {
+			return "nil"
+		}
+		if td := c.dump.GetType(typ); td != nil {
+			return fmt.Sprintf("(%s) %s", td.Name, d.pointer(ptr))
+		}
+		return fmt.Sprintf("(0x%x) %s", typ, d.pointer(ptr))
+	case gotype.Pointer, gotype.UnsafePointer, gotype.Map, gotype.Chan, gotype.Func:
+		return d.pointer(c.word(contents, offset))
+	}
+	return fmt.Sprintf("0x%x", data)
+}
+
+// Describes what a pointer points to: the object that contains it (and
+// where in that object), or the variable, if it's not in the heap.
+func (d *decoder) pointer(ptr uint64) string {
+	if ptr == 0 {
+		return "nil"
+	}
+	return d.c.pointerTarget(ptr)
+}
+
+// Shows the first few elements of a slice's backing array.
+func (d *decoder) preview(elem *gotype.Type, ptr uint64, length uint64) string {
+	n := min(length, decodeMaxPreview)
+	if elem.Size == 1 && (elem.Kind == gotype.Uint || elem.Kind == gotype.Int) {
+		n = min(length, decodeMaxString)
+	}
+	data, ok := d.c.read(ptr, n*elem.Size)
+	if !ok {
+		return ""
+	}
+	if elem.Size == 1 && (elem.Kind == gotype.Uint || elem.Kind == gotype.Int) {
+		return quote(data)
+	}
+	list := make([]string, 0, n)
+	for i := uint64(0); i < n; i++ {
+		switch elem.Kind {
+		case gotype.Struct, gotype.Array:
+			list = append(list, elem.ShortName()+"{...}")
+		default:
+			list = append(list, d.leaf(elem, data, i*elem.Size))
+		}
+	}
+	if length > n {
+		list = append(list, "...")
+	}
+	return "[" + strings.Join(list, ", ") + "]"
+}
+
+func quote(data []byte) string {
+	return strconv.Quote(string(data))
+}
+
+// Reads memory from the object that contains the indicated address.
+func (c *TreeClimber) read(address uint64, n uint64) ([]byte, bool) {
+	o := c.findObject(address)
+	if o == nil || address+n > o.Address+uint64(len(o.Contents)) {
+		return nil, false
+	}
+	return o.Contents[address-o.Address : address-o.Address+n], true
+}
+
+func (c *TreeClimber) word(contents []byte, offset uint64) uint64 {
+	return heapdump.ReadWord(contents, offset, c.params)
+}
+
+// Reads an unsigned integer of any size, in the dump's byte order.
+func (c *TreeClimber) uint(data []byte) uint64 {
+	var order binary.ByteOrder = binary.LittleEndian
+	if c.params.BigEndian {
+		order = binary.BigEndian
+	}
+	switch len(data) {
+	case 1:
+		return uint64(data[0])
+	case 2:
+		return uint64(order.Uint16(data))
+	case 4:
+		return uint64(order.Uint32(data))
+	default:
+		return order.Uint64(data)
+	}
+}
@@ -0,0 +1,404 @@
+package treeclimber
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/adamroach/heapspurs/pkg/heapdump"
+)
+
+// The number of goroutine IDs we list for each group, and the number of
+// goroutines (and groups) we list by memory.
+const (
+	goroutinesMaxIds = 10
+	goroutineMemTop  = 20
+)
+
+// A set of goroutines with identical stacks, in the same state.
+type goroutineGroup struct {
+	key        string
+	goroutines []*heapdump.Goroutine
+	minWait    time.Duration
+	maxWait    time.Duration
+	waits      int // how many of the goroutines have a known wait time
+}
+
+// Groups goroutines by their state and their stack, so that (for
+// example) thousands of goroutines blocked in the same place show up
+// as a single entry. Stacks are the same if they run through the same
+// functions, at the same offsets into them.
+func (c *TreeClimber) goroutineGroups() []*goroutineGroup {
+	groups := make(map[string]*goroutineGroup)
+	sorted := make([]*goroutineGroup, 0)
+	for _, record := range c.records {
+		g, isGoroutine := record.(*heapdump.Goroutine)
+		if !isGoroutine {
+			continue
+		}
+		key := goroutineState(g) + "\n" + c.goroutineStack(g, "\n")
+		group, found := groups[key]
+		if !found {
+			group = &goroutineGroup{key: key}
+			groups[key] = group
+			sorted = append(sorted, group)
+		}
+		group.goroutines = append(group.goroutines, g)
+		if wait, known := g.WaitTime(); known {
+			if group.waits == 0 || wait < group.minWait {
+				group.minWait = wait
+			}
+			group.maxWait = max(group.maxWait, wait)
+			group.waits++
+		}
+	}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return len(sorted[i].goroutines) > len(sorted[j].goroutines)
+	})
+	return sorted
+}
+
+// Lists every goroutine, grouped by identical stacks, most common first
+// -- much like the "goroutine" profile that net/http/pprof serves with
+// debug=1.
+func (c *TreeClimber) PrintGoroutines() error {
+	groups := c.goroutineGroups()
+	if len(groups) == 0 {
+		fmt.Printf("No goroutines found\n")
+		return nil
+	}
+	total := 0
+	for _, group := range groups {
+		total += len(group.goroutines)
+	}
+	fmt.Printf("%d goroutines in %d groups\n", total, len(groups))
+	for _, group := range groups {
+		first := group.goroutines[0]
+		fmt.Printf("\n%d: %s", len(group.goroutines), goroutineState(first))
+		if group.waits > 0 {
+			fmt.Printf(", blocked %s", formatDuration(group.minWait))
+			if group.maxWait != group.minWait {
+				fmt.Printf(" to %s", formatDuration(group.maxWait))
+			}
+		}
+		fmt.Println()
+		fmt.Printf("    Goroutines: %s\n", goroutineIds(group.goroutines))
+		for _, line := range strings.Split(c.goroutineStack(first, "\n"), "\n") {
+			fmt.Printf("    %s\n", line)
+		}
+	}
+	c.noteWaitTimes()
+	return nil
+}
+
+// Describes what a goroutine is doing, e.g. "Waiting (chan receive)".
+func goroutineState(g *heapdump.Goroutine) string {
+	s := g.Status.String()
+	if g.Status == heapdump.Waiting {
+		s += fmt.Sprintf(" (%s)", g.WaitReason)
+	}
+	if g.System {
+		s += " [system]"
+	}
+	if g.Background {
+		s += " [background]"
+	}
+	return s
+}
+
+// Lists the functions on a goroutine's stack, top first, along with how
+// far into each function it is, followed by its pending deferred calls
+// and any panics in progress.
+func (c *TreeClimber) goroutineStack(g *heapdump.Goroutine, separator string) string {
+	out := make([]string, 0, len(g.Frames))
+	for _, frame := range g.Frames {
+		line := fmt.Sprintf("[%d] %s+0x%x", frame.Depth, frame.Name, frame.CurrentPc-frame.EntryPc)
+		if source := frame.Source(); len(source) > 0 {
+			line += " at " + source
+		}
+		out = append(out, line)
+	}
+	for _, d := range g.Defers {
+		out = append(out, "deferred "+c.deferDescription(d))
+	}
+	for _, r := range g.Panics {
+		out = append(out, fmt.Sprintf("panicking with %s", r.Arg))
+	}
+	return strings.Join(out, separator)
+}
+
+// Describes a pending deferred call: the function it will call, and
+// the defer statement that set it up.
+func (c *TreeClimber) deferDescription(d *heapdump.DeferRecord) string {
+	fn := c.dump.Addr(d.EntryPointPc)
+	if name, _, _, found := c.dump.SourceLine(d.EntryPointPc); found {
+		fn = name
+	}
+	// The PC is where the deferring function carries on from.
+	if _, file, line, found := c.dump.SourceLine(d.Pc - 1); found {
+		return fmt.Sprintf("%s from %s:%d", fn, file, line)
+	}
+	return fn
+}
+
+func goroutineIds(goroutines []*heapdump.Goroutine) string {
+	ids := make([]string, 0, goroutinesMaxIds+1)
+	for i, g := range goroutines {
+		if i == goroutinesMaxIds {
+			ids = append(ids, fmt.Sprintf("... (%d more)", len(goroutines)-goroutinesMaxIds))
+			break
+		}
+		ids = append(ids, fmt.Sprintf("%d", g.RoutineId))
+	}
+	return strings.Join(ids, " ")
+}
+
+// Wait times are only as good as our idea of when the last garbage
+// collection finished, so we say so when we've had to guess at it.
+func (c *TreeClimber) noteWaitTimes() {
+	if c.dump.LastGCEstimated() {
+		fmt.Printf("\nWait times are measured up to the latest time a collection found a goroutine waiting, since we couldn't tell when the last one finished; they may be too short. Use --program with a binary that has DWARF to fix this.\n")
+	}
+}
+
+// Rounds a duration to something readable. Durations of less than a
+// microsecond are left as they are, rather than rounded away to nothing.
+func formatDuration(d time.Duration) string {
+	switch {
+	case d < time.Microsecond:
+		return d.String()
+	case d >= time.Minute:
+		return d.Round(time.Second).String()
+	case d >= time.Second:
+		return d.Round(time.Millisecond).String()
+	}
+	return d.Round(time.Microsecond).String()
+}
+
+// Prints the goroutines, and the groups of goroutines with identical
+// stacks, that retain the most memory: the bytes that only their stacks
+// keep alive, and the bytes that their stacks can reach at all.
+func (c *TreeClimber) PrintGoroutineMemory() error {
+	r := c.getRetention()
+	if len(r.goroutines) == 0 {
+		fmt.Printf("No goroutines found\n")
+		return nil
+	}
+	index := make(map[*heapdump.Goroutine]int)
+	type entry struct {
+		label     string
+		nodes     []int32
+		retained  uint64
+		objects   uint64
+		reachable uint64
+	}
+	top := func(entries []*entry) []*entry {
+		sort.SliceStable(entries, func(i, j int) bool {
+			return entries[i].retained > entries[j].retained
+		})
+		if len(entries) > goroutineMemTop {
+			entries = entries[:goroutineMemTop]
+		}
+		for _, e := range entries {
+			e.reachable, _ = c.reachable(e.nodes)
+		}
+		return entries
+	}
+
+	goroutines := make([]*entry, 0, len(r.goroutines))
+	for i, g := range r.goroutines {
+		index[g] = i
+		bytes, count := r.goroutineRetained(i)
+		goroutines = append(goroutines, &entry{goroutineLabel(g), []int32{r.goroutineNode(i)}, bytes, count, 0})
+	}
+	fmt.Printf("%12s %10s %12s  %s\n", "Retained", "Objects", "Reachable", "Goroutine")
+	for _, e := range top(goroutines) {
+		fmt.Printf("%12s %10d %12s  %s\n", unitize(e.retained), e.objects, unitize(e.reachable), e.label)
+	}
+
+	groups := make([]*entry, 0)
+	for _, group := range c.goroutineGroups() {
+		e := &entry{}
+		for _, g := range group.goroutines {
+			if i, found := index[g]; found {
+				bytes, count := r.goroutineRetained(i)
+				e.nodes = append(e.nodes, r.goroutineNode(i))
+				e.retained += bytes
+				e.objects += count
+			}
+		}
+		if len(e.nodes) == 0 {
+			continue
+		}
+		first := group.goroutines[0]
+		e.label = fmt.Sprintf("%d x %s", len(group.goroutines), goroutineState(first))
+		if f := topFunction(first); len(f) > 0 {
+			e.label += " in " + f
+		}
+		groups = append(groups, e)
+	}
+	fmt.Printf("\n%12s %10s %12s  %s\n", "Retained", "Objects", "Reachable", "Stack")
+	for _, e := range top(groups) {
+		fmt.Printf("%12s %10d %12s  %s\n", unitize(e.retained), e.objects, unitize(e.reachable), e.label)
+	}
+	return nil
+}
+
+// Describes the go statement that created a goroutine.
+func (c *TreeClimber) creationSite(g *heapdump.Goroutine) string {
+	if g.CreatorPointer == 0 {
+		return "(no go statement)"
+	}
+	// Like any return address, this points just past the call.
+	if fn, file, line, found := c.dump.SourceLine(g.CreatorPointer - 1); found {
+		return fmt.Sprintf("%s at %s:%d", fn, file, line)
+	}
+	return c.dump.Addr(g.CreatorPointer)
+}
+
+// Lists goroutines by the go statement that created them and, within
+// that, by what they're waiting for and the function they're in. A
+// creation site with thousands of blocked goroutines is usually where a
+// goroutine leak comes from. Each line also gives how long its longest
+// blocked goroutine has been waiting.
+func (c *TreeClimber) PrintGoroutineCreators() error {
+	type group struct {
+		label      string
+		goroutines int
+		maxWait    time.Duration
+		waits      int
+		groups     map[string]*group
+		sorted     []*group
+	}
+	add := func(parent *group, label string, g *heapdump.Goroutine) *group {
+		child, found := parent.groups[label]
+		if !found {
+			child = &group{label: label, groups: make(map[string]*group)}
+			parent.groups[label] = child
+			parent.sorted = append(parent.sorted, child)
+		}
+		child.goroutines++
+		if wait, known := g.WaitTime(); known {
+			child.maxWait = max(child.maxWait, wait)
+			child.waits++
+		}
+		return child
+	}
+	sortGroups := func(groups []*group) {
+		sort.SliceStable(groups, func(i, j int) bool {
+			return groups[i].goroutines > groups[j].goroutines
+		})
+	}
+	waited := func(g *group) string {
+		if g.waits == 0 {
+			return "-"
+		}
+		return formatDuration(g.maxWait)
+	}
+
+	sites := &group{groups: make(map[string]*group)}
+	for _, record := range c.records {
+		g, isGoroutine := record.(*heapdump.Goroutine)
+		if !isGoroutine {
+			continue
+		}
+		site := add(sites, c.creationSite(g), g)
+		label := goroutineState(g)
+		if f := topFunction(g); len(f) > 0 {
+			label += " in " + f
+		}
+		add(site, label, g)
+	}
+	if len(sites.sorted) == 0 {
+		fmt.Printf("No goroutines found\n")
+		return nil
+	}
+
+	sortGroups(sites.sorted)
+	fmt.Printf("%10s %12s  %s\n", "Goroutines", "Longest Wait", "Created At")
+	for _, site := range sites.sorted {
+		fmt.Printf("%10d %12s  %s\n", site.goroutines, waited(site), site.label)
+		sortGroups(site.sorted)
+		for _, g := range site.sorted {
+			fmt.Printf("%10d %12s    %s\n", g.goroutines, waited(g), g.label)
+		}
+	}
+	c.noteWaitTimes()
+	return nil
+}
+
+// Prints every goroutine that has been blocked for at least the
+// indicated time, longest first, with its full stack and the objects
+// that its stack frames point to. Goroutines that have been stuck for
+// hours are nearly always leaks.
+func (c *TreeClimber) PrintBlockedGoroutines(threshold time.Duration) error {
+	type blocked struct {
+		g    *heapdump.Goroutine
+		wait time.Duration
+	}
+	found := make([]blocked, 0)
+	for _, record := range c.records {
+		g, isGoroutine := record.(*heapdump.Goroutine)
+		if !isGoroutine {
+			continue
+		}
+		if wait, known := g.WaitTime(); known && wait >= threshold {
+			found = append(found, blocked{g, wait})
+		}
+	}
+	if len(found) == 0 {
+		fmt.Printf("No goroutines have been blocked for %s or longer\n", formatDuration(threshold))
+		c.noteWaitTimes()
+		return nil
+	}
+	sort.SliceStable(found, func(i, j int) bool {
+		return found[i].wait > found[j].wait
+	})
+
+	r := c.getRetention()
+	index := make(map[*heapdump.Goroutine]int)
+	for i, g := range r.goroutines {
+		index[g] = i
+	}
+	fmt.Printf("%d goroutines have been blocked for %s or longer\n", len(found), formatDuration(threshold))
+	for _, b := range found {
+		fmt.Printf("\nGoroutine[%d] %s, blocked %s, created by %s\n",
+			b.g.RoutineId, goroutineState(b.g), formatDuration(b.wait), c.creationSite(b.g))
+		for _, line := range strings.Split(c.goroutineStack(b.g, "\n"), "\n") {
+			fmt.Printf("    %s\n", line)
+		}
+		if i, found := index[b.g]; found {
+			bytes, count := r.goroutineRetained(i)
+			fmt.Printf("  Retains %s in %d objects\n", unitize(bytes), count)
+		}
+		c.printFrameObjects(b.g)
+	}
+	c.noteWaitTimes()
+	return nil
+}
+
+// Lists the objects that a goroutine's stack frames point to, and the
+// variables that point to them.
+func (c *TreeClimber) printFrameObjects(g *heapdump.Goroutine) {
+	header := false
+	for _, frame := range g.Frames {
+		sources, targets := heapdump.GetPointerInfo(frame, c.params)
+		for i, target := range targets {
+			o := c.dump.FindObject(target)
+			if o == nil {
+				continue
+			}
+			if !header {
+				fmt.Printf("  Points to:\n")
+				header = true
+			}
+			slot := frame.FieldName(sources[i] - frame.Address)
+			if len(slot) == 0 {
+				slot = fmt.Sprintf("+0x%x", sources[i]-frame.Address)
+			}
+			fmt.Printf("    [%d] %s: %s -> %s @ 0x%x (%s)\n",
+				frame.Depth, frame.Name, slot, o.GetName(), o.Address, unitize(uint64(len(o.Contents))))
+		}
+	}
+}
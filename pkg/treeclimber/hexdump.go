@@ -0,0 +1,123 @@
+package treeclimber
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/adamroach/heapspurs/pkg/heapdump"
+)
+
+// Segments are dumped one global variable at a time. Stretches of a
+// segment that no symbol covers are dumped a page at a time.
+const hexdumpPageSize = 4096
+
+// The most bytes of string data we show when a pointer leads to some.
+const hexdumpMaxString = 32
+
+// Finds the record that contains an address, for hexdumps of the
+// middle of an object, stack frame or segment. Segments are broken
+// down by symbol (or page, if there aren't any symbols).
+func (c *TreeClimber) findContaining(address uint64) heapdump.Record {
+	if o := c.findObject(address); o != nil {
+		return o
+	}
+	for _, record := range c.records {
+		switch r := record.(type) {
+		case *heapdump.StackFrame:
+			if address >= r.Address && address < r.Address+uint64(len(r.Contents)) {
+				return r
+			}
+		case *heapdump.DataSegment, *heapdump.BssSegment:
+			seg := r.(heapdump.Owner)
+			if address >= seg.GetAddress() && address < seg.GetAddress()+uint64(len(seg.GetContents())) {
+				return c.segmentPage(seg, address)
+			}
+		}
+	}
+	return nil
+}
+
+// Returns the global variable that contains an address. If the address
+// isn't part of any symbol, we return the page that contains it instead.
+func (c *TreeClimber) segmentPage(seg heapdump.Owner, address uint64) *heapdump.Global {
+	g := c.dump.GlobalAt(seg, address)
+	if sym, _ := c.dump.GetSymbol(address); sym != nil || len(g.Contents) <= hexdumpPageSize {
+		return g
+	}
+	start := max(address&^(hexdumpPageSize-1), g.Address)
+	end := min(address&^(hexdumpPageSize-1)+hexdumpPageSize, g.Address+uint64(len(g.Contents)))
+	page := &heapdump.Global{
+		Address:  start,
+		Name:     fmt.Sprintf("%s+0x%x", heapdump.SegmentName(seg), start-seg.GetAddress()),
+		Contents: g.Contents[start-g.Address : end-g.Address],
+		Segment:  seg,
+	}
+	for _, offset := range g.Fields {
+		if g.Address+offset >= start && g.Address+offset < end {
+			page.Fields = append(page.Fields, g.Address+offset-start)
+		}
+	}
+	return page
+}
+
+// Tells the user how to get to the variables on either side of this one.
+func (c *TreeClimber) segmentNavigation(g *heapdump.Global) string {
+	seg := g.Segment
+	ret := ""
+	if g.Address > seg.GetAddress() {
+		prev := c.segmentPage(seg, g.Address-1)
+		ret += fmt.Sprintf("Previous: --address 0x%x (%s)\n", prev.Address, prev.Name)
+	}
+	end := g.Address + uint64(len(g.Contents))
+	if end < seg.GetAddress()+uint64(len(seg.GetContents())) {
+		next := c.segmentPage(seg, end)
+		ret += fmt.Sprintf("Next: --address 0x%x (%s)\n", next.Address, next.Name)
+	}
+	return ret
+}
+
+// Describes the target of a pointer: what it points into, and a preview
+// of any text found there.
+func (c *TreeClimber) describePointer(ptr uint64) string {
+	if ptr == 0 {
+		return "nil"
+	}
+	ret := c.pointerTarget(ptr)
+	if text := c.printable(ptr); len(text) > 0 {
+		ret += " " + text
+	}
+	return ret
+}
+
+// Names the object, variable or other record that a pointer points
+// into, and how far into it the pointer points.
+func (c *TreeClimber) pointerTarget(ptr uint64) string {
+	if o := c.findObject(ptr); o != nil {
+		if ptr == o.Address {
+			return fmt.Sprintf("0x%x -> %s (%d bytes)", ptr, o.GetName(), len(o.Contents))
+		}
+		return fmt.Sprintf("0x%x -> %s+%d", ptr, o.GetName(), ptr-o.Address)
+	}
+	return c.dump.Addr(ptr)
+}
+
+// Returns the printable text that a pointer leads to, quoted, if there
+// is enough of it to look like a string.
+func (c *TreeClimber) printable(ptr uint64) string {
+	o := c.findObject(ptr)
+	if o == nil {
+		return ""
+	}
+	data := o.Contents[ptr-o.Address:]
+	n := 0
+	for n < len(data) && n <= hexdumpMaxString && data[n] >= 0x20 && data[n] < 0x7f {
+		n++
+	}
+	if n < 4 {
+		return ""
+	}
+	if n > hexdumpMaxString {
+		return strconv.Quote(string(data[:hexdumpMaxString])) + "..."
+	}
+	return strconv.Quote(string(data[:n]))
+}
@@ -0,0 +1,66 @@
+package treeclimber
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Prints the number of objects of each type (or shape), and the bytes
+// they take up, largest first. The objects that make up a map are
+// counted as part of the map, rather than individually.
+func (c *TreeClimber) PrintHistogram() error {
+	type entry struct {
+		name    string
+		bytes   uint64
+		objects uint64
+		maps    bool
+		entries uint64
+		wasted  uint64
+	}
+	entries := make(map[string]*entry)
+	for _, o := range c.objects {
+		name := o.GetName()
+		if o.Map != nil {
+			name = o.Map.Name
+		}
+		e, found := entries[name]
+		if !found {
+			e = &entry{name: name}
+			entries[name] = e
+		}
+		e.bytes += uint64(len(o.Contents))
+		switch {
+		case o.Map == nil:
+			e.objects++
+		case o.Map.Header == o:
+			e.objects++
+			e.maps = true
+			e.entries += o.Map.Entries
+			e.wasted += o.Map.Wasted
+		}
+	}
+	if len(entries) == 0 {
+		fmt.Printf("No objects found\n")
+		return nil
+	}
+	sorted := make([]*entry, 0, len(entries))
+	for _, e := range entries {
+		sorted = append(sorted, e)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].bytes != sorted[j].bytes {
+			return sorted[i].bytes > sorted[j].bytes
+		}
+		return sorted[i].name < sorted[j].name
+	})
+
+	fmt.Printf("%12s %10s  %s\n", "Bytes", "Objects", "Type")
+	for _, e := range sorted {
+		if e.maps {
+			fmt.Printf("%12s %10d  %s (%d entries, %s wasted)\n", unitize(e.bytes), e.objects, e.name, e.entries, unitize(e.wasted))
+		} else {
+			fmt.Printf("%12s %10d  %s\n", unitize(e.bytes), e.objects, e.name)
+		}
+	}
+	return nil
+}
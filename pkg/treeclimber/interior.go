@@ -0,0 +1,132 @@
+package treeclimber
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/adamroach/heapspurs/pkg/heapdump"
+)
+
+// An object is reported as pinned if it's at least pinnedMinSize bytes
+// long, and the pointers into it account for less than pinnedMaxUsed
+// of its bytes.
+const (
+	pinnedMinSize = 1024
+	pinnedMaxUsed = 0.5
+)
+
+// Finds objects that are only kept alive by pointers into their middle,
+// and which those pointers only use a small part of -- the classic case
+// being a short substring (or sub-slice) of a large buffer, which keeps
+// the whole buffer alive. The part of the object that each pointer uses
+// is worked out from its string or slice header, if it has one;
+// otherwise, we assume it's a single word. Objects are listed by the
+// number of bytes that nothing uses, largest first.
+func (c *TreeClimber) PrintPinned() error {
+	type reference struct {
+		owner heapdump.Record
+		dest  uint64
+		start uint64 // range of the object used through this reference
+		end   uint64
+		label string
+	}
+	type entry struct {
+		object *heapdump.Object
+		refs   []reference
+		base   bool // referenced at its start
+		wasted uint64
+	}
+	entries := make(map[*heapdump.Object]*entry)
+	for dest, owners := range c.owners {
+		o := c.findObject(dest)
+		if o == nil {
+			continue
+		}
+		e, found := entries[o]
+		if !found {
+			e = &entry{object: o}
+			entries[o] = e
+		}
+		// Since Go 1.22, objects with pointers that are larger than 512
+		// bytes (on 64-bit platforms) start with a one-word header, so
+		// pointers to the start of the value point one word in.
+		base := o.Address
+		if uint64(len(o.Contents)) > 8*c.params.PointerSize*c.params.PointerSize && len(o.Fields) > 0 {
+			base += c.params.PointerSize
+		}
+		if dest == o.Address || dest == base {
+			e.base = true
+			continue
+		}
+		end := o.Address + uint64(len(o.Contents))
+		for _, owner := range owners {
+			a, isOwner := owner.(heapdump.Owner)
+			if !isOwner || owner == heapdump.Record(o) {
+				continue
+			}
+			ref := reference{owner: owner, dest: dest, end: min(dest+c.params.PointerSize, end)}
+			offset := heapdump.GetPointersSourceAddress(a, dest, c.params) - a.GetAddress()
+			ref.label = ownerLabel(owner, offset)
+			if h, isHeader := c.dump.FindHeader(a, offset, c.params); isHeader {
+				used := h.Len
+				if h.Kind == heapdump.SliceHeader {
+					elem := h.Elem
+					if elem == 0 {
+						elem = 1
+						if len(o.Fields) > 0 {
+							elem = c.params.PointerSize
+						}
+					}
+					used = h.Cap * elem
+				}
+				ref.end = min(dest+used, end)
+				ref.label += " " + h.String()
+			}
+			ref.start = dest
+			e.refs = append(e.refs, ref)
+		}
+	}
+
+	pinned := make([]*entry, 0)
+	for _, e := range entries {
+		if e.base || len(e.refs) == 0 || len(e.object.Contents) < pinnedMinSize {
+			continue
+		}
+		sort.Slice(e.refs, func(i, j int) bool {
+			return e.refs[i].start < e.refs[j].start
+		})
+		used, covered := uint64(0), e.object.Address
+		for _, r := range e.refs {
+			start := max(r.start, covered)
+			if r.end > start {
+				used += r.end - start
+				covered = r.end
+			}
+		}
+		size := uint64(len(e.object.Contents))
+		if float64(used) < pinnedMaxUsed*float64(size) {
+			e.wasted = size - used
+			pinned = append(pinned, e)
+		}
+	}
+	if len(pinned) == 0 {
+		fmt.Printf("No objects are pinned by interior pointers\n")
+		return nil
+	}
+	sort.Slice(pinned, func(i, j int) bool {
+		if pinned[i].wasted != pinned[j].wasted {
+			return pinned[i].wasted > pinned[j].wasted
+		}
+		return pinned[i].object.Address < pinned[j].object.Address
+	})
+
+	fmt.Printf("%12s %12s  %s\n", "Wasted", "Size", "Object")
+	for _, e := range pinned {
+		o := e.object
+		fmt.Printf("%12s %12s  %s @ 0x%x\n", unitize(e.wasted), unitize(uint64(len(o.Contents))), o.GetName(), o.Address)
+		for _, r := range e.refs {
+			fmt.Printf("%27s+%d: %s\n", "", r.dest-o.Address, r.label)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,443 @@
+package treeclimber
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/adamroach/heapspurs/pkg/heapdump"
+)
+
+// Works out which roots are responsible for keeping which objects
+// alive. We build a graph with a synthetic node at the top that points
+// to every root (stack frames, globals, finalizers, and "other" roots),
+// and compute its dominator tree: an object is retained by a root if
+// every path from the top of the graph to the object passes through
+// that root. Objects reachable from more than one root are retained
+// by the synthetic top node, and not attributed to any single root.
+//
+// Stack frames hang off of one more synthetic node for each goroutine,
+// rather than the top node, so that objects that are only reachable
+// from a goroutine's stack are retained by that goroutine, even if
+// several of its frames point to them. So do the goroutine's pending
+// defers and panics, which the runtime keeps for as long as it runs.
+//
+// Node 0 is the synthetic top node, nodes 1 through len(roots) are the
+// roots, the nodes after that are the objects, in address order, and
+// the remaining nodes are the goroutines.
+type retention struct {
+	roots      []heapdump.Record
+	objects    int
+	goroutines []*heapdump.Goroutine
+	graph      *graph
+	idom       []int32  // immediate dominator of each node; -1 if unreachable
+	retained   []uint64 // bytes of objects dominated by each node (including itself)
+	count      []uint64 // number of objects dominated by each node (including itself)
+}
+
+const noNode = -1
+
+func (c *TreeClimber) getRetention() *retention {
+	if c.retention != nil {
+		return c.retention
+	}
+
+	r := &retention{}
+	for _, record := range c.records {
+		switch record.(type) {
+		case *heapdump.StackFrame, *heapdump.DeferRecord, *heapdump.PanicRecord, *heapdump.OtherRoot,
+			*heapdump.RegisteredFinalizer, *heapdump.QueuedFinalizer:
+			r.roots = append(r.roots, record)
+		case *heapdump.DataSegment, *heapdump.BssSegment:
+			// When we have symbols, the segment has been replaced by its
+			// globals in memory; use those instead.
+			a := record.(heapdump.Addressable)
+			if c.memory[a.GetAddress()] == record {
+				r.roots = append(r.roots, record)
+			}
+		}
+	}
+	for _, record := range c.memory {
+		if _, isGlobal := record.(*heapdump.Global); isGlobal {
+			r.roots = append(r.roots, record)
+		}
+	}
+	sort.SliceStable(r.roots, func(i, j int) bool {
+		_, iGlobal := r.roots[i].(*heapdump.Global)
+		_, jGlobal := r.roots[j].(*heapdump.Global)
+		if iGlobal && jGlobal {
+			return r.roots[i].(*heapdump.Global).Address < r.roots[j].(*heapdump.Global).Address
+		}
+		return !iGlobal && jGlobal
+	})
+
+	for _, record := range c.records {
+		if g, isGoroutine := record.(*heapdump.Goroutine); isGoroutine && len(g.Frames) > 0 {
+			r.goroutines = append(r.goroutines, g)
+		}
+	}
+	r.objects = len(c.objects)
+
+	g := c.buildGraph(r.roots, r.goroutines)
+	r.graph = g
+	r.idom = g.dominators()
+
+	n := len(r.idom)
+	r.retained = make([]uint64, n)
+	r.count = make([]uint64, n)
+	for i, o := range c.objects {
+		r.retained[r.objectNode(i)] = uint64(len(o.Contents))
+		r.count[r.objectNode(i)] = 1
+	}
+	g.sumDominated(r.idom, r.retained)
+	g.sumDominated(r.idom, r.count)
+
+	c.retention = r
+	return r
+}
+
+func (r *retention) objectNode(i int) int32 {
+	return int32(1 + len(r.roots) + i)
+}
+
+// Returns the bytes and number of objects that are kept alive only by
+// the indicated root.
+func (r *retention) rootRetained(i int) (bytes uint64, count uint64) {
+	return r.retained[i+1], r.count[i+1]
+}
+
+func (r *retention) goroutineNode(i int) int32 {
+	return int32(1 + len(r.roots) + r.objects + i)
+}
+
+// Returns the bytes and number of objects that are kept alive only by
+// the indicated goroutine's stack.
+func (r *retention) goroutineRetained(i int) (bytes uint64, count uint64) {
+	return r.retained[r.goroutineNode(i)], r.count[r.goroutineNode(i)]
+}
+
+// Returns the bytes and number of objects that can be reached from any
+// of the indicated nodes, whether or not anything else can reach them.
+func (c *TreeClimber) reachable(start []int32) (bytes uint64, count uint64) {
+	c.visitReachable(start, func(i int) {
+		bytes += uint64(len(c.objects[i].Contents))
+		count++
+	})
+	return bytes, count
+}
+
+// Calls visit with the index of every object that can be reached from
+// any of the indicated nodes.
+func (c *TreeClimber) visitReachable(start []int32, visit func(i int)) {
+	r := c.getRetention()
+	g := r.graph
+	seen := make([]bool, g.size())
+	queue := append([]int32{}, start...)
+	for _, v := range start {
+		seen[v] = true
+	}
+	for len(queue) > 0 {
+		v := queue[len(queue)-1]
+		queue = queue[:len(queue)-1]
+		if i := int(v) - 1 - len(r.roots); i >= 0 && i < r.objects {
+			visit(i)
+		}
+		for _, w := range g.targets[g.offsets[v]:g.offsets[v+1]] {
+			if !seen[w] {
+				seen[w] = true
+				queue = append(queue, w)
+			}
+		}
+	}
+}
+
+// Returns the pointer targets of a record in the retention graph.
+func (c *TreeClimber) rootTargets(record heapdump.Record) []uint64 {
+	switch root := record.(type) {
+	case *heapdump.OtherRoot:
+		return []uint64{root.Address}
+	case *heapdump.QueuedFinalizer:
+		return []uint64{root.ObjectAddress, root.FinalizerAddress}
+	case *heapdump.RegisteredFinalizer:
+		// An object with a finalizer doesn't keep *itself* alive, but
+		// the runtime does keep everything that it points to alive, so
+		// that the finalizer can use it.
+		targets := []uint64{root.FinalizerAddress}
+		if o := c.findObject(root.ObjectAddress); o != nil {
+			targets = append(targets, heapdump.GetPointers(o, c.params)...)
+		}
+		return targets
+	case heapdump.Owner:
+		return heapdump.GetPointers(root, c.params)
+	}
+	return nil
+}
+
+// Returns the roots that belong to a goroutine: its stack frames, and
+// its pending defers and panics.
+func goroutineRoots(g *heapdump.Goroutine) []heapdump.Record {
+	roots := make([]heapdump.Record, 0, len(g.Frames)+len(g.Defers)+len(g.Panics))
+	for _, frame := range g.Frames {
+		roots = append(roots, frame)
+	}
+	for _, d := range g.Defers {
+		roots = append(roots, d)
+	}
+	for _, p := range g.Panics {
+		roots = append(roots, p)
+	}
+	return roots
+}
+
+func (c *TreeClimber) buildGraph(roots []heapdump.Record, goroutines []*heapdump.Goroutine) *graph {
+	n := 1 + len(roots) + len(c.objects) + len(goroutines)
+	g := &graph{
+		offsets: make([]int32, n+1),
+	}
+	rootNode := make(map[heapdump.Record]int32)
+	for i, root := range roots {
+		rootNode[root] = int32(1 + i)
+	}
+	inGoroutine := make(map[int32]bool)
+	for _, goroutine := range goroutines {
+		for _, root := range goroutineRoots(goroutine) {
+			if v, found := rootNode[root]; found {
+				inGoroutine[v] = true
+			}
+		}
+	}
+
+	addTargets := func(pointers []uint64) {
+		for _, p := range pointers {
+			i := c.findObjectIndex(p)
+			if i >= 0 {
+				g.targets = append(g.targets, int32(1+len(roots)+i))
+			}
+		}
+	}
+
+	for i := range roots {
+		if !inGoroutine[int32(1+i)] {
+			g.targets = append(g.targets, int32(1+i))
+		}
+	}
+	for i := range goroutines {
+		g.targets = append(g.targets, int32(1+len(roots)+len(c.objects)+i))
+	}
+	g.offsets[1] = int32(len(g.targets))
+	for i, root := range roots {
+		addTargets(c.rootTargets(root))
+		g.offsets[2+i] = int32(len(g.targets))
+	}
+	for i, o := range c.objects {
+		addTargets(heapdump.GetPointers(o, c.params))
+		g.offsets[2+len(roots)+i] = int32(len(g.targets))
+	}
+	for i, goroutine := range goroutines {
+		for _, root := range goroutineRoots(goroutine) {
+			if v, found := rootNode[root]; found {
+				g.targets = append(g.targets, v)
+			}
+		}
+		g.offsets[2+len(roots)+len(c.objects)+i] = int32(len(g.targets))
+	}
+	return g
+}
+
+///////////////////////////////////////////////////////////////////////////
+
+// A directed graph in compressed form: the successors of node v are
+// targets[offsets[v]:offsets[v+1]].
+type graph struct {
+	offsets []int32
+	targets []int32
+	vertex  []int32 // nodes in DFS preorder, filled in by dominators()
+}
+
+func (g *graph) size() int {
+	return len(g.offsets) - 1
+}
+
+// Computes the immediate dominator of each node reachable from node 0,
+// using the Lengauer-Tarjan algorithm (the simple version, with path
+// compression). Everything is iterative, since heap graphs are far too
+// deep for recursion.
+func (g *graph) dominators() []int32 {
+	n := g.size()
+	dfnum := make([]int32, n)
+	parent := make([]int32, n)
+	for i := range dfnum {
+		dfnum[i] = noNode
+	}
+
+	// Depth-first search to number the nodes.
+	type frame struct {
+		node int32
+		next int32
+	}
+	g.vertex = make([]int32, 0, n)
+	stack := []frame{{0, g.offsets[0]}}
+	dfnum[0] = 0
+	parent[0] = noNode
+	g.vertex = append(g.vertex, 0)
+	for len(stack) > 0 {
+		top := &stack[len(stack)-1]
+		if top.next == g.offsets[top.node+1] {
+			stack = stack[:len(stack)-1]
+			continue
+		}
+		w := g.targets[top.next]
+		top.next++
+		if dfnum[w] == noNode {
+			dfnum[w] = int32(len(g.vertex))
+			parent[w] = top.node
+			g.vertex = append(g.vertex, w)
+			stack = append(stack, frame{w, g.offsets[w]})
+		}
+	}
+
+	// Predecessor lists, for the reachable part of the graph.
+	predOffsets := make([]int32, n+1)
+	for v := 0; v < n; v++ {
+		if dfnum[v] == noNode {
+			continue
+		}
+		for _, w := range g.targets[g.offsets[v]:g.offsets[v+1]] {
+			predOffsets[w+1]++
+		}
+	}
+	for v := 0; v < n; v++ {
+		predOffsets[v+1] += predOffsets[v]
+	}
+	preds := make([]int32, predOffsets[n])
+	fill := make([]int32, n)
+	copy(fill, predOffsets[:n])
+	for v := 0; v < n; v++ {
+		if dfnum[v] == noNode {
+			continue
+		}
+		for _, w := range g.targets[g.offsets[v]:g.offsets[v+1]] {
+			preds[fill[w]] = int32(v)
+			fill[w]++
+		}
+	}
+
+	semi := make([]int32, n)
+	idom := make([]int32, n)
+	ancestor := make([]int32, n)
+	label := make([]int32, n)
+	bucketHead := make([]int32, n)
+	bucketNext := make([]int32, n)
+	for v := 0; v < n; v++ {
+		semi[v] = dfnum[v]
+		idom[v] = noNode
+		ancestor[v] = noNode
+		label[v] = int32(v)
+		bucketHead[v] = noNode
+		bucketNext[v] = noNode
+	}
+
+	var path []int32
+	eval := func(v int32) int32 {
+		if ancestor[v] == noNode {
+			return v
+		}
+		// Path compression: walk up to the last node whose ancestor
+		// is still linked, then fix up labels on the way back down.
+		path = path[:0]
+		for x := v; ancestor[ancestor[x]] != noNode; x = ancestor[x] {
+			path = append(path, x)
+		}
+		for i := len(path) - 1; i >= 0; i-- {
+			x := path[i]
+			a := ancestor[x]
+			if semi[label[a]] < semi[label[x]] {
+				label[x] = label[a]
+			}
+			ancestor[x] = ancestor[a]
+		}
+		return label[v]
+	}
+
+	for i := len(g.vertex) - 1; i > 0; i-- {
+		w := g.vertex[i]
+		for _, v := range preds[predOffsets[w]:predOffsets[w+1]] {
+			u := eval(v)
+			if semi[u] < semi[w] {
+				semi[w] = semi[u]
+			}
+		}
+		s := g.vertex[semi[w]]
+		bucketNext[w] = bucketHead[s]
+		bucketHead[s] = w
+		p := parent[w]
+		ancestor[w] = p
+		for v := bucketHead[p]; v != noNode; v = bucketNext[v] {
+			u := eval(v)
+			if semi[u] < semi[v] {
+				idom[v] = u
+			} else {
+				idom[v] = p
+			}
+		}
+		bucketHead[p] = noNode
+	}
+	for i := 1; i < len(g.vertex); i++ {
+		w := g.vertex[i]
+		if idom[w] != g.vertex[semi[w]] {
+			idom[w] = idom[idom[w]]
+		}
+	}
+	idom[0] = 0
+	return idom
+}
+
+// Adds each node's value to those of the nodes that dominate it, so
+// that each node ends up with the total for everything it dominates.
+// Dominators always precede the nodes they dominate in the DFS order,
+// so walking that order backwards accumulates the totals from the
+// bottom of the tree up.
+func (g *graph) sumDominated(idom []int32, values []uint64) {
+	for i := len(g.vertex) - 1; i > 0; i-- {
+		w := g.vertex[i]
+		values[idom[w]] += values[w]
+	}
+}
+
+///////////////////////////////////////////////////////////////////////////
+
+// Prints the global variables that retain the most memory.
+func (c *TreeClimber) PrintGlobals() error {
+	r := c.getRetention()
+	type entry struct {
+		root    heapdump.Record
+		bytes   uint64
+		objects uint64
+	}
+	entries := make([]entry, 0)
+	for i, root := range r.roots {
+		switch root.(type) {
+		case *heapdump.Global, *heapdump.DataSegment, *heapdump.BssSegment:
+			bytes, count := r.rootRetained(i)
+			if count > 0 {
+				entries = append(entries, entry{root, bytes, count})
+			}
+		}
+	}
+	if len(entries) == 0 {
+		fmt.Printf("No global variables retain any objects\n")
+		return nil
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].bytes > entries[j].bytes
+	})
+
+	fmt.Printf("%12s %10s  %s\n", "Retained", "Objects", "Global")
+	for _, e := range entries {
+		name := heapdump.SegmentName(e.root.(heapdump.Addressable))
+		if g, isGlobal := e.root.(*heapdump.Global); isGlobal {
+			name = fmt.Sprintf("%s (%s)", g.Name, heapdump.SegmentName(g.Segment))
+		}
+		fmt.Printf("%12s %10d  %s\n", unitize(e.bytes), e.objects, name)
+	}
+	return nil
+}
@@ -0,0 +1,223 @@
+package treeclimber
+
+import (
+	"encoding/binary"
+	"math/rand"
+	"reflect"
+	"testing"
+
+	"github.com/adamroach/heapspurs/pkg/heapdump"
+)
+
+// Builds a graph of n nodes from a list of edges.
+func newTestGraph(n int, edges [][2]int32) *graph {
+	g := &graph{offsets: make([]int32, n+1)}
+	for v := int32(0); v < int32(n); v++ {
+		for _, e := range edges {
+			if e[0] == v {
+				g.targets = append(g.targets, e[1])
+			}
+		}
+		g.offsets[v+1] = int32(len(g.targets))
+	}
+	return g
+}
+
+func TestDominators(t *testing.T) {
+	tests := []struct {
+		name     string
+		n        int
+		edges    [][2]int32
+		idom     []int32
+		sizes    []uint64
+		retained []uint64
+	}{
+		{
+			name:     "chain",
+			n:        4,
+			edges:    [][2]int32{{0, 1}, {1, 2}, {2, 3}},
+			idom:     []int32{0, 0, 1, 2},
+			sizes:    []uint64{0, 1, 2, 4},
+			retained: []uint64{7, 7, 6, 4},
+		},
+		{
+			// Neither side of a diamond retains its bottom.
+			name:     "diamond",
+			n:        5,
+			edges:    [][2]int32{{0, 1}, {1, 2}, {1, 3}, {2, 4}, {3, 4}},
+			idom:     []int32{0, 0, 1, 1, 1},
+			sizes:    []uint64{0, 1, 2, 4, 8},
+			retained: []uint64{15, 15, 2, 4, 8},
+		},
+		{
+			name:     "two roots",
+			n:        4,
+			edges:    [][2]int32{{0, 1}, {0, 2}, {1, 3}, {2, 3}},
+			idom:     []int32{0, 0, 0, 0},
+			sizes:    []uint64{0, 1, 2, 4},
+			retained: []uint64{7, 1, 2, 4},
+		},
+		{
+			// Everything in a cycle is retained by the way into it.
+			name:     "cycle",
+			n:        5,
+			edges:    [][2]int32{{0, 1}, {1, 2}, {2, 3}, {3, 1}, {3, 4}},
+			idom:     []int32{0, 0, 1, 2, 3},
+			sizes:    []uint64{0, 1, 2, 4, 8},
+			retained: []uint64{15, 15, 14, 12, 8},
+		},
+		{
+			name:     "cycle with two ways in",
+			n:        4,
+			edges:    [][2]int32{{0, 1}, {0, 2}, {1, 3}, {2, 3}, {3, 2}},
+			idom:     []int32{0, 0, 0, 0},
+			sizes:    []uint64{0, 1, 2, 4},
+			retained: []uint64{7, 1, 2, 4},
+		},
+		{
+			// Nodes that can't be reached have no dominator, and
+			// don't count towards anything, even if they point to
+			// something that can be reached.
+			name:     "unreachable",
+			n:        5,
+			edges:    [][2]int32{{0, 1}, {2, 1}, {2, 3}, {1, 4}},
+			idom:     []int32{0, 0, noNode, noNode, 1},
+			sizes:    []uint64{0, 1, 2, 4, 8},
+			retained: []uint64{9, 9, 2, 4, 8},
+		},
+		{
+			// The example from Lengauer and Tarjan's paper, where
+			// semidominators and immediate dominators differ.
+			name: "Lengauer-Tarjan",
+			n:    13,
+			edges: [][2]int32{
+				{0, 1}, {0, 2}, {0, 3}, {1, 4}, {2, 1}, {2, 4}, {2, 5},
+				{3, 6}, {3, 7}, {4, 12}, {5, 8}, {6, 9}, {7, 9}, {7, 10},
+				{8, 5}, {8, 11}, {9, 11}, {10, 9}, {11, 0}, {11, 9}, {12, 8},
+			},
+			idom: []int32{0, 0, 0, 0, 0, 0, 3, 3, 0, 0, 7, 0, 4},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			g := newTestGraph(test.n, test.edges)
+			idom := g.dominators()
+			if !reflect.DeepEqual(idom, test.idom) {
+				t.Errorf("idom = %v, want %v", idom, test.idom)
+			}
+			if test.sizes == nil {
+				return
+			}
+			retained := append([]uint64{}, test.sizes...)
+			g.sumDominated(idom, retained)
+			if !reflect.DeepEqual(retained, test.retained) {
+				t.Errorf("retained = %v, want %v", retained, test.retained)
+			}
+		})
+	}
+}
+
+// Checks the dominators of random graphs against the definition: d
+// dominates w if w can't be reached from node 0 without going through d.
+func TestDominatorsRandom(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	for iter := 0; iter < 200; iter++ {
+		n := 2 + rnd.Intn(30)
+		edges := make([][2]int32, 0)
+		for i := 0; i < n*2; i++ {
+			edges = append(edges, [2]int32{int32(rnd.Intn(n)), int32(rnd.Intn(n))})
+		}
+		g := newTestGraph(n, edges)
+		idom := g.dominators()
+
+		reachable := reachableWithout(g, noNode)
+		for w := 1; w < n; w++ {
+			if !reachable[w] {
+				if idom[w] != noNode {
+					t.Fatalf("graph %v: unreachable node %d has idom %d", edges, w, idom[w])
+				}
+				continue
+			}
+			// The immediate dominator is the dominator that every
+			// other (strict) dominator dominates, i.e., the closest.
+			dominators := make([]int32, 0)
+			for d := int32(0); d < int32(n); d++ {
+				if int(d) != w && (d == 0 || !reachableWithout(g, d)[w]) {
+					dominators = append(dominators, d)
+				}
+			}
+			want := dominators[0]
+			for _, d := range dominators {
+				if !reachableWithout(g, want)[d] {
+					want = d
+				}
+			}
+			if idom[w] != want {
+				t.Fatalf("graph %v: idom[%d] = %d, want %d", edges, w, idom[w], want)
+			}
+		}
+	}
+}
+
+// Returns the nodes that can be reached from node 0 without passing
+// through the indicated node.
+func reachableWithout(g *graph, skip int32) []bool {
+	seen := make([]bool, g.size())
+	if skip == 0 {
+		return seen
+	}
+	seen[0] = true
+	stack := []int32{0}
+	for len(stack) > 0 {
+		v := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		for _, w := range g.targets[g.offsets[v]:g.offsets[v+1]] {
+			if w != skip && !seen[w] {
+				seen[w] = true
+				stack = append(stack, w)
+			}
+		}
+	}
+	return seen
+}
+
+// Pending defers and panics keep what they point to alive, and belong
+// to their goroutine, just like its stack frames.
+func TestDeferAndPanicRoots(t *testing.T) {
+	p := &heapdump.DumpParams{PointerSize: 8}
+	word := func(v uint64) []byte {
+		b := make([]byte, 8)
+		binary.LittleEndian.PutUint64(b, v)
+		return b
+	}
+	closure := &heapdump.Object{Address: 0x1000, Contents: make([]byte, 16)}
+	arg := &heapdump.Object{Address: 0x2000, Contents: make([]byte, 32)}
+	frame := &heapdump.StackFrame{}
+	d := &heapdump.DeferRecord{Address: 0x9000, Contents: word(closure.Address), Fields: []uint64{0}}
+	panicking := &heapdump.PanicRecord{Address: 0x9100, Contents: word(arg.Address), Fields: []uint64{0}}
+	g := &heapdump.Goroutine{
+		Frames: []*heapdump.StackFrame{frame},
+		Defers: []*heapdump.DeferRecord{d},
+		Panics: []*heapdump.PanicRecord{panicking},
+	}
+	c := &TreeClimber{
+		params:  p,
+		records: []heapdump.Record{g, frame, d, panicking, closure, arg},
+		objects: []*heapdump.Object{closure, arg},
+		memory:  make(map[uint64]heapdump.Record),
+	}
+
+	for _, record := range []heapdump.Record{d, panicking} {
+		if k := categoryOf(record); k != stackRoots {
+			t.Errorf("categoryOf(%T) = %v; want %v", record, k, stackRoots)
+		}
+	}
+	r := c.getRetention()
+	if len(r.goroutines) != 1 {
+		t.Fatalf("%d goroutines; want 1", len(r.goroutines))
+	}
+	bytes, count := r.goroutineRetained(0)
+	if bytes != 48 || count != 2 {
+		t.Errorf("goroutineRetained() = %d bytes in %d objects; want 48 bytes in 2 objects", bytes, count)
+	}
+}
@@ -0,0 +1,238 @@
+package treeclimber
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/adamroach/heapspurs/pkg/heapdump"
+)
+
+// The kinds of roots that keep the heap alive.
+type rootCategory int
+
+const (
+	stackRoots rootCategory = iota
+	globalRoots
+	finalizerRoots
+	otherRoots
+	rootCategories
+)
+
+// The number of roots we list in each category.
+const rootsMaxListed = 10
+
+func (k rootCategory) String() string {
+	switch k {
+	case stackRoots:
+		return "goroutine stacks"
+	case globalRoots:
+		return "globals"
+	case finalizerRoots:
+		return "finalizers"
+	case otherRoots:
+		return "other roots"
+	}
+	return fmt.Sprintf("rootCategory(%d)", int(k))
+}
+
+func (k rootCategory) title() string {
+	switch k {
+	case stackRoots:
+		return "Goroutine"
+	case globalRoots:
+		return "Global"
+	case finalizerRoots:
+		return "Finalizer"
+	}
+	return "Other Root"
+}
+
+func categoryOf(root heapdump.Record) rootCategory {
+	switch root.(type) {
+	case *heapdump.StackFrame, *heapdump.DeferRecord, *heapdump.PanicRecord:
+		return stackRoots
+	case *heapdump.Global, *heapdump.DataSegment, *heapdump.BssSegment:
+		return globalRoots
+	case *heapdump.RegisteredFinalizer, *heapdump.QueuedFinalizer:
+		return finalizerRoots
+	}
+	return otherRoots
+}
+
+// Splits the reachable heap up by the kinds of roots that can reach it:
+// goroutine stacks, globals, finalizers, and the runtime's other roots.
+// Memory that more than one kind of root can reach is counted
+// separately, under each combination. Then, within each kind, the roots
+// that retain the most memory on their own are listed, along with what
+// is only reachable from several of them at once. This is the quickest
+// way to tell whether a heap is dominated by global caches or by
+// in-flight work.
+func (c *TreeClimber) PrintRoots() error {
+	r := c.getRetention()
+	if len(r.roots) == 0 {
+		fmt.Printf("No roots found\n")
+		return nil
+	}
+
+	// Mark every object with the kinds of roots that reach it.
+	reachedBy := make([]uint8, r.objects)
+	for k := rootCategory(0); k < rootCategories; k++ {
+		start := make([]int32, 0)
+		for i, root := range r.roots {
+			if categoryOf(root) == k {
+				start = append(start, int32(1+i))
+			}
+		}
+		c.visitReachable(start, func(i int) {
+			reachedBy[i] |= 1 << k
+		})
+	}
+
+	type total struct {
+		bytes   uint64
+		objects uint64
+	}
+	byMask := make(map[uint8]*total)
+	reachable, unreachable := total{}, total{}
+	for i, o := range c.objects {
+		size := uint64(len(o.Contents))
+		mask := reachedBy[i]
+		if mask == 0 {
+			unreachable.bytes += size
+			unreachable.objects++
+			continue
+		}
+		reachable.bytes += size
+		reachable.objects++
+		if byMask[mask] == nil {
+			byMask[mask] = &total{}
+		}
+		byMask[mask].bytes += size
+		byMask[mask].objects++
+	}
+
+	masks := make([]uint8, 0, len(byMask))
+	for mask := range byMask {
+		masks = append(masks, mask)
+	}
+	sort.Slice(masks, func(i, j int) bool {
+		if byMask[masks[i]].bytes != byMask[masks[j]].bytes {
+			return byMask[masks[i]].bytes > byMask[masks[j]].bytes
+		}
+		return masks[i] < masks[j]
+	})
+	fmt.Printf("%s in %d objects reachable from roots", unitize(reachable.bytes), reachable.objects)
+	if unreachable.objects > 0 {
+		fmt.Printf(" (and %s in %d objects that nothing reaches)", unitize(unreachable.bytes), unreachable.objects)
+	}
+	fmt.Printf("\n\n%12s %10s  %s\n", "Bytes", "Objects", "Reachable From")
+	for _, mask := range masks {
+		fmt.Printf("%12s %10d  %s\n", unitize(byMask[mask].bytes), byMask[mask].objects, maskLabel(mask))
+	}
+
+	for k := rootCategory(0); k < rootCategories; k++ {
+		only := byMask[1<<k]
+		if only == nil {
+			continue
+		}
+		c.printCategoryRoots(r, k, only.bytes, only.objects)
+	}
+	return nil
+}
+
+// Describes a set of root categories, e.g. "goroutine stacks only" or
+// "globals and finalizers".
+func maskLabel(mask uint8) string {
+	names := make([]string, 0)
+	for k := rootCategory(0); k < rootCategories; k++ {
+		if mask&(1<<k) != 0 {
+			names = append(names, k.String())
+		}
+	}
+	if len(names) == 1 {
+		return names[0] + " only"
+	}
+	return strings.Join(names[:len(names)-1], ", ") + " and " + names[len(names)-1]
+}
+
+// Lists the roots of one kind that retain the most memory on their own,
+// followed by whatever is reachable only from that kind of root, but
+// from more than one of them.
+func (c *TreeClimber) printCategoryRoots(r *retention, k rootCategory, bytes uint64, objects uint64) {
+	type entry struct {
+		label   string
+		bytes   uint64
+		objects uint64
+	}
+	entries := make([]*entry, 0)
+	if k == stackRoots {
+		for i, g := range r.goroutines {
+			b, count := r.goroutineRetained(i)
+			entries = append(entries, &entry{goroutineLabel(g), b, count})
+		}
+	} else {
+		// Other roots are only described, so we add up the roots with
+		// the same description.
+		labels := make(map[string]*entry)
+		for i, root := range r.roots {
+			if categoryOf(root) != k {
+				continue
+			}
+			b, count := r.rootRetained(i)
+			label := c.rootLabel(root)
+			if labels[label] == nil {
+				labels[label] = &entry{label: label}
+				entries = append(entries, labels[label])
+			}
+			labels[label].bytes += b
+			labels[label].objects += count
+		}
+	}
+	retaining := make([]*entry, 0, len(entries))
+	retained, retainedObjects := uint64(0), uint64(0)
+	for _, e := range entries {
+		if e.objects > 0 {
+			retaining = append(retaining, e)
+			retained += e.bytes
+			retainedObjects += e.objects
+		}
+	}
+	sort.SliceStable(retaining, func(i, j int) bool {
+		return retaining[i].bytes > retaining[j].bytes
+	})
+
+	fmt.Printf("\n%12s %10s  %s\n", "Retained", "Objects", k.title())
+	for i, e := range retaining {
+		if i == rootsMaxListed {
+			rest, restObjects := uint64(0), uint64(0)
+			for _, e := range retaining[i:] {
+				rest += e.bytes
+				restObjects += e.objects
+			}
+			fmt.Printf("%12s %10d  (%d more)\n", unitize(rest), restObjects, len(retaining)-i)
+			break
+		}
+		fmt.Printf("%12s %10d  %s\n", unitize(e.bytes), e.objects, e.label)
+	}
+	if objects > retainedObjects {
+		fmt.Printf("%12s %10d  (shared by several of them)\n", unitize(bytes-retained), objects-retainedObjects)
+	}
+}
+
+// Describes a root other than a stack frame.
+func (c *TreeClimber) rootLabel(root heapdump.Record) string {
+	switch r := root.(type) {
+	case *heapdump.Global:
+		return fmt.Sprintf("%s (%s)", r.Name, heapdump.SegmentName(r.Segment))
+	case *heapdump.DataSegment, *heapdump.BssSegment:
+		return heapdump.SegmentName(r.(heapdump.Addressable))
+	case *heapdump.RegisteredFinalizer:
+		return fmt.Sprintf("%s on %s", c.finalizerLabel(r), c.dump.GetName(r.ObjectAddress))
+	case *heapdump.QueuedFinalizer:
+		return fmt.Sprintf("%s on %s", c.finalizerLabel(r), c.dump.GetName(r.ObjectAddress))
+	case *heapdump.OtherRoot:
+		return r.Description
+	}
+	return fmt.Sprintf("%T", root)
+}
@@ -0,0 +1,228 @@
+package treeclimber
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/adamroach/heapspurs/pkg/heapdump"
+)
+
+// The upper bounds of the buckets in the GC pause histogram; anything
+// longer goes in a last, open-ended bucket.
+var pauseBuckets = []time.Duration{
+	10 * time.Microsecond,
+	25 * time.Microsecond,
+	50 * time.Microsecond,
+	100 * time.Microsecond,
+	250 * time.Microsecond,
+	500 * time.Microsecond,
+	time.Millisecond,
+	2500 * time.Microsecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+}
+
+const (
+	pauseBarWidth     = 40
+	statsTolerancePct = 1 // how far the dump can be from MemStats before we point it out
+
+	// Objects this small are allocated from single-page spans, which
+	// keep their pointer bitmap in their last few bytes if they have
+	// pointers (since Go 1.22).
+	smallObjectSpan    = 8192
+	smallObjectMaxSize = 512
+
+	// Allocations smaller than this without pointers can share a block
+	// of this size with each other.
+	tinyBlockSize = 16
+)
+
+// Prints the runtime's memory statistics as of the dump, and then
+// checks them against what's actually in the dump. The runtime's
+// numbers cover things that the dump doesn't show, so differences
+// aren't necessarily a problem, but large ones are worth knowing about.
+func (c *TreeClimber) PrintStats() error {
+	var m *heapdump.MemStats
+	for _, record := range c.records {
+		if r, isStats := record.(*heapdump.MemStats); isStats {
+			m = r
+		}
+	}
+	if m == nil {
+		fmt.Printf("No MemStats record found\n")
+		return nil
+	}
+
+	fmt.Printf("Memory\n")
+	line := func(bytes uint64, format string, args ...any) {
+		fmt.Printf("%12s  %s\n", unitize(bytes), fmt.Sprintf(format, args...))
+	}
+	line(m.HeapAlloc, "Heap allocated (HeapAlloc), in %d objects", m.HeapObjects)
+	line(m.HeapInuse, "Heap in use (HeapInuse)")
+	line(m.HeapIdle, "Heap idle (HeapIdle)")
+	line(m.HeapReleased, "Heap returned to the OS (HeapReleased)")
+	line(m.HeapSys, "Heap obtained from the OS (HeapSys)")
+	line(m.StackInuse, "Stacks in use (StackInuse)")
+	line(m.MSpanInuse+m.MCacheInuse, "Runtime structures in use (MSpanInuse, MCacheInuse)")
+	line(m.GCSys+m.BuckHashSys+m.OtherSys, "Other runtime metadata (GCSys, BuckHashSys, OtherSys)")
+	line(m.Sys, "Total obtained from the OS (Sys)")
+	line(m.TotalAlloc, "Allocated since the program started (TotalAlloc), in %d objects", m.Mallocs)
+	line(m.NextGC, "Heap size that triggers the next collection (NextGC)")
+
+	fmt.Printf("\nGarbage Collection\n")
+	fmt.Printf("  %d collections", m.NumGC)
+	if m.NumGC > 0 {
+		fmt.Printf(", the last at %s", time.Unix(0, int64(m.LastGC)).UTC().Format(time.RFC3339))
+		fmt.Printf(", pausing for %s in all", time.Duration(m.PauseTotalNs))
+	}
+	fmt.Println()
+	printPauses(m.Pauses())
+
+	c.reconcileStats(m)
+	return nil
+}
+
+// Prints percentiles and a histogram of GC pauses.
+func printPauses(pauses []uint64) {
+	if len(pauses) == 0 {
+		return
+	}
+	sorted := append([]uint64{}, pauses...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i] < sorted[j]
+	})
+	percentile := func(pct int) time.Duration {
+		i := (len(sorted)*pct + 99) / 100
+		return time.Duration(sorted[max(i-1, 0)])
+	}
+	fmt.Printf("  Last %d pauses: median %s, 90th percentile %s, 99th percentile %s, longest %s\n",
+		len(sorted), percentile(50), percentile(90), percentile(99), time.Duration(sorted[len(sorted)-1]))
+
+	counts := make([]int, len(pauseBuckets)+1)
+	for _, pause := range pauses {
+		i := sort.Search(len(pauseBuckets), func(i int) bool {
+			return time.Duration(pause) <= pauseBuckets[i]
+		})
+		counts[i]++
+	}
+	first, last, most := len(counts), 0, 0
+	for i, count := range counts {
+		if count > 0 {
+			first, last = min(first, i), i
+			most = max(most, count)
+		}
+	}
+	fmt.Printf("\n%12s %10s\n", "Pause", "Count")
+	for i := first; i <= last; i++ {
+		label := fmt.Sprintf("> %s", pauseBuckets[len(pauseBuckets)-1])
+		if i < len(pauseBuckets) {
+			label = fmt.Sprintf("<= %s", pauseBuckets[i])
+		}
+		bar := strings.Repeat("#", (counts[i]*pauseBarWidth+most-1)/most)
+		fmt.Printf("%12s %10d  %s\n", label, counts[i], bar)
+	}
+}
+
+// Compares MemStats with the objects and stacks in the dump.
+func (c *TreeClimber) reconcileStats(m *heapdump.MemStats) {
+	// Spans of small objects take up a page each, and a span's objects
+	// either all have pointers, or none of them do.
+	scanSpans := make(map[uint64]bool)
+	for _, o := range c.objects {
+		if len(o.Contents) <= smallObjectMaxSize && len(o.Fields) > 0 {
+			scanSpans[o.Address/smallObjectSpan] = true
+		}
+	}
+	// The bitmaps aren't really objects, so they're left out of the
+	// comparison.
+	objects, objectBytes, bitmaps, bitmapBytes, tinyBlocks := uint64(0), uint64(0), uint64(0), uint64(0), 0
+	for _, o := range c.objects {
+		switch {
+		case scanSpans[o.Address/smallObjectSpan] && c.inSpanBitmap(o):
+			bitmaps++
+			bitmapBytes += uint64(len(o.Contents))
+			continue
+		case len(o.Contents) <= tinyBlockSize && len(o.Fields) == 0:
+			tinyBlocks++
+		}
+		objects++
+		objectBytes += uint64(len(o.Contents))
+	}
+	goroutines, stackBytes, frameBytes, known := 0, uint64(0), uint64(0), true
+	for _, record := range c.records {
+		switch r := record.(type) {
+		case *heapdump.Goroutine:
+			goroutines++
+			stackBytes += r.StackSize
+			known = known && r.StackSize > 0
+		case *heapdump.StackFrame:
+			frameBytes += uint64(len(r.Contents))
+		}
+	}
+
+	fmt.Printf("\nCompared With the Dump\n")
+	fmt.Printf("%12s %12s %12s\n", "MemStats", "Dump", "Difference")
+	compare := func(stat uint64, dump uint64, format func(uint64) string, label string) {
+		diff := int64(dump) - int64(stat)
+		sign := "+"
+		if diff < 0 {
+			sign = "-"
+			diff = -diff
+		}
+		flag := ""
+		if uint64(diff)*100 > stat*statsTolerancePct {
+			flag = " (!)"
+		}
+		fmt.Printf("%12s %12s %12s  %s%s\n", format(stat), format(dump), sign+format(uint64(diff)), label, flag)
+	}
+	count := func(x uint64) string {
+		return fmt.Sprintf("%d", x)
+	}
+	compare(m.HeapObjects, objects, count, "Heap objects (HeapObjects)")
+	compare(m.HeapAlloc, objectBytes, unitize, "Heap bytes (HeapAlloc)")
+	if known {
+		compare(m.StackInuse, stackBytes, unitize, fmt.Sprintf("Stack bytes (StackInuse), in %d goroutines", goroutines))
+	} else {
+		compare(m.StackInuse, frameBytes, unitize, fmt.Sprintf("Stack bytes (StackInuse), in the frames of %d goroutines", goroutines))
+	}
+
+	fmt.Println()
+	switch {
+	case objectBytes < m.HeapAlloc:
+		fmt.Printf("%s of allocated heap isn't in any object in the dump.\n", unitize(m.HeapAlloc-objectBytes))
+	case objectBytes > m.HeapAlloc:
+		fmt.Printf("The dump's objects take up %s more than the allocated heap.\n", unitize(objectBytes-m.HeapAlloc))
+	}
+	if bitmaps > 0 {
+		fmt.Printf("The dump also has %d objects (%s) that are really the pointer bitmaps at the ends of spans of small objects, which the runtime dumps as if they were objects; they're left out above.\n",
+			bitmaps, unitize(bitmapBytes))
+	}
+	if m.HeapObjects > objects && tinyBlocks > 0 {
+		fmt.Printf("Some of the missing objects may be small allocations without pointers, which the runtime can combine into shared %d-byte blocks that the dump lists as one object each; the dump has %d objects that could be such blocks.\n",
+			tinyBlockSize, tinyBlocks)
+	}
+	if known && stackBytes < m.StackInuse {
+		fmt.Printf("%s of stack belongs to no goroutine in the dump: threads' system and signal stacks, and stacks kept for reuse by goroutines that have exited.\n",
+			unitize(m.StackInuse-stackBytes))
+	} else if !known {
+		fmt.Printf("Without the layout of runtime.g (from --program), only the stack that goroutines' frames take up is counted, not what's set aside for them.\n")
+	}
+}
+
+// Reports whether a small object lies where its span would keep the
+// pointer bitmap for the objects in it, if they have pointers. The
+// runtime dumps every slot in a span, including those.
+func (c *TreeClimber) inSpanBitmap(o *heapdump.Object) bool {
+	size := uint64(len(o.Contents))
+	if size == 0 || size > smallObjectMaxSize {
+		return false
+	}
+	bitmap := smallObjectSpan / (8 * c.params.PointerSize)
+	slots := (smallObjectSpan - bitmap) / size
+	return (o.Address%smallObjectSpan)/size >= slots
+}
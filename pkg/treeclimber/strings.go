@@ -0,0 +1,90 @@
+package treeclimber
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/adamroach/heapspurs/pkg/heapdump"
+)
+
+// Prints every string header that points into the heap, grouped by the
+// string it refers to, along with the owners that hold it.
+func (c *TreeClimber) PrintStrings() error {
+	type key struct {
+		data   uint64
+		length uint64
+	}
+	type entry struct {
+		header heapdump.DataHeader
+		owners []string
+	}
+	entries := make(map[key]*entry)
+	for _, record := range c.memory {
+		o, isOwner := record.(heapdump.Owner)
+		if !isOwner {
+			continue
+		}
+		for _, offset := range o.GetFields() {
+			h, isHeader := c.dump.FindHeader(o, offset, c.params)
+			if !isHeader || h.Kind != heapdump.StringHeader || c.dump.FindObject(h.Data) == nil {
+				continue
+			}
+			k := key{h.Data, h.Len}
+			e, found := entries[k]
+			if !found {
+				e = &entry{header: h}
+				entries[k] = e
+			}
+			e.owners = append(e.owners, ownerLabel(record, offset))
+		}
+	}
+	if len(entries) == 0 {
+		fmt.Printf("No strings found\n")
+		return nil
+	}
+
+	sorted := make([]*entry, 0, len(entries))
+	for _, e := range entries {
+		sort.Strings(e.owners)
+		sorted = append(sorted, e)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].header.Data != sorted[j].header.Data {
+			return sorted[i].header.Data < sorted[j].header.Data
+		}
+		return sorted[i].header.Len < sorted[j].header.Len
+	})
+	for _, e := range sorted {
+		fmt.Printf("0x%x %s\n", e.header.Data, e.header)
+		for _, owner := range e.owners {
+			fmt.Printf("  %s\n", owner)
+		}
+	}
+	return nil
+}
+
+// Describes a pointer slot briefly: what holds it, and which field.
+func ownerLabel(record heapdump.Record, offset uint64) string {
+	a := record.(heapdump.Addressable)
+	var label string
+	switch r := record.(type) {
+	case *heapdump.Object:
+		label = fmt.Sprintf("%s @ 0x%x", r.GetName(), r.Address)
+	case *heapdump.Global:
+		label = fmt.Sprintf("%s (%s)", r.Name, heapdump.SegmentName(r.Segment))
+		if name := r.FieldName(offset); len(name) > 0 && name != r.Name {
+			label = fmt.Sprintf("%s (%s)", name, heapdump.SegmentName(r.Segment))
+		}
+		return label
+	case *heapdump.StackFrame:
+		label = fmt.Sprintf("StackFrame[%d] %s @ 0x%x", r.Depth, r.Name, r.Address)
+	default:
+		label = fmt.Sprintf("%s @ 0x%x", heapdump.SegmentName(a), a.GetAddress())
+	}
+	if f, hasFields := record.(heapdump.FieldNamer); hasFields {
+		if name := f.FieldName(offset); len(name) > 0 {
+			return fmt.Sprintf("%s (%s)", label, name)
+		}
+	}
+	return fmt.Sprintf("%s +0x%x", label, offset)
+}
@@ -0,0 +1,144 @@
+package treeclimber
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/adamroach/heapspurs/pkg/heapdump"
+)
+
+// Lists every OS thread, with its runtime.m and the goroutine running on
+// it, followed by the goroutines that are in system calls, grouped by
+// identical stacks. Each goroutine in a system call (or a cgo call) has
+// a thread to itself, so that's usually where a growing thread count
+// comes from.
+func (c *TreeClimber) PrintThreads() error {
+	threads := make([]*heapdump.OsThread, 0)
+	for _, record := range c.records {
+		if t, isThread := record.(*heapdump.OsThread); isThread {
+			threads = append(threads, t)
+		}
+	}
+	if len(threads) == 0 {
+		fmt.Printf("No OS threads found\n")
+		return nil
+	}
+	sort.SliceStable(threads, func(i, j int) bool {
+		return threads[i].GoId < threads[j].GoId
+	})
+
+	goroutines := make(map[uint64]*heapdump.Goroutine)
+	for _, record := range c.records {
+		if g, isGoroutine := record.(*heapdump.Goroutine); isGoroutine {
+			goroutines[g.Address] = g
+		}
+	}
+	syscalls := make([]*goroutineGroup, 0)
+	inSyscall, inCgo := 0, 0
+	for _, group := range c.goroutineGroups() {
+		if group.goroutines[0].Status == heapdump.Syscall {
+			syscalls = append(syscalls, group)
+			inSyscall += len(group.goroutines)
+		}
+	}
+	for _, t := range threads {
+		if t.InCgo {
+			inCgo++
+		}
+	}
+	fmt.Printf("%d OS threads, %d goroutines in system calls", len(threads), inSyscall)
+	if inCgo > 0 {
+		fmt.Printf(", %d threads in cgo calls", inCgo)
+	}
+	fmt.Println()
+
+	fmt.Printf("\n%6s %10s  %s\n", "M", "OS Thread", "Runtime M / Goroutine")
+	for _, t := range threads {
+		fmt.Printf("%6d %10d  %s\n", t.GoId, t.OsId, c.threadLabel(t, goroutines))
+		if g := t.Goroutine; g != nil {
+			s := fmt.Sprintf("Goroutine[%d] %s", g.RoutineId, goroutineState(g))
+			if f := topFunction(g); len(f) > 0 {
+				s += " in " + f
+			}
+			if wait, known := g.WaitTime(); known {
+				s += fmt.Sprintf(", for %s", formatDuration(wait))
+			}
+			fmt.Printf("%19s-> %s\n", "", s)
+		}
+	}
+
+	if len(syscalls) > 0 {
+		fmt.Printf("\nGoroutines in system calls:\n")
+	}
+	for _, group := range syscalls {
+		fmt.Printf("\n%d: %s", len(group.goroutines), goroutineState(group.goroutines[0]))
+		if group.waits > 0 {
+			fmt.Printf(", for %s", formatDuration(group.minWait))
+			if group.maxWait != group.minWait {
+				fmt.Printf(" to %s", formatDuration(group.maxWait))
+			}
+		}
+		fmt.Println()
+		fmt.Printf("    Goroutines: %s\n", goroutineIds(group.goroutines))
+		fmt.Printf("    Threads: %s\n", threadIds(group.goroutines))
+		for _, line := range strings.Split(c.goroutineStack(group.goroutines[0], "\n"), "\n") {
+			fmt.Printf("    %s\n", line)
+		}
+	}
+	c.noteWaitTimes()
+	return nil
+}
+
+// Describes a thread by its runtime.m, and what that says about it.
+func (c *TreeClimber) threadLabel(t *heapdump.OsThread, goroutines map[uint64]*heapdump.Goroutine) string {
+	var s string
+	switch {
+	case t.M != nil:
+		s = fmt.Sprintf("%s @ 0x%x (%s)", t.M.GetName(), t.M.Address, unitize(uint64(len(t.M.Contents))))
+	case len(c.dump.GetName(t.ThreadDescriptorAddress)) > 0:
+		s = fmt.Sprintf("%s @ 0x%x", c.dump.GetName(t.ThreadDescriptorAddress), t.ThreadDescriptorAddress)
+	default:
+		s = fmt.Sprintf("0x%x (not in the heap)", t.ThreadDescriptorAddress)
+	}
+	if !t.Described {
+		return s
+	}
+	flags := make([]string, 0)
+	if t.HasP {
+		flags = append(flags, "has P")
+	}
+	if t.LockedTo != 0 {
+		locked := fmt.Sprintf("goroutine 0x%x", t.LockedTo)
+		if g, found := goroutines[t.LockedTo]; found {
+			locked = fmt.Sprintf("Goroutine[%d]", g.RoutineId)
+		}
+		flags = append(flags, "locked to "+locked)
+	}
+	if t.InCgo {
+		flags = append(flags, "in cgo")
+	}
+	if t.CgoCalls > 0 {
+		flags = append(flags, fmt.Sprintf("%d cgo calls", t.CgoCalls))
+	}
+	if len(flags) > 0 {
+		s += " [" + strings.Join(flags, ", ") + "]"
+	}
+	return s
+}
+
+func threadIds(goroutines []*heapdump.Goroutine) string {
+	ids := make([]string, 0, goroutinesMaxIds+1)
+	for i, g := range goroutines {
+		if i == goroutinesMaxIds {
+			ids = append(ids, fmt.Sprintf("... (%d more)", len(goroutines)-goroutinesMaxIds))
+			break
+		}
+		if g.Thread == nil {
+			ids = append(ids, "?")
+			continue
+		}
+		ids = append(ids, fmt.Sprintf("%d", g.Thread.OsId))
+	}
+	return strings.Join(ids, " ")
+}
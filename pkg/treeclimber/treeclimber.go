@@ -6,6 +6,7 @@ import (
 	"encoding/hex"
 	"fmt"
 	"io"
+	"sort"
 	"strings"
 
 	"github.com/adamroach/heapspurs/pkg/heapdump"
@@ -14,15 +15,19 @@ import (
 )
 
 type TreeClimber struct {
+	dump       *heapdump.Dump
 	params     *heapdump.DumpParams
+	records    []heapdump.Record            // All records, in the order they appear in the dump
+	objects    []*heapdump.Object           // All objects, sorted by address
+	retention  *retention                   // Which roots keep which objects alive; computed on demand
 	memory     map[uint64]heapdump.Record   // Map of all records that represet an in-memory construct
 	owners     map[uint64][]heapdump.Record // Maps from pointed-to objects to the thing(s) pointing to them
 	visited    map[uint64]bool              // Temporary state used to keep track of already-visited nodes during graph traversal
 	finalizers map[uint64]heapdump.Record   // Map of object address to its finalizer (if any)
 }
 
-func NewTreeClimber(reader *bufio.Reader) (*TreeClimber, error) {
-	c := &TreeClimber{}
+func NewTreeClimber(dump *heapdump.Dump, reader *bufio.Reader) (*TreeClimber, error) {
+	c := &TreeClimber{dump: dump}
 	err := c.build(reader)
 	return c, err
 }
@@ -39,12 +44,19 @@ func (c *TreeClimber) PrintOwners(address uint64, depth int) error {
 func (c *TreeClimber) PrintAnchors(address uint64) error {
 	c.visited = make(map[uint64]bool)
 	defer func() { c.visited = nil }()
-	return c.printAnchors(address)
+	return c.printAnchors(address, 0)
 }
 
 func (c *TreeClimber) Hexdump(address uint64) (string, error) {
 	r, found := c.memory[address]
+	switch seg := r.(type) {
+	case *heapdump.DataSegment, *heapdump.BssSegment:
+		r = c.segmentPage(seg.(heapdump.Owner), address)
+	}
 	if !found {
+		r = c.findContaining(address)
+	}
+	if r == nil {
 		return "", fmt.Errorf("Cound not find record for address 0x%x", address)
 	}
 
@@ -53,10 +65,23 @@ func (c *TreeClimber) Hexdump(address uint64) (string, error) {
 		return "", fmt.Errorf("Object of type %T does not have Contents", r)
 	}
 
-	ret := hex.Dump(o.GetContents())
+	ret := ""
+	if s, canString := r.(fmt.Stringer); canString {
+		ret = s.String() + "\n"
+	}
+	ret = ret + hex.Dump(o.GetContents())
+
+	pointers := heapdump.GetPointers(o, c.params)
+	for i, field := range o.GetFields() {
+		description := c.describePointer(pointers[i])
+		if h, isHeader := c.dump.FindHeader(o, field, c.params); isHeader {
+			description = c.pointerTarget(pointers[i]) + " " + h.String()
+		}
+		ret = ret + fmt.Sprintf("Pointer: 0x%x = %s\n", field, description)
+	}
 
-	for _, field := range o.GetFields() {
-		ret = ret + fmt.Sprintf("Pointer: 0x%x\n", field)
+	if g, isGlobal := r.(*heapdump.Global); isGlobal {
+		ret = ret + c.segmentNavigation(g)
 	}
 
 	return ret, nil
@@ -108,7 +133,6 @@ func unitize(x uint64) string {
 	default:
 		return fmt.Sprintf("%.2f TiB", float64(x)/(1024*1024*1024*1024))
 	}
-	return ""
 }
 
 // There are four owner types in a heap dump:
@@ -116,6 +140,7 @@ func unitize(x uint64) string {
 // StackFrame
 // BssSegment
 // DataSegment
+// When we have symbols, the segments are further broken down into Globals.
 func (c *TreeClimber) addNode(graph *cgraph.Graph, address uint64, spotlight bool) *cgraph.Node {
 	record, found := c.memory[address]
 	if !found {
@@ -129,6 +154,11 @@ func (c *TreeClimber) addNode(graph *cgraph.Graph, address uint64, spotlight boo
 		return node
 	}
 
+	// The objects that make up a map are drawn as a single node.
+	if o, isObject := record.(*heapdump.Object); isObject && o.Map != nil && o.Map.Header != o {
+		return c.addNode(graph, o.Map.Header.Address, spotlight)
+	}
+
 	if c.visited[address] {
 		node, _ := graph.NodeByName(fmt.Sprintf("0x%x", address))
 		return node
@@ -141,12 +171,21 @@ func (c *TreeClimber) addNode(graph *cgraph.Graph, address uint64, spotlight boo
 	switch r := record.(type) {
 	case *heapdump.Object:
 		name := r.GetName()
-		if name != "Object" {
+		if len(r.Name) > 0 {
 			node.SetFontColor("#008000")
 		}
 		label := fmt.Sprintf("%s (%s)\n0x%x", name, unitize(uint64(len(r.Contents))), address)
+		if r.Map != nil {
+			label = fmt.Sprintf("%s (%s in %d objects)\n0x%x\n%d entries", name, unitize(r.Map.Bytes), len(r.Map.Objects), address, r.Map.Entries)
+			if r.Map.Wasted > 0 {
+				label += fmt.Sprintf(", %s wasted", unitize(r.Map.Wasted))
+			}
+		}
+		if r.Chan != nil && r.Chan.Header == r {
+			label += fmt.Sprintf("\ncap %d, %d buffered\n%d goroutines waiting", r.Chan.Capacity, r.Chan.Count, len(r.Chan.Waiters))
+		}
 		if finalizer != nil {
-			label += fmt.Sprintf("\n%T", finalizer)
+			label += "\n" + c.finalizerLabel(finalizer)
 			node.SetColor("red")
 			node.SetPenWidth(5)
 		}
@@ -156,26 +195,46 @@ func (c *TreeClimber) addNode(graph *cgraph.Graph, address uint64, spotlight boo
 		// Objects generally have owners; track them down and graph them.
 		// Because owners can point to subfields within an object, we need to scan
 		// for references anywhere inside the object.
+		// For maps, that means anywhere inside any of the map's objects.
 		foundOwner := false
-		end := uint64(len(r.Contents)) + address
-		for dest := address; dest < end; dest++ {
-			o, hasOwners := c.owners[dest]
-			if hasOwners {
-				for _, owner := range o {
-					a, isOwner := owner.(heapdump.Owner)
-					if isOwner {
-						foundOwner = true
-						on := c.addNode(graph, a.GetAddress(), false)
-						edge, _ := graph.CreateEdgeByName("", on, node)
-						if dest != address {
-							edge.SetHeadLabel(fmt.Sprintf("0x%x\n(offset = %d)", dest, dest-address))
-							edge.SetColor("red")
+		parts := []*heapdump.Object{r}
+		if r.Map != nil {
+			parts = r.Map.Objects
+		}
+		for _, part := range parts {
+			start := part.Address
+			end := uint64(len(part.Contents)) + start
+			for dest := start; dest < end; dest++ {
+				o, hasOwners := c.owners[dest]
+				if hasOwners {
+					for _, owner := range o {
+						a, isOwner := owner.(heapdump.Owner)
+						if member, isObject := owner.(*heapdump.Object); isObject && member.Map != nil && member.Map == r.Map {
+							continue
 						}
-						ps := heapdump.GetPointersSourceAddress(a, dest, c.params)
-						if ps != 0 {
-							name := heapdump.GetName(ps)
-							if name != "" {
-								edge.SetTailLabel(name)
+						if isOwner {
+							foundOwner = true
+							on := c.addNode(graph, a.GetAddress(), false)
+							edge, _ := graph.CreateEdgeByName("", on, node)
+							if dest != start {
+								edge.SetHeadLabel(fmt.Sprintf("0x%x\n(offset = %d)", dest, dest-start))
+								edge.SetColor("red")
+							}
+							ps := heapdump.GetPointersSourceAddress(a, dest, c.params)
+							if ps != 0 {
+								name := ""
+								if f, hasFields := owner.(heapdump.FieldNamer); hasFields {
+									name = f.FieldName(ps - a.GetAddress())
+								}
+								if name == "" {
+									name = c.dump.GetName(ps)
+								}
+								if h, isHeader := c.dump.FindHeader(a, ps-a.GetAddress(), c.params); isHeader {
+									name = strings.TrimSpace(name + "\n" + h.String())
+								}
+								if name != "" {
+									edge.SetTailLabel(name)
+								}
 							}
 						}
 					}
@@ -189,6 +248,19 @@ func (c *TreeClimber) addNode(graph *cgraph.Graph, address uint64, spotlight boo
 	case *heapdump.StackFrame:
 		node.SetLabel(fmt.Sprintf("StackFrame @ 0x%x\n%s", address, c.fullStack(address, "\\l")+"\\l"))
 		node.SetShape(cgraph.BoxShape)
+	case *heapdump.Global:
+		node.SetLabel(fmt.Sprintf("%s\n%s", r.Name, heapdump.SegmentName(r.Segment)))
+		if _, isBss := r.Segment.(*heapdump.BssSegment); isBss {
+			node.SetShape(cgraph.DoubleOctagonShape)
+		} else {
+			node.SetShape(cgraph.TripleOctagonShape)
+		}
+	case *heapdump.DeferRecord:
+		node.SetLabel(fmt.Sprintf("Defer @ 0x%x\n%s", address, c.deferDescription(r)))
+		node.SetShape(cgraph.BoxShape)
+	case *heapdump.PanicRecord:
+		node.SetLabel(fmt.Sprintf("Panic @ 0x%x\n%s", address, r.Arg))
+		node.SetShape(cgraph.BoxShape)
 	case *heapdump.BssSegment:
 		node.SetLabel("BssSegment")
 		node.SetShape(cgraph.DoubleOctagonShape)
@@ -207,6 +279,16 @@ func (c *TreeClimber) addNode(graph *cgraph.Graph, address uint64, spotlight boo
 	return node
 }
 
+func (c *TreeClimber) finalizerLabel(r heapdump.Record) string {
+	switch f := r.(type) {
+	case *heapdump.RegisteredFinalizer:
+		return fmt.Sprintf("Finalizer: %s", c.dump.Pc(f.FinalizerEntryPc))
+	case *heapdump.QueuedFinalizer:
+		return fmt.Sprintf("Queued Finalizer: %s", c.dump.Pc(f.FinalizerEntryPc))
+	}
+	return fmt.Sprintf("%T", r)
+}
+
 func (c *TreeClimber) fullStack(address uint64, separator string) string {
 	out := make([]string, 0)
 	framePtr := address
@@ -216,7 +298,11 @@ func (c *TreeClimber) fullStack(address uint64, separator string) string {
 		if !found {
 			break
 		}
-		out = append(out, fmt.Sprintf("[%d] %s", frame.Depth, frame.Name))
+		line := fmt.Sprintf("[%d] %s", frame.Depth, frame.Name)
+		if source := frame.Source(); len(source) > 0 {
+			line += " at " + source
+		}
+		out = append(out, line)
 		framePtr = frame.ChildPointer
 	}
 	return strings.Join(out, separator)
@@ -226,6 +312,10 @@ func (c *TreeClimber) printOwners(address uint64, depth int, prefix ...string) e
 	if depth == 0 {
 		return nil
 	}
+	// The objects that make up a map are shown as the map itself.
+	if m := c.mapOf(address); m != nil {
+		address = m.Header.Address
+	}
 	if c.visited[address] {
 		return nil
 		// return fmt.Errorf("Loop: already visited address 0x%x", address)
@@ -244,6 +334,9 @@ func (c *TreeClimber) printOwners(address uint64, depth int, prefix ...string) e
 	fmt.Printf("%s%s\n", indent, s.String())
 
 	o, found := c.owners[address]
+	if m := c.mapOf(address); m != nil {
+		o, found = c.mapOwners(m), true
+	}
 	if !found {
 		return nil
 	}
@@ -259,7 +352,9 @@ func (c *TreeClimber) printOwners(address uint64, depth int, prefix ...string) e
 	return nil
 }
 
-func (c *TreeClimber) printAnchors(address uint64) error {
+// Prints the anchors that keep an address alive. The kept address is
+// the one we came from, which the anchor points to.
+func (c *TreeClimber) printAnchors(address uint64, kept uint64) error {
 	if c.visited[address] {
 		return fmt.Errorf("Loop: already visited address 0x%x", address)
 	}
@@ -274,6 +369,12 @@ func (c *TreeClimber) printAnchors(address uint64) error {
 		fmt.Println(root.String())
 	case *heapdump.StackFrame:
 		fmt.Println(root.String())
+		sources, targets := heapdump.GetPointerInfo(root, c.params)
+		for i, target := range targets {
+			if v, found := root.Vars[sources[i]-root.Address]; found && target == kept {
+				fmt.Printf("  %s: %s keeps 0x%x alive\n", v.Function, v, kept)
+			}
+		}
 		childPtr := root.ChildPointer
 		for childPtr != 0 {
 			childRecord, found := c.memory[childPtr]
@@ -288,6 +389,8 @@ func (c *TreeClimber) printAnchors(address uint64) error {
 		fmt.Println(root.String())
 	case *heapdump.DataSegment:
 		fmt.Println(root.String())
+	case *heapdump.Global:
+		fmt.Println(root.String())
 	}
 
 	o, found := c.owners[address]
@@ -295,66 +398,131 @@ func (c *TreeClimber) printAnchors(address uint64) error {
 		return nil
 	}
 	for _, owner := range o {
+		switch r := owner.(type) {
+		case *heapdump.DeferRecord, *heapdump.PanicRecord:
+			// The runtime keeps these for as long as their goroutine
+			// runs, wherever they're stored.
+			fmt.Println(r)
+			continue
+		}
 		a, addressable := owner.(heapdump.Addressable)
 		if addressable {
-			c.printAnchors(a.GetAddress())
+			c.printAnchors(a.GetAddress(), address)
 		}
 	}
 	return nil
 }
 
 func (c *TreeClimber) build(reader *bufio.Reader) error {
-	err := heapdump.ReadHeader(reader)
+	records, params, err := c.dump.ReadRecords(reader)
 	if err != nil {
-		return fmt.Errorf("Reading header: %w\n", err)
+		return err
 	}
 
+	c.params = params
+	c.records = records
 	c.memory = make(map[uint64]heapdump.Record)
 	c.owners = make(map[uint64][]heapdump.Record)
 	c.finalizers = make(map[uint64]heapdump.Record)
 
-readloop:
-	for {
-		record, err := heapdump.ReadRecord(reader)
-		if err != nil {
-			return err
-		}
-
+	for _, record := range records {
 		switch r := record.(type) {
-		case *heapdump.Eof:
-			break readloop
-		case *heapdump.DumpParams:
-			c.params = r
 		case *heapdump.QueuedFinalizer:
 			c.finalizers[r.ObjectAddress] = r
 		case *heapdump.RegisteredFinalizer:
 			c.finalizers[r.ObjectAddress] = r
+		case *heapdump.Object:
+			c.objects = append(c.objects, r)
+		case *heapdump.DataSegment:
+			if c.addGlobals(r) {
+				continue
+			}
+		case *heapdump.BssSegment:
+			if c.addGlobals(r) {
+				continue
+			}
+		case *heapdump.DeferRecord, *heapdump.PanicRecord:
+			continue
 		}
+		c.addRecord(record)
+	}
 
-		a, isAddressable := record.(heapdump.Addressable)
-		if isAddressable {
-			c.memory[a.GetAddress()] = record
-		}
+	sort.Slice(c.objects, func(i, j int) bool {
+		return c.objects[i].Address < c.objects[j].Address
+	})
+
+	c.dump.InferTypes(records, c.params)
 
-		// Dump parameters isn't *defined* to come before other
-		// records; but in practice, it does. If this changes,
-		// we may need to move the construction of owner pointers
-		// to after we read all of the records in the file.
-		o, isOwner := record.(heapdump.Owner)
-		if isOwner {
-			pointers := heapdump.GetPointers(o, c.params)
-			for i := 0; i < len(pointers); i++ {
-				if pointers[i] != 0 {
-					c.addOwner(pointers[i], record)
+	// Defer and panic records only point to their closures and panic
+	// arguments once InferTypes has linked them. Deferred calls can also
+	// live in heap objects at the same address, which we'd rather keep.
+	for _, record := range records {
+		switch r := record.(type) {
+		case *heapdump.DeferRecord, *heapdump.PanicRecord:
+			o := r.(heapdump.Owner)
+			if _, found := c.memory[o.GetAddress()]; found {
+				for _, pointer := range heapdump.GetPointers(o, c.params) {
+					c.addOwner(pointer, record)
 				}
+				continue
 			}
+			c.addRecord(record)
 		}
-
 	}
 
 	return nil
 }
 
+func (c *TreeClimber) addRecord(record heapdump.Record) {
+	a, isAddressable := record.(heapdump.Addressable)
+	if isAddressable {
+		c.memory[a.GetAddress()] = record
+	}
+
+	o, isOwner := record.(heapdump.Owner)
+	if isOwner {
+		pointers := heapdump.GetPointers(o, c.params)
+		for i := 0; i < len(pointers); i++ {
+			if pointers[i] != 0 {
+				c.addOwner(pointers[i], record)
+			}
+		}
+	}
+}
+
+// If we know the program's symbols, we replace each segment with one
+// record per global variable, so that pointers from the segment can be
+// attributed to the variable that holds them.
+func (c *TreeClimber) addGlobals(segment heapdump.Owner) bool {
+	globals := c.dump.SplitSegment(segment)
+	if globals == nil {
+		return false
+	}
+	for _, g := range globals {
+		c.addRecord(g)
+	}
+	return true
+}
+
+// Returns the object that contains the indicated address, if any.
+func (c *TreeClimber) findObject(address uint64) *heapdump.Object {
+	i := c.findObjectIndex(address)
+	if i < 0 {
+		return nil
+	}
+	return c.objects[i]
+}
+
+func (c *TreeClimber) findObjectIndex(address uint64) int {
+	i := sort.Search(len(c.objects), func(i int) bool {
+		return c.objects[i].Address > address
+	}) - 1
+	if i < 0 || address >= c.objects[i].Address+uint64(len(c.objects[i].Contents)) {
+		return -1
+	}
+	return i
+}
+
 func (c *TreeClimber) addOwner(address uint64, r heapdump.Record) {
 	_, found := c.owners[address]
 	if !found {
@@ -363,3 +531,28 @@ func (c *TreeClimber) addOwner(address uint64, r heapdump.Record) {
 
 	c.owners[address] = append(c.owners[address], r)
 }
+
+// Returns the map that the object at the indicated address is part of.
+func (c *TreeClimber) mapOf(address uint64) *heapdump.MapInfo {
+	if o, isObject := c.memory[address].(*heapdump.Object); isObject {
+		return o.Map
+	}
+	return nil
+}
+
+// Returns everything outside of a map that points to any of the
+// objects that make it up.
+func (c *TreeClimber) mapOwners(m *heapdump.MapInfo) []heapdump.Record {
+	owners := make([]heapdump.Record, 0)
+	for _, part := range m.Objects {
+		// Objects with a malloc header are pointed to one word in.
+		for _, dest := range []uint64{part.Address, part.Address + c.params.PointerSize} {
+			for _, owner := range c.owners[dest] {
+				if o, isObject := owner.(*heapdump.Object); !isObject || o.Map != m {
+					owners = append(owners, owner)
+				}
+			}
+		}
+	}
+	return owners
+}